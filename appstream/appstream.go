@@ -0,0 +1,230 @@
+// Package appstream assembles AppStream catalogs from the labels of
+// Flatpak images
+package appstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels that flatpak build-bundle --oci puts on images. The appdata label
+// is the AppStream XML for the application, gzip-compressed and base64
+// encoded; the icon labels are base64-encoded PNG files, with the size in
+// pixels as the suffix.
+const (
+	LabelAppdata    = "org.freedesktop.appstream.appdata"
+	LabelIconPrefix = "org.freedesktop.appstream.icon-"
+)
+
+// Appdata bigger than this after decompression is rejected
+const maxAppdataSize = 16 * 1024 * 1024
+
+// Icon is a remote icon to add to a component
+type Icon struct {
+	Size int
+	Url  string
+}
+
+// DecodeAppdata returns the AppStream XML from the appdata label of an
+// image. Uncompressed XML is accepted as well.
+func DecodeAppdata(label string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(label)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	result, err := ioutil.ReadAll(io.LimitReader(reader, maxAppdataSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > maxAppdataSize {
+		return nil, fmt.Errorf("Appdata is bigger than %d bytes", maxAppdataSize)
+	}
+
+	return result, nil
+}
+
+// IconSizes returns the sizes of the icons in an image's labels, smallest
+// first
+func IconSizes(labels map[string]string) []int {
+	var result []int
+	for label := range labels {
+		if !strings.HasPrefix(label, LabelIconPrefix) {
+			continue
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(label, LabelIconPrefix))
+		if err == nil && size > 0 {
+			result = append(result, size)
+		}
+	}
+	sort.Ints(result)
+
+	return result
+}
+
+// DecodeIcon returns the PNG data for the icon of the given size from an
+// image's labels, or nil if there is no such icon
+func DecodeIcon(labels map[string]string, size int) ([]byte, error) {
+	label, ok := labels[LabelIconPrefix+strconv.Itoa(size)]
+	if !ok {
+		return nil, nil
+	}
+
+	return base64.StdEncoding.DecodeString(label)
+}
+
+// iconsXml formats icons as AppStream <icon/> elements
+func iconsXml(icons []Icon) []byte {
+	var b bytes.Buffer
+	for _, icon := range icons {
+		fmt.Fprintf(&b, `<icon type="remote" width="%d" height="%d">`, icon.Size, icon.Size)
+		xml.EscapeText(&b, []byte(icon.Url))
+		b.WriteString("</icon>\n")
+	}
+	return b.Bytes()
+}
+
+// ExtractComponents returns the <component/> elements of an AppStream
+// document, which can be a single component or a collection, as raw XML.
+// The icons are added to each component.
+func ExtractComponents(appdata []byte, icons []Icon) ([][]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(appdata))
+	var result [][]byte
+	depth := 0
+	// Depth and offset of the component currently being read
+	componentDepth := 0
+	var start int64
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if t.Name.Local == "component" && componentDepth == 0 {
+				componentDepth = depth
+				start = offset
+			}
+		case xml.EndElement:
+			if depth == componentDepth {
+				end := decoder.InputOffset()
+				component := appdata[start:end]
+				// Insert the icons before the end tag, unless the
+				// element is empty and has no end tag
+				if close := bytes.LastIndex(component, []byte("</")); close >= 0 && len(icons) > 0 {
+					withIcons := make([]byte, 0, len(component)+100*len(icons))
+					withIcons = append(withIcons, component[:close]...)
+					withIcons = append(withIcons, iconsXml(icons)...)
+					withIcons = append(withIcons, component[close:]...)
+					component = withIcons
+				}
+				result = append(result, component)
+				componentDepth = 0
+			}
+			depth--
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("Unexpected end of AppStream XML")
+	}
+
+	return result, nil
+}
+
+// Component holds the parts of an AppStream component used to describe
+// an application outside of a catalog
+type Component struct {
+	Id   string
+	Name string
+	// The homepage URL
+	Homepage string
+}
+
+type componentXml struct {
+	Id    string `xml:"id"`
+	Names []struct {
+		Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"name"`
+	Urls []struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"url"`
+}
+
+// ParseComponent returns the first component in an AppStream document, or
+// nil if there are none. Translations of the name are ignored.
+func ParseComponent(appdata []byte) (*Component, error) {
+	components, err := ExtractComponents(appdata, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(components) == 0 {
+		return nil, nil
+	}
+
+	var parsed componentXml
+	err = xml.Unmarshal(components[0], &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	result := Component{
+		Id: strings.TrimSpace(parsed.Id),
+	}
+	for _, name := range parsed.Names {
+		if name.Lang == "" {
+			result.Name = strings.TrimSpace(name.Value)
+			break
+		}
+	}
+	for _, url := range parsed.Urls {
+		if url.Type == "homepage" {
+			result.Homepage = strings.TrimSpace(url.Value)
+			break
+		}
+	}
+
+	return &result, nil
+}
+
+// WriteCollection writes an AppStream collection with the given
+// components
+func WriteCollection(w io.Writer, origin string, architecture string, components [][]byte) error {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<components version="0.8" origin="`)
+	xml.EscapeText(&b, []byte(origin))
+	b.WriteString(`" architecture="`)
+	xml.EscapeText(&b, []byte(architecture))
+	b.WriteString(`">` + "\n")
+	for _, component := range components {
+		b.Write(component)
+		b.WriteString("\n")
+	}
+	b.WriteString("</components>\n")
+
+	_, err := b.WriteTo(w)
+	return err
+}
@@ -0,0 +1,146 @@
+package appstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const mapsAppdata = `<?xml version="1.0" encoding="UTF-8"?>
+<components version="0.8" origin="flatpak">
+  <component type="desktop">
+    <id>org.gnome.Maps</id>
+    <name>Maps</name>
+    <name xml:lang="de">Karten</name>
+    <url type="bugtracker">https://gitlab.gnome.org/GNOME/gnome-maps/issues</url>
+    <url type="homepage">https://apps.gnome.org/Maps/</url>
+    <icon type="cached" height="64" width="64">org.gnome.Maps.png</icon>
+    <bundle type="flatpak">app/org.gnome.Maps/x86_64/stable</bundle>
+  </component>
+</components>
+`
+
+func encodeAppdata(t *testing.T, appdata string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(appdata))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestDecodeAppdata(t *testing.T) {
+	decoded, err := DecodeAppdata(encodeAppdata(t, mapsAppdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != mapsAppdata {
+		t.Errorf("Unexpected appdata %s", decoded)
+	}
+
+	decoded, err = DecodeAppdata(base64.StdEncoding.EncodeToString([]byte(mapsAppdata)))
+	if err != nil || string(decoded) != mapsAppdata {
+		t.Errorf("Uncompressed appdata not decoded: %v", err)
+	}
+
+	_, err = DecodeAppdata("not base64!")
+	if err == nil {
+		t.Errorf("Expected an error for invalid base64")
+	}
+}
+
+func TestIcons(t *testing.T) {
+	labels := map[string]string{
+		LabelIconPrefix + "128":   base64.StdEncoding.EncodeToString([]byte("PNG128")),
+		LabelIconPrefix + "64":    base64.StdEncoding.EncodeToString([]byte("PNG64")),
+		LabelIconPrefix + "large": "",
+		LabelAppdata:              "",
+	}
+
+	sizes := IconSizes(labels)
+	if len(sizes) != 2 || sizes[0] != 64 || sizes[1] != 128 {
+		t.Errorf("Unexpected sizes %v", sizes)
+	}
+
+	icon, err := DecodeIcon(labels, 64)
+	if err != nil || string(icon) != "PNG64" {
+		t.Errorf("Unexpected icon %q, %v", icon, err)
+	}
+	icon, err = DecodeIcon(labels, 32)
+	if err != nil || icon != nil {
+		t.Errorf("Expected no icon, got %q, %v", icon, err)
+	}
+}
+
+func TestExtractComponents(t *testing.T) {
+	components, err := ExtractComponents([]byte(mapsAppdata), []Icon{
+		{Size: 64, Url: "https://flagstate.example.com/appstream/icons/sha256:1234/64.png?a&b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(components) != 1 {
+		t.Fatalf("Expected 1 component, got %d", len(components))
+	}
+	component := string(components[0])
+	if !strings.HasPrefix(component, `<component type="desktop">`) ||
+		!strings.HasSuffix(component, `<icon type="remote" width="64" height="64">`+
+			`https://flagstate.example.com/appstream/icons/sha256:1234/64.png?a&amp;b</icon>`+"\n</component>") {
+		t.Errorf("Unexpected component %s", component)
+	}
+
+	// A metainfo file is a single component
+	components, err = ExtractComponents([]byte(`<component><id>org.example.App</id></component>`), nil)
+	if err != nil || len(components) != 1 || string(components[0]) != `<component><id>org.example.App</id></component>` {
+		t.Errorf("Unexpected components %q, %v", components, err)
+	}
+
+	_, err = ExtractComponents([]byte(`<components><component><id>`), nil)
+	if err == nil {
+		t.Errorf("Expected an error for truncated XML")
+	}
+}
+
+func TestParseComponent(t *testing.T) {
+	component, err := ParseComponent([]byte(mapsAppdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Component{Id: "org.gnome.Maps", Name: "Maps", Homepage: "https://apps.gnome.org/Maps/"}
+	if component == nil || *component != expected {
+		t.Errorf("Expected %+v, got %+v", expected, component)
+	}
+
+	component, err = ParseComponent([]byte(`<components version="0.8"></components>`))
+	if component != nil || err != nil {
+		t.Errorf("Expected no component, got %+v, %v", component, err)
+	}
+}
+
+func TestWriteCollection(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteCollection(&buf, "flagstate", "amd64", [][]byte{
+		[]byte(`<component><id>a</id></component>`),
+		[]byte(`<component><id>b</id></component>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<components version="0.8" origin="flagstate" architecture="amd64">
+<component><id>a</id></component>
+<component><id>b</id></component>
+</components>
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected collection %s", buf.String())
+	}
+}
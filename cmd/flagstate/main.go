@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/owtaylor/flagstate"
 	"github.com/owtaylor/flagstate/database"
@@ -29,6 +30,19 @@ func startTimers(config *flagstate.Config, fetcher *fetcher.Fetcher) {
 	}()
 }
 
+func openDatabase(config *flagstate.Config) database.Database {
+	if postgresUrl := config.Database.Postgres.Url; postgresUrl != "" {
+		db, err := database.NewPostgresDB(postgresUrl, config.Search.Labels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return db
+	}
+
+	log.Fatal("No database configured")
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -37,21 +51,29 @@ func main() {
 		log.Fatal(err)
 	}
 
-	var db database.Database
+	db := openDatabase(config)
 
-	if postgresUrl := config.Database.Postgres.Url; postgresUrl != "" {
-		db, err = database.NewPostgresDB(postgresUrl)
-		if err != nil {
-			log.Fatal(err)
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "import-vulnerabilities":
+			importVulnerabilities(db, flag.Args()[1:])
+		case "reindex-search":
+			// Needed after changing the labels used for searching
+			err := database.UpdateSearchText(context.Background(), db)
+			if err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("Unknown command '%s'", flag.Arg(0))
 		}
-	}
-
-	if db == nil {
-		log.Fatal("No database configured")
+		return
 	}
 
 	changes := util.NewChangeBroadcaster()
-	fetcher := fetcher.NewFetcher(db, changes, config.Registry.Url)
+	fetcher, err := fetcher.NewFetcher(db, changes, config)
+	if err != nil {
+		log.Fatal(err)
+	}
 	fetcher.FetchAll()
 	startTimers(config, fetcher)
 
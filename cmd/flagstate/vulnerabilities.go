@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate/database"
+	"github.com/owtaylor/flagstate/vulnerability"
+	"io/ioutil"
+	"log"
+)
+
+// importVulnerabilities implements:
+//
+//	flagstate import-vulnerabilities [-format trivy|grype] [-digest DIGEST] REPORT.json
+//
+// which stores the output of a scanner for an indexed image
+func importVulnerabilities(db database.Database, args []string) {
+	flags := flag.NewFlagSet("import-vulnerabilities", flag.ExitOnError)
+	format := flags.String("format", "", "Scanner output format (trivy or grype); guessed if not specified")
+	digestArg := flags.String("digest", "", "Digest of the scanned image, not an image list; found from the report if not specified")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: flagstate import-vulnerabilities [-format FORMAT] [-digest DIGEST] REPORT.json")
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := vulnerability.ParseReport(data, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dgst := report.Digest
+	if *digestArg != "" {
+		dgst, err = digest.ParseDigest(*digestArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if dgst == "" {
+		log.Fatal("The report doesn't include the image digest; use -digest")
+	}
+
+	err = database.ImportVulnerabilities(context.Background(), db, dgst, report.Scanner, report.Vulnerabilities)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Imported %d vulnerabilities for %s", len(report.Vulnerabilities), dgst)
+}
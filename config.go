@@ -26,9 +26,65 @@ func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type Config struct {
+	// The URL that flagstate itself is reachable at, used for links in
+	// generated files. If unset, it is determined from each request.
+	PublicUrl string `yaml:"public_url"`
+
 	Registry struct {
 		Url       string
 		PublicUrl string `yaml:"public_url"`
+		// Credentials used when the registry requests authentication,
+		// either directly via basic auth, or via a token server
+		Username     string
+		Password     string
+		PasswordFile string `yaml:"password_file"`
+		RefreshToken string `yaml:"refresh_token"`
+		Tls          struct {
+			CaFile             string `yaml:"ca_file"`
+			CaDir              string `yaml:"ca_dir"`
+			CertFile           string `yaml:"cert_file"`
+			KeyFile            string `yaml:"key_file"`
+			MinVersion         string `yaml:"min_version"`
+			InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+		}
+		Proxy struct {
+			// If unset, the HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment
+			// variables are used
+			Url     string
+			NoProxy []string `yaml:"no_proxy"`
+		}
+	}
+	Verification struct {
+		// Public keys, in PEM format, that cosign signatures are
+		// checked against. The id is used to refer to the key in queries.
+		Keys []struct {
+			Id   string
+			File string
+		}
+	}
+	Vulnerabilities struct {
+		// Bearer token required to import scanner results. If unset,
+		// the import endpoint is disabled.
+		ImportToken string `yaml:"import_token"`
+	}
+	Inspection struct {
+		// Download the layers of new images to find /etc/os-release.
+		// This can mean downloading much more than the manifests.
+		OSRelease bool `yaml:"os_release"`
+		// Inspection stops at a layer with a bigger compressed size;
+		// the default is 256MiB
+		MaxLayerSize int64 `yaml:"max_layer_size"`
+	}
+	Flatpak struct {
+		// Suggested name for the remote in generated .flatpakref files
+		RemoteName string `yaml:"remote_name"`
+		// Title of the remote in the generated .flatpakrepo file
+		Title string
+	}
+	Search struct {
+		// Labels whose values are included in full-text search, in
+		// addition to the repository name, title, and description
+		Labels []string
 	}
 	Components struct {
 		WebUI          bool `yaml:"web_ui"`
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/docker/distribution/digest"
 	"github.com/owtaylor/flagstate"
+	"strconv"
 	"time"
 )
 
@@ -13,6 +14,16 @@ const (
 	QueryIs = iota
 	QueryExists
 	QueryMatches
+	QueryBefore
+	QueryAfter
+)
+
+type SortKey int
+
+const (
+	SortNone = iota
+	SortCreated
+	SortPushed
 )
 
 type QueryTerm struct {
@@ -24,15 +35,45 @@ type Query struct {
 	repository   []QueryTerm
 	tag          []QueryTerm
 	os           []QueryTerm
+	osVersion    []QueryTerm
+	osFeature    []QueryTerm
 	architecture []QueryTerm
+	variant      []QueryTerm
+	mediaType    []QueryTerm
 	annotations  map[string][]QueryTerm
 	labels       map[string][]QueryTerm
+	osRelease    map[string][]QueryTerm
+	// Keyed by the name of the field in flagstate.FlatpakMetadata
+	flatpak      map[string][]QueryTerm
+	flatpakLists map[string][]QueryTerm
+	created      []QueryTerm
+	pushed       []QueryTerm
+	basedOn      []QueryTerm
+	artifactType []QueryTerm
+	referrerType []QueryTerm
+	signedBy     []QueryTerm
+	// Package terms must all match the same package
+	packageName    []QueryTerm
+	packageVersion []QueryTerm
+	packagePurl    []QueryTerm
+	maxSeverity    []QueryTerm
+	// Full-text search queries, which must all match
+	search []string
+
+	includeConfig  bool
+	includeLayers  bool
+	includeFailed  bool
+	sortKey        SortKey
+	sortDescending bool
 }
 
 func NewQuery() *Query {
 	return &Query{
-		annotations: make(map[string][]QueryTerm),
-		labels:      make(map[string][]QueryTerm),
+		annotations:  make(map[string][]QueryTerm),
+		labels:       make(map[string][]QueryTerm),
+		osRelease:    make(map[string][]QueryTerm),
+		flatpak:      make(map[string][]QueryTerm),
+		flatpakLists: make(map[string][]QueryTerm),
 	}
 }
 
@@ -56,11 +97,135 @@ func (q *Query) OS(os string) *Query {
 	return q
 }
 
+func (q *Query) OSVersion(osVersion string) *Query {
+	q.osVersion = append(q.osVersion, QueryTerm{QueryIs, osVersion})
+	return q
+}
+
+func (q *Query) OSVersionMatches(osVersion string) *Query {
+	q.osVersion = append(q.osVersion, QueryTerm{QueryMatches, osVersion})
+	return q
+}
+
+func (q *Query) OSFeature(osFeature string) *Query {
+	q.osFeature = append(q.osFeature, QueryTerm{QueryIs, osFeature})
+	return q
+}
+
 func (q *Query) Architecture(architecture string) *Query {
 	q.architecture = append(q.architecture, QueryTerm{QueryIs, architecture})
 	return q
 }
 
+func (q *Query) Variant(variant string) *Query {
+	q.variant = append(q.variant, QueryTerm{QueryIs, variant})
+	return q
+}
+
+// MediaType matches images and artifacts with the given manifest media type
+func (q *Query) MediaType(mediaType string) *Query {
+	q.mediaType = append(q.mediaType, QueryTerm{QueryIs, mediaType})
+	return q
+}
+
+// ArtifactType matches artifacts with the given artifact type. A query with
+// an ArtifactType term doesn't return images or lists.
+func (q *Query) ArtifactType(artifactType string) *Query {
+	q.artifactType = append(q.artifactType, QueryTerm{QueryIs, artifactType})
+	return q
+}
+
+// HasSignature matches images, lists, and artifacts that have a signature
+// referring to them in the same repository
+func (q *Query) HasSignature() *Query {
+	q.referrerType = append(q.referrerType, QueryTerm{QueryIs, flagstate.ReferrerSignature})
+	return q
+}
+
+// HasSBOM matches images, lists, and artifacts that have an SBOM referring
+// to them in the same repository
+func (q *Query) HasSBOM() *Query {
+	q.referrerType = append(q.referrerType, QueryTerm{QueryIs, flagstate.ReferrerSBOM})
+	return q
+}
+
+// SignedBy matches images, lists, and artifacts that have a cosign
+// signature that was verified against the configured key with the given id
+func (q *Query) SignedBy(keyId string) *Query {
+	q.signedBy = append(q.signedBy, QueryTerm{QueryIs, keyId})
+	return q
+}
+
+// PackageName matches images with an SBOM that lists a package with the
+// given name. The other Package terms of the query must match the same
+// package.
+func (q *Query) PackageName(name string) *Query {
+	q.packageName = append(q.packageName, QueryTerm{QueryIs, name})
+	return q
+}
+
+// PackageVersion matches packages with exactly the given version
+func (q *Query) PackageVersion(version string) *Query {
+	q.packageVersion = append(q.packageVersion, QueryTerm{QueryIs, version})
+	return q
+}
+
+// PackageVersionBefore matches packages with versions older than the given
+// version, comparing versions the way RPM does
+func (q *Query) PackageVersionBefore(version string) *Query {
+	q.packageVersion = append(q.packageVersion, QueryTerm{QueryBefore, version})
+	return q
+}
+
+// PackageVersionAfter matches packages with versions the same as or newer
+// than the given version
+func (q *Query) PackageVersionAfter(version string) *Query {
+	q.packageVersion = append(q.packageVersion, QueryTerm{QueryAfter, version})
+	return q
+}
+
+// PackagePurl matches packages with the given package URL. Qualifiers and
+// subpath are ignored, and if purl has no version, any version matches.
+func (q *Query) PackagePurl(purl string) *Query {
+	base, version := splitPurl(purl)
+	q.packagePurl = append(q.packagePurl, QueryTerm{QueryIs, base})
+	if version != "" {
+		q.PackageVersion(version)
+	}
+	return q
+}
+
+// MaxSeverityBelow matches images that have had scanner results imported
+// without any vulnerabilities as severe as severity, which is one of the
+// flagstate.Severity constants
+func (q *Query) MaxSeverityBelow(severity string) *Query {
+	rank, _ := flagstate.SeverityRank(severity)
+	q.maxSeverity = append(q.maxSeverity, QueryTerm{QueryBefore, strconv.Itoa(rank)})
+	return q
+}
+
+// MaxSeverityAtLeast matches images with a vulnerability that is at least
+// as severe as severity
+func (q *Query) MaxSeverityAtLeast(severity string) *Query {
+	rank, _ := flagstate.SeverityRank(severity)
+	q.maxSeverity = append(q.maxSeverity, QueryTerm{QueryAfter, strconv.Itoa(rank)})
+	return q
+}
+
+func (q *Query) hasPackageTerms() bool {
+	return len(q.packageName) > 0 || len(q.packageVersion) > 0 || len(q.packagePurl) > 0
+}
+
+// hasImageTerms is true if the query has terms that only apply to images,
+// in which case it doesn't return artifacts.
+func (q *Query) hasImageTerms() bool {
+	return len(q.os) > 0 || len(q.osVersion) > 0 || len(q.osFeature) > 0 ||
+		len(q.architecture) > 0 || len(q.variant) > 0 || len(q.labels) > 0 ||
+		len(q.osRelease) > 0 || len(q.created) > 0 || len(q.basedOn) > 0 ||
+		q.hasPackageTerms() || len(q.maxSeverity) > 0 ||
+		len(q.flatpak) > 0 || len(q.flatpakLists) > 0 || len(q.search) > 0
+}
+
 func (q *Query) AnnotationExists(annotation string) *Query {
 	q.annotations[annotation] = append(q.annotations[annotation],
 		QueryTerm{QueryExists, ""})
@@ -97,24 +262,232 @@ func (q *Query) LabelMatches(label string, pattern string) *Query {
 	return q
 }
 
+// OSReleaseExists matches images where layer inspection found the given
+// key, such as "ID" or "VERSION_ID", in /etc/os-release
+func (q *Query) OSReleaseExists(key string) *Query {
+	q.osRelease[key] = append(q.osRelease[key],
+		QueryTerm{QueryExists, ""})
+	return q
+}
+
+func (q *Query) OSReleaseIs(key string, value string) *Query {
+	q.osRelease[key] = append(q.osRelease[key],
+		QueryTerm{QueryIs, value})
+	return q
+}
+
+func (q *Query) OSReleaseMatches(key string, pattern string) *Query {
+	q.osRelease[key] = append(q.osRelease[key],
+		QueryTerm{QueryMatches, pattern})
+	return q
+}
+
+// FlatpakId matches images containing the Flatpak application or runtime
+// with the given ID, such as org.gnome.Maps
+func (q *Query) FlatpakId(id string) *Query {
+	q.flatpak["Id"] = append(q.flatpak["Id"], QueryTerm{QueryIs, id})
+	return q
+}
+
+func (q *Query) FlatpakBranch(branch string) *Query {
+	q.flatpak["Branch"] = append(q.flatpak["Branch"], QueryTerm{QueryIs, branch})
+	return q
+}
+
+// FlatpakRuntime matches Flatpak applications using a runtime, given as
+// ID/ARCH/BRANCH
+func (q *Query) FlatpakRuntime(runtime string) *Query {
+	q.flatpak["Runtime"] = append(q.flatpak["Runtime"], QueryTerm{QueryIs, runtime})
+	return q
+}
+
+func (q *Query) FlatpakRuntimeMatches(pattern string) *Query {
+	q.flatpak["Runtime"] = append(q.flatpak["Runtime"], QueryTerm{QueryMatches, pattern})
+	return q
+}
+
+func (q *Query) FlatpakSdk(sdk string) *Query {
+	q.flatpak["Sdk"] = append(q.flatpak["Sdk"], QueryTerm{QueryIs, sdk})
+	return q
+}
+
+// FlatpakShared matches Flatpaks with the given --share permission
+func (q *Query) FlatpakShared(subsystem string) *Query {
+	q.flatpakLists["Shared"] = append(q.flatpakLists["Shared"], QueryTerm{QueryIs, subsystem})
+	return q
+}
+
+func (q *Query) FlatpakSocket(socket string) *Query {
+	q.flatpakLists["Sockets"] = append(q.flatpakLists["Sockets"], QueryTerm{QueryIs, socket})
+	return q
+}
+
+func (q *Query) FlatpakDevice(device string) *Query {
+	q.flatpakLists["Devices"] = append(q.flatpakLists["Devices"], QueryTerm{QueryIs, device})
+	return q
+}
+
+// FlatpakFilesystem matches Flatpaks with the given --filesystem
+// permission, with any access mode unless the argument has one, so "home"
+// also matches "home:ro"
+func (q *Query) FlatpakFilesystem(filesystem string) *Query {
+	q.flatpakLists["Filesystems"] = append(q.flatpakLists["Filesystems"], QueryTerm{QueryIs, filesystem})
+	return q
+}
+
+func (q *Query) FlatpakExtension(extension string) *Query {
+	q.flatpakLists["Extensions"] = append(q.flatpakLists["Extensions"], QueryTerm{QueryIs, extension})
+	return q
+}
+
+func timeArgument(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// CreatedBefore matches images where the image configuration has a created
+// time before t.
+func (q *Query) CreatedBefore(t time.Time) *Query {
+	q.created = append(q.created, QueryTerm{QueryBefore, timeArgument(t)})
+	return q
+}
+
+// CreatedAfter matches images where the image configuration has a created
+// time at or after t.
+func (q *Query) CreatedAfter(t time.Time) *Query {
+	q.created = append(q.created, QueryTerm{QueryAfter, timeArgument(t)})
+	return q
+}
+
+// PushedBefore matches tags that were first seen pointing to their
+// current image or list before t.
+func (q *Query) PushedBefore(t time.Time) *Query {
+	q.pushed = append(q.pushed, QueryTerm{QueryBefore, timeArgument(t)})
+	return q
+}
+
+// PushedAfter matches tags that were first seen pointing to their
+// current image or list at or after t.
+func (q *Query) PushedAfter(t time.Time) *Query {
+	q.pushed = append(q.pushed, QueryTerm{QueryAfter, timeArgument(t)})
+	return q
+}
+
+// BasedOn matches images built on top of the image or image list with the
+// given digest: images whose layers start with all the layers of the base
+// image, or that name it in an org.opencontainers.image.base.digest
+// annotation.
+func (q *Query) BasedOn(dgst digest.Digest) *Query {
+	q.basedOn = append(q.basedOn, QueryTerm{QueryIs, string(dgst)})
+	return q
+}
+
+// Search matches images and lists where the words of text are found in
+// the repository name, the title, the description, or the labels configured
+// for searching. The text can use the syntax of web search engines, like
+// quoted phrases, "or", and "-word" to exclude a word. Repositories in
+// the result are ordered by relevance, best first.
+func (q *Query) Search(text string) *Query {
+	q.search = append(q.search, text)
+	return q
+}
+
+// Sort orders the images and lists within each repository of the result.
+// Images and lists without a value for the key are sorted last.
+func (q *Query) Sort(key SortKey, descending bool) *Query {
+	q.sortKey = key
+	q.sortDescending = descending
+	return q
+}
+
+// IncludeConfig causes the Created, Author, Config, and History fields of
+// images to be returned. They are omitted by default to keep results small.
+func (q *Query) IncludeConfig() *Query {
+	q.includeConfig = true
+	return q
+}
+
+// IncludeLayers causes the ConfigBlob and Layers fields of images to be
+// returned.
+func (q *Query) IncludeLayers() *Query {
+	q.includeLayers = true
+	return q
+}
+
+// IncludeFailedTags causes the tags of each repository that couldn't be
+// fetched to be returned. Only the Repository, Tag, and Search terms of the
+// query apply to failed tags.
+func (q *Query) IncludeFailedTags() *Query {
+	q.includeFailed = true
+	return q
+}
+
+// RepositoryBlob is a blob referenced by an image or artifact in a repository
+type RepositoryBlob struct {
+	Repository string
+	Digest     digest.Digest
+	Size       int64
+}
+
 type Tx interface {
 	Commit() error
 	Rollback() error
 	Modified() (bool, time.Time)
 
 	DoQuery(query *Query) ([]*flagstate.Repository, error)
+	// Look up a stored image or list in any repository, returning nil
+	// if it isn't found
+	GetImage(dgst digest.Digest) (*flagstate.Image, error)
+	GetImageList(dgst digest.Digest) (*flagstate.ImageList, error)
+	GetArtifact(dgst digest.Digest) (*flagstate.Artifact, error)
+	// Returns each blob referenced by a tagged image or artifact once per
+	// repository
+	RepositoryBlobs() ([]RepositoryBlob, error)
+	GetAncestry(dgst digest.Digest) (*Ancestry, error)
 
 	StoreImage(repository string, image *flagstate.TaggedImage) error
 	StoreImageList(repository string, list *flagstate.TaggedImageList) error
+	StoreArtifact(repository string, artifact *flagstate.TaggedArtifact) error
 
 	SetImageTags(repository string, dgst digest.Digest, tags []string) error
 	SetImageListTags(repository string, dgst digest.Digest, tags []string) error
+	SetArtifactTags(repository string, dgst digest.Digest, tags []string) error
+	// Returns the referrers to subject stored for the repository
+	GetReferrers(repository string, subject digest.Digest) ([]*flagstate.Referrer, error)
+	// Replaces the referrers to subject stored for the repository
+	SetReferrers(repository string, subject digest.Digest, referrers []*flagstate.Referrer) error
+	// Returns the results of verifying the signatures of subject, sorted
+	// by key id
+	GetSignatureVerifications(repository string, subject digest.Digest) ([]*flagstate.SignatureVerification, error)
+	// Replaces the results of verifying the signatures of subject
+	SetSignatureVerifications(repository string, subject digest.Digest, verifications []*flagstate.SignatureVerification) error
+	// Replaces the packages listed in the SBOMs of an image or image list
+	// in the repository
+	SetPackages(repository string, dgst digest.Digest, packages []*flagstate.Package) error
+	// Replaces the vulnerabilities found by scanner for an image
+	SetVulnerabilities(dgst digest.Digest, scanner string, vulnerabilities []*flagstate.Vulnerability) error
+	// Counts the vulnerabilities at least as severe as minRank in the
+	// images tagged in each repository
+	GetVulnerabilityReport(minRank int) ([]*RepositoryVulnerabilities, error)
+	// Recomputes the full-text search vectors of all images, after the
+	// labels used for searching have changed
+	UpdateSearchText() error
+	// Returns the repositories where the name, or the title or description
+	// of the representative image, matches the ILIKE pattern, and the
+	// total number of matches
+	SearchRepositories(pattern string, offset int, limit int) ([]*SearchResult, int, error)
+	// Replaces the failed tags for the repository
+	SetFailedTags(repository string, failedTags []*flagstate.FailedTag) error
 
 	DeleteImage(repository string, dgst digest.Digest) error
 	DeleteImageList(repository string, dgst digest.Digest) error
+	DeleteArtifact(repository string, dgst digest.Digest) error
 
 	DeleteMissingRepos(allRepos map[string]bool) error
 	DeleteUnused() error
+
+	// A nil fetchErr records a successful fetch
+	SetFetchStatus(repository string, fetchErr error) (*FetchStatus, error)
+	GetFetchStatus(unhealthyOnly bool) ([]*FetchStatus, error)
 }
 
 type Database interface {
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"context"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+)
+
+// GetImage returns the image with the given digest, including its
+// configuration and layers, or ErrImageNotFound if it isn't indexed
+func GetImage(ctx context.Context, db Database, dgst digest.Digest) (*flagstate.Image, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	image, err := tx.GetImage(dgst)
+	if err != nil {
+		return nil, err
+	}
+	if image == nil {
+		return nil, ErrImageNotFound
+	}
+
+	return image, nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/docker/distribution/digest"
+)
+
+const (
+	AnnotationBaseDigest = "org.opencontainers.image.base.digest"
+	AnnotationBaseName   = "org.opencontainers.image.base.name"
+)
+
+// Ancestry chains longer than this are assumed to be a loop in the
+// annotations and are cut off.
+const maxAncestry = 32
+
+var ErrImageNotFound = errors.New("Image not found")
+
+// Ancestor is an image that another image was built on top of
+type Ancestor struct {
+	Digest digest.Digest
+	// Set if the base image was named by annotation as an image list
+	List digest.Digest `json:",omitempty"`
+	// From the org.opencontainers.image.base.name annotation
+	Name string `json:",omitempty"`
+	// How the ancestor was found - "annotation" or "layers"
+	Source string
+	// The number of layers of the ancestor, all shared with its descendants
+	Layers int
+	// Where the ancestor is tagged, as <repository>:<tag>. If empty, the
+	// ancestor was only found via annotation and isn't in the index.
+	Tags []string
+}
+
+// Ancestry is the result of Tx.GetAncestry
+type Ancestry struct {
+	Digest digest.Digest
+	// Nearest ancestor first
+	Ancestors []Ancestor
+}
+
+// layerPrefixExpr returns an SQL expression that is true if the layers of
+// the image with alias base are a proper prefix of the layers of the image
+// with alias image. The containment check is redundant, but allows the
+// imageLayerDigests index to be used.
+func layerPrefixExpr(base string, image string) string {
+	return image + `.LayerDigests @> ` + base + `.LayerDigests ` +
+		`AND cardinality(` + base + `.LayerDigests) > 0 ` +
+		`AND cardinality(` + base + `.LayerDigests) < cardinality(` + image + `.LayerDigests) ` +
+		`AND ` + image + `.LayerDigests[1:cardinality(` + base + `.LayerDigests)] = ` + base + `.LayerDigests`
+}
+
+// GetAncestry finds the chain of base images that the image with the given
+// digest was built from. The org.opencontainers.image.base.digest annotation
+// is used when present; otherwise the indexed image with the longest
+// proper prefix of the image's layers is taken to be the base.
+func GetAncestry(ctx context.Context, db Database, dgst digest.Digest) (*Ancestry, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return tx.GetAncestry(dgst)
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"sort"
+	"strings"
+)
+
+// AffectedTag is a tag pointing to an image, or an image list, that
+// contains a package matched by a query
+type AffectedTag struct {
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// versionKey returns a string that sorts byte by byte in the same order as
+// versions compare in RPM: runs of digits compare numerically and are newer
+// than runs of letters, separators are ignored, and a version that is a
+// prefix of another is older.
+func versionKey(version string) string {
+	var b strings.Builder
+	for i := 0; i < len(version); {
+		j := i + 1
+		if isDigit(version[i]) {
+			for j < len(version) && isDigit(version[j]) {
+				j++
+			}
+			digits := strings.TrimLeft(version[i:j], "0")
+			if len(digits) > 99 {
+				digits = digits[:99]
+			}
+			fmt.Fprintf(&b, ".1%02d%s", len(digits), digits)
+		} else if isLetter(version[i]) {
+			for j < len(version) && isLetter(version[j]) {
+				j++
+			}
+			b.WriteString(".0" + version[i:j])
+		}
+		i = j
+	}
+
+	return b.String()
+}
+
+// splitPurl splits a package URL into the part identifying the package and
+// the version, dropping any qualifiers and subpath
+func splitPurl(purl string) (base string, version string) {
+	if i := strings.IndexByte(purl, '#'); i >= 0 {
+		purl = purl[:i]
+	}
+	if i := strings.IndexByte(purl, '?'); i >= 0 {
+		purl = purl[:i]
+	}
+	// An '@' in the namespace or name is percent-encoded
+	if i := strings.LastIndexByte(purl, '@'); i >= 0 {
+		return purl[:i], purl[i+1:]
+	}
+
+	return purl, ""
+}
+
+// GetAffectedTags returns the tags of the images and image lists matching
+// the query, which should have Package terms, sorted by repository and tag
+func GetAffectedTags(ctx context.Context, db Database, query *Query) ([]*AffectedTag, error) {
+	repos, err := db.DoQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*AffectedTag, 0)
+	for _, repo := range repos {
+		for _, image := range repo.Images {
+			for _, tag := range image.Tags {
+				result = append(result, &AffectedTag{repo.Name, tag, image.Digest})
+			}
+		}
+		for _, list := range repo.Lists {
+			for _, tag := range list.Tags {
+				result = append(result, &AffectedTag{repo.Name, tag, list.Digest})
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Repository != result[j].Repository {
+			return result[i].Repository < result[j].Repository
+		}
+		return result[i].Tag < result[j].Tag
+	})
+
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestVersionKey(t *testing.T) {
+	// Each version is older than the next
+	versions := []string{
+		"0.9",
+		"1",
+		"1.0",
+		"1.0a",
+		"1.0.1",
+		"1.2",
+		"1.10",
+		"1.10.0-1",
+		"3.0.7",
+		"10.0",
+	}
+	for i := 0; i+1 < len(versions); i++ {
+		a, b := versionKey(versions[i]), versionKey(versions[i+1])
+		if a >= b {
+			t.Errorf("Expected %s (%s) < %s (%s)", versions[i], a, versions[i+1], b)
+		}
+	}
+
+	if versionKey("1.01") != versionKey("1.1") || versionKey("1_1") != versionKey("1.1") {
+		t.Errorf("Leading zeros and separators should be ignored")
+	}
+}
+
+func TestSplitPurl(t *testing.T) {
+	for _, c := range []struct {
+		purl    string
+		base    string
+		version string
+	}{
+		{"pkg:rpm/fedora/openssl", "pkg:rpm/fedora/openssl", ""},
+		{"pkg:rpm/fedora/openssl@3.0.7-1.fc37?arch=x86_64", "pkg:rpm/fedora/openssl", "3.0.7-1.fc37"},
+		{"pkg:npm/%40angular/core@16.0.0#sub/path", "pkg:npm/%40angular/core", "16.0.0"},
+	} {
+		base, version := splitPurl(c.purl)
+		if base != c.base || version != c.version {
+			t.Errorf("%s: expected '%s' '%s', got '%s' '%s'", c.purl, c.base, c.version, base, version)
+		}
+	}
+}
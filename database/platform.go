@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/owtaylor/flagstate"
+)
+
+var (
+	ErrTagNotFound        = errors.New("Tag not found")
+	ErrNoMatchingPlatform = errors.New("No image matches the requested platform")
+)
+
+// ResolvedImage is the result of ResolvePlatform
+type ResolvedImage struct {
+	Repository string
+	Tag        string
+	// Set if the tag points to an image list
+	List   *flagstate.ImageList `json:",omitempty"`
+	Image  *flagstate.Image
+	Reason string
+}
+
+// ResolvePlatform finds the image that best matches platform for the
+// given repository and tag. If the tag points to an image list, the
+// entries of the list are considered; if it points to a single image,
+// that image is checked for compatibility.
+func ResolvePlatform(ctx context.Context, db Database, repository string, tag string, platform flagstate.Platform) (*ResolvedImage, error) {
+	repos, err := db.DoQuery(ctx, NewQuery().Repository(repository).Tag(tag))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ResolvedImage{
+		Repository: repository,
+		Tag:        tag,
+	}
+
+	var images []*flagstate.Image
+	for _, repo := range repos {
+		for _, list := range repo.Lists {
+			result.List = &list.ImageList
+			images = list.Images
+		}
+		for _, image := range repo.Images {
+			images = append(images, &image.Image)
+		}
+	}
+
+	if len(images) == 0 {
+		return nil, ErrTagNotFound
+	}
+
+	match := platform.BestMatch(images)
+	if match == nil {
+		return nil, ErrNoMatchingPlatform
+	}
+
+	result.Image = match.Image
+	result.Reason = match.Reason
+	if result.List != nil {
+		result.Reason = "image list entry: " + result.Reason
+	}
+
+	return result, nil
+}
@@ -6,36 +6,48 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/docker/distribution/digest"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/owtaylor/flagstate"
 	"log"
 	"sort"
+	"strings"
 	"time"
 )
 
 type postgresDatabase struct {
-	db *sql.DB
+	db           *sql.DB
+	searchLabels []string
 }
 
 type postgresTransaction struct {
 	tx               *sql.Tx
 	modify           bool
 	modificationTime time.Time
+	searchLabels     []string
 }
 
-func NewPostgresDB(url string) (Database, error) {
+// NewPostgresDB opens a Postgres database. The values of searchLabels are
+// included in the full-text search text of images.
+func NewPostgresDB(url string, searchLabels []string) (Database, error) {
 	db, err := sql.Open("postgres", url)
 	if err != nil {
 		return nil, err
 	}
 
+	if searchLabels == nil {
+		searchLabels = []string{}
+	}
+
 	return &postgresDatabase{
-		db: db,
+		db:           db,
+		searchLabels: searchLabels,
 	}, nil
 }
 
 func (pdb *postgresDatabase) Begin(ctx context.Context) (Tx, error) {
-	ptx := postgresTransaction{}
+	ptx := postgresTransaction{
+		searchLabels: pdb.searchLabels,
+	}
 
 	var err error
 	ptx.tx, err = pdb.db.BeginTx(ctx, nil)
@@ -108,24 +120,108 @@ func (ptx postgresTransaction) exec(query string, args ...interface{}) (sql.Resu
 	return res, err
 }
 
+// imageJsonExpr returns an SQL expression converting a row of the image table
+// to JSON, omitting the columns the query doesn't need.
+func imageJsonExpr(alias string, query *Query) string {
+	result := `to_jsonb(` + alias + `) - 'layerdigests' - 'searchtext'`
+	if !query.includeConfig {
+		result += ` - 'created' - 'author' - 'config' - 'history'`
+	}
+	if query.includeLayers {
+		result += ` || jsonb_build_object('Layers', ` +
+			`(SELECT jsonb_agg(jsonb_build_object('Digest', l.Digest, 'MediaType', l.MediaType, 'Size', l.Size) ORDER BY l.Position) ` +
+			`FROM layer l WHERE l.Image = ` + alias + `.Digest))`
+	} else {
+		result += ` - 'configblob'`
+	}
+
+	return `(` + result + `)`
+}
+
+// orderExpr returns the ORDER BY clause to sort results within each
+// repository, given the SQL expressions for the different sort keys.
+func orderExpr(query *Query, repository string, created string, pushed string) string {
+	result := `ORDER BY ` + repository
+	switch query.sortKey {
+	case SortCreated:
+		result += `, ` + created
+	case SortPushed:
+		result += `, ` + pushed
+	default:
+		return result
+	}
+
+	if query.sortDescending {
+		result += ` DESC NULLS LAST`
+	} else {
+		result += ` ASC NULLS LAST`
+	}
+
+	return result
+}
+
+// hasReferrerExpr returns an SQL expression that is true if the subject has
+// a referrer of the given type in the repository
+func hasReferrerExpr(repository string, subject string, referrerType string) string {
+	return `EXISTS (SELECT 1 FROM referrer r WHERE r.Repository = ` + repository +
+		` AND r.Subject = ` + subject + ` AND r.Type = '` + referrerType + `')`
+}
+
+// verificationsExpr returns an SQL expression for a JSON array of the
+// results of verifying the signatures of the subject in the repository
+func verificationsExpr(repository string, subject string) string {
+	return `(SELECT jsonb_agg(jsonb_build_object('KeyId', v.KeyId, 'Verified', v.Verified, 'Error', v.Error) ORDER BY v.KeyId) ` +
+		`FROM signatureVerification v WHERE v.Repository = ` + repository + ` AND v.Subject = ` + subject + `)`
+}
+
+// vulnerabilitySummaryExpr returns an SQL expression for a JSON
+// flagstate.VulnerabilitySummary for the image, or NULL if no scanner
+// results have been imported for it
+func vulnerabilitySummaryExpr(image string) string {
+	count := func(severity string) string {
+		return `count(v.Id) FILTER (WHERE v.Severity = '` + severity + `')`
+	}
+	return `(SELECT jsonb_build_object(` +
+		`'Scanner', s.Scanner, 'Imported', s.Imported, ` +
+		`'Critical', ` + count(flagstate.SeverityCritical) + `, ` +
+		`'High', ` + count(flagstate.SeverityHigh) + `, ` +
+		`'Medium', ` + count(flagstate.SeverityMedium) + `, ` +
+		`'Low', ` + count(flagstate.SeverityLow) + `, ` +
+		`'Unknown', ` + count(flagstate.SeverityUnknown) + `) ` +
+		`FROM vulnerabilityScan s LEFT JOIN vulnerability v ON v.Image = s.Image ` +
+		`WHERE s.Image = ` + image + ` GROUP BY s.Image, s.Scanner, s.Imported)`
+}
+
 const imageQueryTemplate = `
 WITH x AS
     (SELECT DISTINCT
         t.Repository, t.Image
      FROM imageTag t JOIN image i on i.Digest = t.Image
-     %s)
+     %[1]s)
 SELECT
      repository,
-     (select to_json(i) from image i where i.Digest = Image) as image,
-     (select jsonb_agg(t.Tag) from imageTag t where t.Image = x.Image and t.Repository = Repository) as tags
+     (select %[2]s from image i where i.Digest = Image) as image,
+     (select jsonb_agg(t.Tag) from imageTag t where t.Image = x.Image and t.Repository = x.Repository) as tags,
+     (select min(t.FirstSeen) from imageTag t where t.Image = x.Image and t.Repository = x.Repository) as pushed,
+     %[4]s as hasSignature,
+     %[5]s as hasSBOM,
+     %[6]s as verifications,
+     %[7]s as vulnerabilities
 FROM x
-ORDER by Repository
+%[3]s
 `
 
 func (ptx postgresTransaction) doImageQuery(query *Query) ([]*flagstate.Repository, error) {
-	whereClause, args := makeWhereClause(query)
+	whereClause, args := makeWhereClause(query, `t.Image`)
 
-	imageQuery := fmt.Sprintf(imageQueryTemplate, whereClause)
+	imageQuery := fmt.Sprintf(imageQueryTemplate, whereClause, imageJsonExpr("i", query),
+		orderExpr(query, `Repository`,
+			`(SELECT Created FROM image i WHERE i.Digest = x.Image)`,
+			`pushed`),
+		hasReferrerExpr(`x.Repository`, `x.Image`, flagstate.ReferrerSignature),
+		hasReferrerExpr(`x.Repository`, `x.Image`, flagstate.ReferrerSBOM),
+		verificationsExpr(`x.Repository`, `x.Image`),
+		vulnerabilitySummaryExpr(`x.Image`))
 
 	rows, err := ptx.tx.Query(imageQuery, args...)
 	if err != nil {
@@ -139,8 +235,11 @@ func (ptx postgresTransaction) doImageQuery(query *Query) ([]*flagstate.Reposito
 		var repository string
 		var imageJson []byte
 		var tagsJson []byte
+		var verificationsJson []byte
+		var vulnerabilitiesJson []byte
 
-		err = rows.Scan(&repository, &imageJson, &tagsJson)
+		err = rows.Scan(&repository, &imageJson, &tagsJson, &image.Pushed, &image.HasSignature, &image.HasSBOM,
+			&verificationsJson, &vulnerabilitiesJson)
 		if err != nil {
 			return nil, err
 		}
@@ -163,12 +262,34 @@ func (ptx postgresTransaction) doImageQuery(query *Query) ([]*flagstate.Reposito
 			log.Print(err)
 			continue
 		}
+		err = unmarshalVerifications(verificationsJson, &image.Verifications)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if vulnerabilitiesJson != nil {
+			err = json.Unmarshal(vulnerabilitiesJson, &image.Vulnerabilities)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+		}
 		currentRepository.Images = append(currentRepository.Images, &image)
 	}
 
 	return result, nil
 }
 
+// unmarshalVerifications parses the result of verificationsExpr, which is
+// NULL if there are no verifications
+func unmarshalVerifications(verificationsJson []byte, verifications *[]*flagstate.SignatureVerification) error {
+	if verificationsJson == nil {
+		return nil
+	}
+
+	return json.Unmarshal(verificationsJson, verifications)
+}
+
 const listQueryTemplate = `
 WITH x AS
     (SELECT DISTINCT
@@ -176,21 +297,33 @@ WITH x AS
      FROM listTag t
      JOIN listEntry le ON t.List = le.List
      JOIN image i ON i.Digest = le.Image
-     %s)
+     %[1]s)
 SELECT
     Repository,
     to_jsonb((SELECT l FROM list l WHERE l.Digest = x.List)) AS list,
-    jsonb_agg((SELECT image FROM image WHERE image.Digest = x.Digest)) AS images,
-    (SELECT jsonb_agg(t.Tag) from listTag t where t.List = x.List) AS tags
+    jsonb_agg((SELECT %[2]s || jsonb_build_object('Vulnerabilities', %[7]s) FROM image WHERE image.Digest = x.Digest)) AS images,
+    (SELECT jsonb_agg(t.Tag) from listTag t where t.List = x.List and t.Repository = x.Repository) AS tags,
+    (SELECT min(t.FirstSeen) from listTag t where t.List = x.List and t.Repository = x.Repository) AS pushed,
+    %[4]s AS hasSignature,
+    %[5]s AS hasSBOM,
+    %[6]s AS verifications
 FROM x
     JOIN list l ON l.Digest = x.List
 GROUP BY x.Repository, x.List
+%[3]s
 `
 
 func (ptx postgresTransaction) doListQuery(query *Query) ([]*flagstate.Repository, error) {
-	whereClause, args := makeWhereClause(query)
+	whereClause, args := makeWhereClause(query, `t.List`)
 
-	listQuery := fmt.Sprintf(listQueryTemplate, whereClause)
+	listQuery := fmt.Sprintf(listQueryTemplate, whereClause, imageJsonExpr("image", query),
+		orderExpr(query, `x.Repository`,
+			`max((SELECT Created FROM image WHERE image.Digest = x.Digest))`,
+			`pushed`),
+		hasReferrerExpr(`x.Repository`, `x.List`, flagstate.ReferrerSignature),
+		hasReferrerExpr(`x.Repository`, `x.List`, flagstate.ReferrerSBOM),
+		verificationsExpr(`x.Repository`, `x.List`),
+		vulnerabilitySummaryExpr(`x.Digest`))
 
 	rows, err := ptx.tx.Query(listQuery, args...)
 	if err != nil {
@@ -205,7 +338,9 @@ func (ptx postgresTransaction) doListQuery(query *Query) ([]*flagstate.Repositor
 		var list flagstate.TaggedImageList
 		var imagesJson []byte
 		var tagsJson []byte
-		err = rows.Scan(&repository, &listJson, &imagesJson, &tagsJson)
+		var pushed *time.Time
+		var verificationsJson []byte
+		err = rows.Scan(&repository, &listJson, &imagesJson, &tagsJson, &pushed, &list.HasSignature, &list.HasSBOM, &verificationsJson)
 		if err != nil {
 			return nil, err
 		}
@@ -228,6 +363,13 @@ func (ptx postgresTransaction) doListQuery(query *Query) ([]*flagstate.Repositor
 			continue
 		}
 
+		err = unmarshalVerifications(verificationsJson, &list.Verifications)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		list.Pushed = pushed
+
 		if currentRepository == nil || repository != currentRepository.Name {
 			currentRepository = &flagstate.Repository{
 				Name:   repository,
@@ -279,6 +421,25 @@ func (ptx postgresTransaction) DoQuery(query *Query) ([]*flagstate.Repository, e
 		}
 	}
 
+	result, err = ptx.addArtifacts(query, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.includeFailed {
+		result, err = ptx.addFailedTags(query, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(query.search) > 0 {
+		err = ptx.sortBySearchRank(query, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	for _, repo := range result {
 		for _, image := range repo.Images {
 			sort.Strings(image.Tags)
@@ -286,11 +447,457 @@ func (ptx postgresTransaction) DoQuery(query *Query) ([]*flagstate.Repository, e
 		for _, list := range repo.Lists {
 			sort.Strings(list.Tags)
 		}
+		for _, artifact := range repo.Artifacts {
+			sort.Strings(artifact.Tags)
+		}
+	}
+
+	return result, nil
+}
+
+const searchRankQueryTemplate = `
+SELECT t.Repository, max(ts_rank(%[1]s || i.SearchText, %[2]s))
+FROM (SELECT Repository, Image FROM imageTag
+      UNION ALL
+      SELECT lt.Repository, le.Image FROM listTag lt JOIN listEntry le ON le.List = lt.List) t
+    JOIN image i ON i.Digest = t.Image
+WHERE t.Repository = ANY($1)
+GROUP BY t.Repository
+`
+
+// sortBySearchRank sorts the repositories in the result of a query with
+// full-text search terms by the rank of their best matching image, keeping
+// the order of repositories with the same rank
+func (ptx postgresTransaction) sortBySearchRank(query *Query, result []*flagstate.Repository) error {
+	names := make([]string, len(result))
+	for i, repo := range result {
+		names[i] = repo.Name
+	}
+
+	args := []interface{}{pq.Array(names)}
+	tsqueries := make([]string, len(query.search))
+	for i, text := range query.search {
+		args = append(args, text)
+		tsqueries[i] = searchQueryExpr(fmt.Sprintf("$%d", len(args)))
+	}
+
+	rows, err := ptx.tx.Query(
+		fmt.Sprintf(searchRankQueryTemplate, repositorySearchExpr(`t.Repository`), strings.Join(tsqueries, ` && `)),
+		args...)
+	if err != nil {
+		return err
+	}
+
+	ranks := make(map[string]float64)
+	for rows.Next() {
+		var repository string
+		var rank float64
+		err = rows.Scan(&repository, &rank)
+		if err != nil {
+			return err
+		}
+		ranks[repository] = rank
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return ranks[result[i].Name] > ranks[result[j].Name]
+	})
+
+	return nil
+}
+
+const repositoryBlobsQuery = `
+WITH repoImage AS
+    (SELECT t.Repository, t.Image FROM imageTag t
+     UNION
+     SELECT t.Repository, le.Image FROM listTag t JOIN listEntry le ON le.List = t.List)
+SELECT r.Repository, l.Digest, l.Size
+FROM repoImage r JOIN layer l ON l.Image = r.Image
+UNION
+SELECT r.Repository, i.ConfigBlob->>'Digest', (i.ConfigBlob->>'Size')::bigint
+FROM repoImage r JOIN image i ON i.Digest = r.Image
+WHERE i.ConfigBlob IS NOT NULL AND i.ConfigBlob != 'null'
+UNION
+SELECT t.Repository, l->>'Digest', (l->>'Size')::bigint
+FROM artifactTag t JOIN artifact a ON a.Digest = t.Artifact,
+     jsonb_array_elements(CASE WHEN jsonb_typeof(a.Layers) = 'array' THEN a.Layers ELSE '[]' END) l
+UNION
+SELECT t.Repository, a.ConfigBlob->>'Digest', (a.ConfigBlob->>'Size')::bigint
+FROM artifactTag t JOIN artifact a ON a.Digest = t.Artifact
+WHERE a.ConfigBlob IS NOT NULL AND a.ConfigBlob != 'null'
+ORDER BY 1, 2
+`
+
+func (ptx postgresTransaction) RepositoryBlobs() ([]RepositoryBlob, error) {
+	rows, err := ptx.tx.Query(repositoryBlobsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]RepositoryBlob, 0)
+	for rows.Next() {
+		var blob RepositoryBlob
+		err := rows.Scan(&blob.Repository, &blob.Digest, &blob.Size)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, blob)
 	}
 
 	return result, nil
 }
 
+// ancestorTags finds where an image is tagged, directly or as part of a list
+func (ptx postgresTransaction) ancestorTags(dgst digest.Digest) ([]string, error) {
+	rows, err := ptx.tx.Query(
+		`SELECT t.Repository || ':' || t.Tag FROM imageTag t WHERE t.Image = $1 `+
+			`UNION `+
+			`SELECT t.Repository || ':' || t.Tag FROM listTag t JOIN listEntry le ON le.List = t.List WHERE le.Image = $1 `+
+			`ORDER BY 1`,
+		dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		err := rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, tag)
+	}
+
+	return result, nil
+}
+
+// annotatedAncestor finds the image named by the base image annotations of
+// the image, preferring, if it is a list, an entry with the same platform.
+func (ptx postgresTransaction) annotatedAncestor(baseDigest string, baseName string, os string, architecture string, variant string) (*Ancestor, error) {
+	ancestor := &Ancestor{
+		Digest: digest.Digest(baseDigest),
+		Name:   baseName,
+		Source: "annotation",
+	}
+
+	var resolved digest.Digest
+	err := ptx.tx.QueryRow(
+		`SELECT i.Digest, cardinality(i.LayerDigests) FROM image i `+
+			`WHERE i.Digest = $1 OR i.Digest IN (SELECT le.Image FROM listEntry le WHERE le.List = $1) `+
+			`ORDER BY i.Digest = $1 DESC, (i.OS = $2 AND i.Architecture = $3) DESC, i.Variant = $4 DESC, i.Digest `+
+			`LIMIT 1`,
+		baseDigest, os, architecture, variant).Scan(&resolved, &ancestor.Layers)
+	if err == sql.ErrNoRows {
+		ancestor.Tags = make([]string, 0)
+		return ancestor, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if resolved != ancestor.Digest {
+		ancestor.List = ancestor.Digest
+		ancestor.Digest = resolved
+	}
+
+	return ancestor, nil
+}
+
+// layerAncestor finds the image with the most layers that are a proper
+// prefix of the layers of the image.
+func (ptx postgresTransaction) layerAncestor(dgst digest.Digest) (*Ancestor, error) {
+	ancestor := &Ancestor{
+		Source: "layers",
+	}
+
+	err := ptx.tx.QueryRow(
+		`SELECT b.Digest, cardinality(b.LayerDigests) FROM image i, image b `+
+			`WHERE i.Digest = $1 AND `+layerPrefixExpr(`b`, `i`)+` `+
+			`ORDER BY cardinality(b.LayerDigests) DESC, b.Digest `+
+			`LIMIT 1`,
+		dgst).Scan(&ancestor.Digest, &ancestor.Layers)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ancestor, nil
+}
+
+func (ptx postgresTransaction) GetAncestry(dgst digest.Digest) (*Ancestry, error) {
+	ancestry := &Ancestry{
+		Digest:    dgst,
+		Ancestors: make([]Ancestor, 0),
+	}
+
+	seen := map[digest.Digest]bool{dgst: true}
+	current := dgst
+	for len(ancestry.Ancestors) < maxAncestry {
+		var baseDigest, baseName, os, architecture, variant sql.NullString
+		err := ptx.tx.QueryRow(
+			`SELECT jsonb_object_field_text(Annotations, $2), jsonb_object_field_text(Annotations, $3), `+
+				`OS, Architecture, Variant FROM image WHERE Digest = $1`,
+			current, AnnotationBaseDigest, AnnotationBaseName).Scan(&baseDigest, &baseName, &os, &architecture, &variant)
+		if err == sql.ErrNoRows {
+			if current == dgst {
+				return nil, ErrImageNotFound
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var ancestor *Ancestor
+		if baseDigest.String != "" {
+			ancestor, err = ptx.annotatedAncestor(baseDigest.String, baseName.String,
+				os.String, architecture.String, variant.String)
+		} else {
+			ancestor, err = ptx.layerAncestor(current)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ancestor == nil || seen[ancestor.Digest] {
+			break
+		}
+		seen[ancestor.Digest] = true
+
+		if ancestor.Tags == nil {
+			ancestor.Tags, err = ptx.ancestorTags(ancestor.Digest)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ancestry.Ancestors = append(ancestry.Ancestors, *ancestor)
+
+		current = ancestor.Digest
+	}
+
+	return ancestry, nil
+}
+
+func (ptx postgresTransaction) GetImage(dgst digest.Digest) (*flagstate.Image, error) {
+	query := NewQuery().IncludeConfig().IncludeLayers()
+
+	var imageJson []byte
+	err := ptx.tx.QueryRow(
+		`SELECT `+imageJsonExpr("i", query)+` FROM image i WHERE i.Digest = $1`,
+		dgst).Scan(&imageJson)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var image flagstate.Image
+	err = json.Unmarshal(imageJson, &image)
+	if err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+func (ptx postgresTransaction) GetImageList(dgst digest.Digest) (*flagstate.ImageList, error) {
+	query := NewQuery().IncludeConfig().IncludeLayers()
+
+	var listJson []byte
+	var imagesJson []byte
+	err := ptx.tx.QueryRow(
+		`SELECT to_jsonb(l), `+
+			`COALESCE((SELECT jsonb_agg(`+imageJsonExpr("i", query)+` ORDER BY i.Digest) `+
+			`FROM listEntry le JOIN image i ON i.Digest = le.Image WHERE le.List = l.Digest), '[]') `+
+			`FROM list l WHERE l.Digest = $1`,
+		dgst).Scan(&listJson, &imagesJson)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list flagstate.ImageList
+	err = json.Unmarshal(listJson, &list)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(imagesJson, &list.Images)
+	if err != nil {
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+func (ptx postgresTransaction) GetArtifact(dgst digest.Digest) (*flagstate.Artifact, error) {
+	var artifactJson []byte
+	err := ptx.tx.QueryRow(
+		`SELECT to_jsonb(a) FROM artifact a WHERE a.Digest = $1`,
+		dgst).Scan(&artifactJson)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var artifact flagstate.Artifact
+	err = json.Unmarshal(artifactJson, &artifact)
+	if err != nil {
+		return nil, err
+	}
+
+	return &artifact, nil
+}
+
+// repositoryMap is used to add items to the repositories of a query
+// result, creating repositories that aren't there yet
+type repositoryMap struct {
+	byName map[string]*flagstate.Repository
+	result []*flagstate.Repository
+	added  bool
+}
+
+func newRepositoryMap(result []*flagstate.Repository) *repositoryMap {
+	rm := &repositoryMap{
+		byName: make(map[string]*flagstate.Repository),
+		result: result,
+	}
+	for _, repo := range result {
+		rm.byName[repo.Name] = repo
+	}
+
+	return rm
+}
+
+func (rm *repositoryMap) get(name string) *flagstate.Repository {
+	repo := rm.byName[name]
+	if repo == nil {
+		repo = &flagstate.Repository{
+			Name:   name,
+			Images: make([]*flagstate.TaggedImage, 0),
+			Lists:  make([]*flagstate.TaggedImageList, 0),
+		}
+		rm.byName[name] = repo
+		rm.result = append(rm.result, repo)
+		rm.added = true
+	}
+
+	return repo
+}
+
+func (rm *repositoryMap) sorted() []*flagstate.Repository {
+	if rm.added {
+		sort.Slice(rm.result, func(i, j int) bool {
+			return rm.result[i].Name < rm.result[j].Name
+		})
+	}
+
+	return rm.result
+}
+
+const artifactQueryTemplate = `
+WITH x AS
+    (SELECT DISTINCT
+        t.Repository, t.Artifact
+     FROM artifactTag t JOIN artifact i on i.Digest = t.Artifact
+     %[1]s)
+SELECT
+     repository,
+     (select to_jsonb(i) from artifact i where i.Digest = Artifact) as artifact,
+     (select jsonb_agg(t.Tag) from artifactTag t where t.Artifact = x.Artifact and t.Repository = x.Repository) as tags,
+     (select min(t.FirstSeen) from artifactTag t where t.Artifact = x.Artifact and t.Repository = x.Repository) as pushed,
+     %[3]s as hasSignature,
+     %[4]s as hasSBOM,
+     %[5]s as verifications
+FROM x
+%[2]s
+`
+
+// addArtifacts adds artifacts matching the query to the repositories in
+// result, adding any repositories that only have artifacts.
+func (ptx postgresTransaction) addArtifacts(query *Query, result []*flagstate.Repository) ([]*flagstate.Repository, error) {
+	whereClause, args := makeArtifactWhereClause(query)
+
+	// Artifacts have no creation time, so sorting by created leaves them
+	// in the order of the repository
+	artifactQuery := fmt.Sprintf(artifactQueryTemplate, whereClause,
+		orderExpr(query, `Repository`, `Repository`, `pushed`),
+		hasReferrerExpr(`x.Repository`, `x.Artifact`, flagstate.ReferrerSignature),
+		hasReferrerExpr(`x.Repository`, `x.Artifact`, flagstate.ReferrerSBOM),
+		verificationsExpr(`x.Repository`, `x.Artifact`))
+
+	rows, err := ptx.tx.Query(artifactQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := newRepositoryMap(result)
+	for rows.Next() {
+		var artifact flagstate.TaggedArtifact
+		var repository string
+		var artifactJson []byte
+		var tagsJson []byte
+		var verificationsJson []byte
+
+		err = rows.Scan(&repository, &artifactJson, &tagsJson, &artifact.Pushed, &artifact.HasSignature, &artifact.HasSBOM, &verificationsJson)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(artifactJson, &artifact)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		err = json.Unmarshal(tagsJson, &artifact.Tags)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		err = unmarshalVerifications(verificationsJson, &artifact.Verifications)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		repo := byName.get(repository)
+		repo.Artifacts = append(repo.Artifacts, &artifact)
+	}
+
+	return byName.sorted(), nil
+}
+
+// addFailedTags adds failed tags matching the query to the repositories
+// in result, adding any repositories that only have failed tags.
+func (ptx postgresTransaction) addFailedTags(query *Query, result []*flagstate.Repository) ([]*flagstate.Repository, error) {
+	whereClause, args := makeFailedTagWhereClause(query)
+	rows, err := ptx.tx.Query(
+		`SELECT f.Repository, f.Tag, f.Digest, f.MediaType, f.Error FROM failedTag f `+
+			whereClause+` ORDER BY f.Repository, f.Tag`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := newRepositoryMap(result)
+	for rows.Next() {
+		var repository string
+		var failedTag flagstate.FailedTag
+		var dgst, mediaType sql.NullString
+		err := rows.Scan(&repository, &failedTag.Tag, &dgst, &mediaType, &failedTag.Error)
+		if err != nil {
+			return nil, err
+		}
+		failedTag.Digest = digest.Digest(dgst.String)
+		failedTag.MediaType = mediaType.String
+
+		repo := byName.get(repository)
+		repo.FailedTags = append(repo.FailedTags, &failedTag)
+	}
+
+	return byName.sorted(), nil
+}
+
 func (ptx postgresTransaction) getTags(repository string, target string, dgst digest.Digest) (map[string]bool, error) {
 	rows, err := ptx.tx.Query(
 		`SELECT Tag FROM `+target+`Tag WHERE `+target+` = $1 `,
@@ -324,7 +931,8 @@ func (ptx postgresTransaction) setTags(repository string, target string, targetU
 		_, err := ptx.exec(
 			`INSERT INTO `+target+`Tag (Repository, Tag, `+targetUpper+` ) `+
 				`VALUES ($1, $2, $3) `+
-				`ON CONFLICT (Repository, Tag) DO UPDATE SET `+targetUpper+` = $3 `,
+				`ON CONFLICT (Repository, Tag) DO UPDATE SET `+targetUpper+` = $3, FirstSeen = now() `+
+				`WHERE `+target+`Tag.`+targetUpper+` IS DISTINCT FROM $3 `,
 			repository, tag, dgst)
 
 		if err != nil {
@@ -353,14 +961,339 @@ func (ptx postgresTransaction) SetImageListTags(repository string, dgst digest.D
 	return ptx.setTags(repository, "list", "List", dgst, tags)
 }
 
+func (ptx postgresTransaction) SetArtifactTags(repository string, dgst digest.Digest, tags []string) error {
+	return ptx.setTags(repository, "artifact", "Artifact", dgst, tags)
+}
+
 func (ptx postgresTransaction) storeImage(repository string, image *flagstate.Image) error {
 	log.Printf("Storing image %s/%s", repository, image.Digest)
 	annotationsJson, _ := json.Marshal(image.Annotations)
 	labelsJson, _ := json.Marshal(image.Labels)
+	osReleaseJson, _ := json.Marshal(image.OSRelease)
+	flatpakJson, _ := json.Marshal(image.Flatpak)
+	osFeatures := image.OSFeatures
+	if osFeatures == nil {
+		osFeatures = []string{}
+	}
+	osFeaturesJson, _ := json.Marshal(osFeatures)
+	configJson, _ := json.Marshal(image.Config)
+	historyJson, _ := json.Marshal(image.History)
+	configBlobJson, _ := json.Marshal(image.ConfigBlob)
+	layerDigests := make([]string, len(image.Layers))
+	for i, layer := range image.Layers {
+		layerDigests[i] = string(layer.Digest)
+	}
+	res, err := ptx.exec(
+		`INSERT INTO image (Digest, MediaType, Architecture, Variant, OS, OSVersion, OSFeatures, Annotations, Labels, `+
+			`OSRelease, Flatpak, Created, Author, Config, History, ConfigBlob, Size, LayerDigests) `+
+			`VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18) ON CONFLICT (digest) DO NOTHING `,
+		image.Digest, image.MediaType, image.Architecture, image.Variant,
+		image.OS, image.OSVersion, osFeaturesJson, annotationsJson, labelsJson,
+		osReleaseJson, flatpakJson, image.Created, image.Author, configJson, historyJson, configBlobJson, image.Size,
+		pq.Array(layerDigests))
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// The image may have been stored on its own, without the
+		// platform details that an entry in an image list provides
+		_, err = ptx.exec(
+			`UPDATE image SET Architecture = COALESCE(NULLIF(Architecture, ''), $2), `+
+				`Variant = COALESCE(NULLIF(Variant, ''), $3), `+
+				`OS = COALESCE(NULLIF(OS, ''), $4), `+
+				`OSVersion = COALESCE(NULLIF(OSVersion, ''), $5), `+
+				`OSFeatures = CASE WHEN COALESCE(OSFeatures, '[]') = '[]' THEN $6 ELSE OSFeatures END `+
+				`WHERE Digest = $1 AND ((COALESCE(Architecture, '') = '' AND $2 != '') `+
+				`OR (COALESCE(Variant, '') = '' AND $3 != '') `+
+				`OR (COALESCE(OS, '') = '' AND $4 != '') `+
+				`OR (COALESCE(OSVersion, '') = '' AND $5 != '') `+
+				`OR (COALESCE(OSFeatures, '[]') = '[]' AND $6::jsonb != '[]')) `,
+			image.Digest, image.Architecture, image.Variant, image.OS, image.OSVersion, osFeaturesJson)
+		return err
+	}
+
+	_, err = ptx.tx.Exec(
+		`UPDATE image i SET SearchText = `+imageSearchTextExpr(`i`, `$2`)+` WHERE i.Digest = $1`,
+		image.Digest, pq.Array(ptx.searchLabels))
+	if err != nil {
+		return err
+	}
+
+	for i, layer := range image.Layers {
+		_, err := ptx.tx.Exec(
+			`INSERT INTO layer (Image, Position, Digest, MediaType, Size) `+
+				`VALUES ($1, $2, $3, $4, $5) `,
+			image.Digest, i, layer.Digest, layer.MediaType, layer.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ptx postgresTransaction) GetReferrers(repository string, subject digest.Digest) ([]*flagstate.Referrer, error) {
+	rows, err := ptx.tx.Query(
+		`SELECT Digest, MediaType, ArtifactType, Type, Tag FROM referrer `+
+			`WHERE Repository = $1 AND Subject = $2 ORDER BY Digest`,
+		repository, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*flagstate.Referrer, 0)
+	for rows.Next() {
+		referrer := flagstate.Referrer{Subject: subject}
+		var artifactType, tag sql.NullString
+		err := rows.Scan(&referrer.Digest, &referrer.MediaType, &artifactType, &referrer.Type, &tag)
+		if err != nil {
+			return nil, err
+		}
+		referrer.ArtifactType = artifactType.String
+		referrer.Tag = tag.String
+		result = append(result, &referrer)
+	}
+
+	return result, nil
+}
+
+func (ptx postgresTransaction) SetReferrers(repository string, subject digest.Digest, referrers []*flagstate.Referrer) error {
+	log.Printf("Setting referrers for %s@%s", repository, subject)
+	_, err := ptx.exec(
+		`DELETE FROM referrer WHERE Repository = $1 AND Subject = $2 `,
+		repository, subject)
+	if err != nil {
+		return err
+	}
+
+	for _, referrer := range referrers {
+		_, err := ptx.exec(
+			`INSERT INTO referrer (Repository, Subject, Digest, MediaType, ArtifactType, Type, Tag) `+
+				`VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (Repository, Subject, Digest) DO NOTHING `,
+			repository, subject, referrer.Digest, referrer.MediaType, referrer.ArtifactType,
+			referrer.Type, referrer.Tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ptx postgresTransaction) GetSignatureVerifications(repository string, subject digest.Digest) ([]*flagstate.SignatureVerification, error) {
+	rows, err := ptx.tx.Query(
+		`SELECT KeyId, Verified, Error FROM signatureVerification `+
+			`WHERE Repository = $1 AND Subject = $2 ORDER BY KeyId`,
+		repository, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*flagstate.SignatureVerification, 0)
+	for rows.Next() {
+		var verification flagstate.SignatureVerification
+		var verificationError sql.NullString
+		err := rows.Scan(&verification.KeyId, &verification.Verified, &verificationError)
+		if err != nil {
+			return nil, err
+		}
+		verification.Error = verificationError.String
+		result = append(result, &verification)
+	}
+
+	return result, nil
+}
+
+func (ptx postgresTransaction) SetSignatureVerifications(repository string, subject digest.Digest, verifications []*flagstate.SignatureVerification) error {
+	log.Printf("Setting signature verifications for %s@%s", repository, subject)
+	_, err := ptx.exec(
+		`DELETE FROM signatureVerification WHERE Repository = $1 AND Subject = $2 `,
+		repository, subject)
+	if err != nil {
+		return err
+	}
+
+	for _, verification := range verifications {
+		_, err := ptx.exec(
+			`INSERT INTO signatureVerification (Repository, Subject, KeyId, Verified, Error) `+
+				`VALUES ($1, $2, $3, $4, $5) `,
+			repository, subject, verification.KeyId, verification.Verified, verification.Error)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ptx postgresTransaction) SetPackages(repository string, dgst digest.Digest, packages []*flagstate.Package) error {
+	log.Printf("Setting %d packages for %s/%s", len(packages), repository, dgst)
+	_, err := ptx.exec(`DELETE FROM package WHERE Repository = $1 AND Image = $2 `, repository, dgst)
+	if err != nil {
+		return err
+	}
+
+	for _, pkg := range packages {
+		purlBase, _ := splitPurl(pkg.Purl)
+		_, err := ptx.exec(
+			`INSERT INTO package (Repository, Image, Name, Version, VersionKey, Purl, PurlBase) `+
+				`VALUES ($1, $2, $3, $4, $5, $6, $7) `,
+			repository, dgst, pkg.Name, pkg.Version, versionKey(pkg.Version), pkg.Purl, purlBase)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ptx postgresTransaction) SetVulnerabilities(dgst digest.Digest, scanner string, vulnerabilities []*flagstate.Vulnerability) error {
+	log.Printf("Setting %d vulnerabilities for %s", len(vulnerabilities), dgst)
+	_, err := ptx.exec(`DELETE FROM vulnerability WHERE Image = $1 `, dgst)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vulnerabilities {
+		rank, _ := flagstate.SeverityRank(v.Severity)
+		_, err := ptx.exec(
+			`INSERT INTO vulnerability (Image, Id, Package, InstalledVersion, FixedVersion, Severity, SeverityRank) `+
+				`VALUES ($1, $2, $3, $4, $5, $6, $7) `,
+			dgst, v.Id, v.Package, v.InstalledVersion, v.FixedVersion, v.Severity, rank)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = ptx.exec(
+		`INSERT INTO vulnerabilityScan (Image, Scanner, Imported) VALUES ($1, $2, now()) `+
+			`ON CONFLICT (Image) DO UPDATE SET Scanner = $2, Imported = now() `,
+		dgst, scanner)
+
+	return err
+}
+
+const vulnerabilityReportQuery = `
+WITH tagged AS
+    (SELECT Repository, Image FROM imageTag
+     UNION
+     SELECT t.Repository, le.Image FROM listTag t JOIN listEntry le ON le.List = t.List)
+SELECT
+    t.Repository,
+    count(DISTINCT t.Image) AS images,
+    count(*) FILTER (WHERE v.Severity = 'CRITICAL') AS critical,
+    count(*) FILTER (WHERE v.Severity = 'HIGH') AS high,
+    count(*) FILTER (WHERE v.Severity = 'MEDIUM') AS medium,
+    count(*) FILTER (WHERE v.Severity = 'LOW') AS low,
+    count(*) FILTER (WHERE v.Severity = 'UNKNOWN') AS unknown
+FROM tagged t JOIN vulnerability v ON v.Image = t.Image
+WHERE v.SeverityRank >= $1
+GROUP BY t.Repository
+ORDER BY critical DESC, high DESC, medium DESC, low DESC, unknown DESC, t.Repository
+`
+
+func (ptx postgresTransaction) GetVulnerabilityReport(minRank int) ([]*RepositoryVulnerabilities, error) {
+	rows, err := ptx.tx.Query(vulnerabilityReportQuery, minRank)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*RepositoryVulnerabilities, 0)
+	for rows.Next() {
+		var r RepositoryVulnerabilities
+		err = rows.Scan(&r.Repository, &r.Images, &r.Critical, &r.High, &r.Medium, &r.Low, &r.Unknown)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &r)
+	}
+
+	return result, nil
+}
+
+// searchQueryTemplate finds the representative image of each repository,
+// preferring images tagged "latest", then the most recently pushed
+const searchQueryTemplate = `
+WITH tagged AS
+    (SELECT Repository, Image, Tag, FirstSeen FROM imageTag
+     UNION ALL
+     SELECT t.Repository, le.Image, t.Tag, t.FirstSeen FROM listTag t JOIN listEntry le ON le.List = t.List),
+representative AS
+    (SELECT DISTINCT ON (Repository) Repository, Image FROM tagged
+     ORDER BY Repository, Tag = 'latest' DESC, FirstSeen DESC NULLS LAST, Image),
+described AS
+    (SELECT r.Repository, %[1]s AS Title, %[2]s AS Description
+     FROM representative r JOIN image i ON i.Digest = r.Image),
+matched AS
+    (SELECT * FROM described
+     WHERE Repository ILIKE $1 OR Title ILIKE $1 OR Description ILIKE $1)
+%[3]s
+`
+
+func (ptx postgresTransaction) UpdateSearchText() error {
 	_, err := ptx.exec(
-		`INSERT INTO image (Digest, MediaType, Architecture, OS, Annotations, Labels) `+
-			`VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (digest) DO NOTHING `,
-		image.Digest, image.MediaType, image.Architecture, image.OS, annotationsJson, labelsJson)
+		`UPDATE image i SET SearchText = `+imageSearchTextExpr(`i`, `$1`),
+		pq.Array(ptx.searchLabels))
+	return err
+}
+
+func (ptx postgresTransaction) SearchRepositories(pattern string, offset int, limit int) ([]*SearchResult, int, error) {
+	searchQuery := func(selection string) string {
+		return fmt.Sprintf(searchQueryTemplate,
+			metadataExpr("i", flagstate.TitleSources),
+			metadataExpr("i", flagstate.DescriptionSources),
+			selection)
+	}
+
+	var total int
+	err := ptx.tx.QueryRow(searchQuery(`SELECT count(*) FROM matched`), pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := ptx.tx.Query(
+		searchQuery(`SELECT Repository, Title, Description FROM matched ORDER BY Repository LIMIT $2 OFFSET $3`),
+		pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]*SearchResult, 0)
+	for rows.Next() {
+		var r SearchResult
+		err = rows.Scan(&r.Repository, &r.Title, &r.Description)
+		if err != nil {
+			return nil, 0, err
+		}
+		result = append(result, &r)
+	}
+
+	return result, total, nil
+}
+
+func (ptx postgresTransaction) SetFailedTags(repository string, failedTags []*flagstate.FailedTag) error {
+	tags := make([]string, 0, len(failedTags))
+	for _, failedTag := range failedTags {
+		tags = append(tags, failedTag.Tag)
+		_, err := ptx.exec(
+			`INSERT INTO failedTag (Repository, Tag, Digest, MediaType, Error) `+
+				`VALUES ($1, $2, $3, $4, $5) `+
+				`ON CONFLICT (Repository, Tag) DO UPDATE SET Digest = $3, MediaType = $4, Error = $5 `+
+				`WHERE (failedTag.Digest, failedTag.MediaType, failedTag.Error) IS DISTINCT FROM ($3, $4, $5) `,
+			repository, failedTag.Tag, failedTag.Digest, failedTag.MediaType, failedTag.Error)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := ptx.exec(
+		`DELETE FROM failedTag WHERE Repository = $1 AND NOT (Tag = ANY($2)) `,
+		repository, pq.Array(tags))
+
 	return err
 }
 
@@ -377,9 +1310,9 @@ func (ptx postgresTransaction) storeImageList(repository string, list *flagstate
 	log.Printf("Storing list %s/%s", repository, list.Digest)
 	annotationsJson, _ := json.Marshal(list.Annotations)
 	res, err := ptx.exec(
-		`INSERT INTO list (Digest, MediaType, Annotations) `+
-			`VALUES ($1, $2, $3) ON CONFLICT (Digest) DO NOTHING `,
-		list.Digest, list.MediaType, annotationsJson)
+		`INSERT INTO list (Digest, MediaType, Annotations, Size) `+
+			`VALUES ($1, $2, $3, $4) ON CONFLICT (Digest) DO NOTHING `,
+		list.Digest, list.MediaType, annotationsJson, list.Size)
 	if err != nil {
 		return err
 	}
@@ -418,6 +1351,24 @@ func (ptx postgresTransaction) StoreImageList(repository string, list *flagstate
 	return ptx.SetImageListTags(repository, list.Digest, list.Tags)
 }
 
+func (ptx postgresTransaction) StoreArtifact(repository string, artifact *flagstate.TaggedArtifact) error {
+	log.Printf("Storing artifact %s/%s", repository, artifact.Digest)
+	configBlobJson, _ := json.Marshal(artifact.ConfigBlob)
+	annotationsJson, _ := json.Marshal(artifact.Annotations)
+	layersJson, _ := json.Marshal(artifact.Layers)
+	helmJson, _ := json.Marshal(artifact.Helm)
+	_, err := ptx.exec(
+		`INSERT INTO artifact (Digest, MediaType, ArtifactType, ConfigBlob, Annotations, Layers, Size, Helm) `+
+			`VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (Digest) DO NOTHING `,
+		artifact.Digest, artifact.MediaType, artifact.ArtifactType, configBlobJson,
+		annotationsJson, layersJson, artifact.Size, helmJson)
+	if err != nil {
+		return err
+	}
+
+	return ptx.SetArtifactTags(repository, artifact.Digest, artifact.Tags)
+}
+
 func (ptx postgresTransaction) DeleteImage(repository string, dgst digest.Digest) error {
 	log.Printf("Deleting tags for image %s/%s", repository, dgst)
 	_, err := ptx.exec(
@@ -436,6 +1387,15 @@ func (ptx postgresTransaction) DeleteImageList(repository string, dgst digest.Di
 	return err
 }
 
+func (ptx postgresTransaction) DeleteArtifact(repository string, dgst digest.Digest) error {
+	log.Printf("Deleting tags for artifact %s/%s", repository, dgst)
+	_, err := ptx.exec(
+		`DELETE FROM artifactTag WHERE Repository = $1 AND Artifact = $2 `,
+		repository, dgst)
+
+	return err
+}
+
 func (ptx postgresTransaction) deleteMissingReposFromTable(table string, allRepos map[string]bool) error {
 	toDelete := make([]string, 0)
 
@@ -456,7 +1416,7 @@ func (ptx postgresTransaction) deleteMissingReposFromTable(table string, allRepo
 	}
 
 	for _, repo := range toDelete {
-		_, err := ptx.exec(`DELETE FROM `+table+`Tag WHERE Repository = $1`,
+		_, err := ptx.exec(`DELETE FROM `+table+` WHERE Repository = $1`,
 			repo)
 		if err != nil {
 			return err
@@ -475,6 +1435,33 @@ func (ptx postgresTransaction) DeleteMissingRepos(allRepos map[string]bool) erro
 	if err != nil {
 		return err
 	}
+	err = ptx.deleteMissingReposFromTable("artifactTag", allRepos)
+	if err != nil {
+		return err
+	}
+	err = ptx.deleteMissingReposFromTable("referrer", allRepos)
+	if err != nil {
+		return err
+	}
+	err = ptx.deleteMissingReposFromTable("signatureVerification", allRepos)
+	if err != nil {
+		return err
+	}
+	err = ptx.deleteMissingReposFromTable("failedTag", allRepos)
+	if err != nil {
+		return err
+	}
+
+	repos := make([]string, 0, len(allRepos))
+	for repo := range allRepos {
+		repos = append(repos, repo)
+	}
+	_, err = ptx.tx.Exec(
+		`DELETE FROM fetchStatus WHERE NOT (Repository = ANY($1))`,
+		pq.Array(repos))
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -498,5 +1485,115 @@ func (ptx postgresTransaction) DeleteUnused() error {
 		return err
 	}
 
+	_, err = ptx.tx.Exec(
+		`DELETE FROM referrer r ` +
+			`WHERE NOT EXISTS (SELECT * FROM imageTag t WHERE t.Repository = r.Repository AND t.Image = r.Subject) ` +
+			`AND NOT EXISTS (SELECT * FROM listTag t WHERE t.Repository = r.Repository AND t.List = r.Subject) ` +
+			`AND NOT EXISTS (SELECT * FROM artifactTag t WHERE t.Repository = r.Repository AND t.Artifact = r.Subject)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = ptx.tx.Exec(
+		`DELETE FROM signatureVerification v ` +
+			`WHERE NOT EXISTS (SELECT * FROM imageTag t WHERE t.Repository = v.Repository AND t.Image = v.Subject) ` +
+			`AND NOT EXISTS (SELECT * FROM listTag t WHERE t.Repository = v.Repository AND t.List = v.Subject) ` +
+			`AND NOT EXISTS (SELECT * FROM artifactTag t WHERE t.Repository = v.Repository AND t.Artifact = v.Subject)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = ptx.tx.Exec(
+		`DELETE FROM package p ` +
+			`WHERE NOT EXISTS (SELECT * FROM imageTag t WHERE t.Repository = p.Repository AND t.Image = p.Image) ` +
+			`AND NOT EXISTS (SELECT * FROM listTag t WHERE t.Repository = p.Repository AND t.List = p.Image) ` +
+			`AND NOT EXISTS (SELECT * FROM listTag t JOIN listEntry le ON le.List = t.List ` +
+			`WHERE t.Repository = p.Repository AND le.Image = p.Image)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = ptx.tx.Exec(
+		`DELETE FROM vulnerability v ` +
+			`WHERE NOT EXISTS (SELECT * FROM image WHERE image.Digest = v.Image)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = ptx.tx.Exec(
+		`DELETE FROM vulnerabilityScan s ` +
+			`WHERE NOT EXISTS (SELECT * FROM image WHERE image.Digest = s.Image)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = ptx.tx.Exec(
+		`DELETE FROM artifact ` +
+			`WHERE NOT EXISTS (SELECT * FROM artifactTag WHERE artifactTag.Artifact = artifact.Digest)`)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
+
+func (ptx postgresTransaction) SetFetchStatus(repository string, fetchErr error) (*FetchStatus, error) {
+	// We don't use ptx.exec() since the fetch status isn't part of the
+	// content that queries return
+	var status FetchStatus
+	var lastError sql.NullString
+	var err error
+	if fetchErr == nil {
+		err = ptx.tx.QueryRow(
+			`INSERT INTO fetchStatus (Repository, LastAttempt, LastSuccess, ConsecutiveFailures, LastError) `+
+				`VALUES ($1, now(), now(), 0, NULL) `+
+				`ON CONFLICT (Repository) DO UPDATE SET `+
+				`LastAttempt = now(), LastSuccess = now(), ConsecutiveFailures = 0, LastError = NULL `+
+				`RETURNING Repository, LastAttempt, LastSuccess, ConsecutiveFailures, LastError`,
+			repository).Scan(&status.Repository, &status.LastAttempt, &status.LastSuccess,
+			&status.ConsecutiveFailures, &lastError)
+	} else {
+		err = ptx.tx.QueryRow(
+			`INSERT INTO fetchStatus (Repository, LastAttempt, ConsecutiveFailures, LastError) `+
+				`VALUES ($1, now(), 1, $2) `+
+				`ON CONFLICT (Repository) DO UPDATE SET `+
+				`LastAttempt = now(), ConsecutiveFailures = fetchStatus.ConsecutiveFailures + 1, LastError = $2 `+
+				`RETURNING Repository, LastAttempt, LastSuccess, ConsecutiveFailures, LastError`,
+			repository, fetchErr.Error()).Scan(&status.Repository, &status.LastAttempt, &status.LastSuccess,
+			&status.ConsecutiveFailures, &lastError)
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.LastError = lastError.String
+
+	return &status, nil
+}
+
+func (ptx postgresTransaction) GetFetchStatus(unhealthyOnly bool) ([]*FetchStatus, error) {
+	query := `SELECT Repository, LastAttempt, LastSuccess, ConsecutiveFailures, LastError FROM fetchStatus `
+	if unhealthyOnly {
+		query += `WHERE ConsecutiveFailures > 0 `
+	}
+	query += `ORDER BY Repository`
+
+	rows, err := ptx.tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*FetchStatus, 0)
+	for rows.Next() {
+		var status FetchStatus
+		var lastError sql.NullString
+		err := rows.Scan(&status.Repository, &status.LastAttempt, &status.LastSuccess,
+			&status.ConsecutiveFailures, &lastError)
+		if err != nil {
+			return nil, err
+		}
+		status.LastError = lastError.String
+		result = append(result, &status)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+	"github.com/owtaylor/flagstate"
+	"strings"
+)
+
+// SearchResult is a repository found by SearchRepositories, with the title
+// and description of its representative image: the image tagged "latest",
+// or otherwise the most recently pushed image.
+type SearchResult struct {
+	Repository  string
+	Title       string `json:",omitempty"`
+	Description string `json:",omitempty"`
+}
+
+// metadataExpr returns an SQL expression for the first non-empty value
+// from sources in the image with the given alias, matching what
+// flagstate.Image.Title() and Description() return
+func metadataExpr(alias string, sources []flagstate.MetadataSource) string {
+	values := make([]string, 0, len(sources))
+	for _, source := range sources {
+		column := "Labels"
+		if source.Annotation {
+			column = "Annotations"
+		}
+		values = append(values, `NULLIF(jsonb_object_field_text(`+alias+`.`+column+`, '`+source.Key+`'), '')`)
+	}
+
+	return `COALESCE(` + strings.Join(values, `, `) + `, '')`
+}
+
+// The text search configuration for full-text search
+const searchConfig = `'english'`
+
+// repositorySearchExpr returns an SQL expression for the full-text search
+// vector of a repository name, with the parts of the path and words joined
+// by punctuation as separate words
+func repositorySearchExpr(repository string) string {
+	return `setweight(to_tsvector(` + searchConfig + `, translate(` + repository + `, '/._-', '    ')), 'A')`
+}
+
+// imageSearchTextExpr returns an SQL expression for the full-text search
+// vector stored for the image with the given alias. The title is weighted
+// the same as the repository name; labels is the SQL expression for an
+// array of the labels that are also searched.
+func imageSearchTextExpr(alias string, labels string) string {
+	return `setweight(to_tsvector(` + searchConfig + `, ` + metadataExpr(alias, flagstate.TitleSources) + `), 'A') || ` +
+		`setweight(to_tsvector(` + searchConfig + `, ` + metadataExpr(alias, flagstate.DescriptionSources) + `), 'B') || ` +
+		`setweight(to_tsvector(` + searchConfig + `, COALESCE((SELECT string_agg(l.value, ' ' ORDER BY l.key) ` +
+		`FROM jsonb_each_text(` + alias + `.Labels) l WHERE l.key = ANY(` + labels + `)), '')), 'C')`
+}
+
+// searchQueryExpr returns an SQL expression for a full-text search query
+// from the user's text
+func searchQueryExpr(text string) string {
+	return `websearch_to_tsquery(` + searchConfig + `, ` + text + `)`
+}
+
+// containsPattern returns a pattern for LIKE that matches strings
+// containing text
+func containsPattern(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + replacer.Replace(text) + "%"
+}
+
+// SearchRepositories finds the repositories where the name, or the title
+// or description of the representative image, contains text, ignoring
+// case. The results are sorted by name; at most limit results starting at
+// offset are returned, along with the total number of matches.
+func SearchRepositories(ctx context.Context, db Database, text string, offset int, limit int) ([]*SearchResult, int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	return tx.SearchRepositories(containsPattern(text), offset, limit)
+}
+
+// UpdateSearchText recomputes the full-text search vectors of all images
+func UpdateSearchText(ctx context.Context, db Database) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.UpdateSearchText()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// FetchStatus records the outcome of fetching a repository from the registry
+type FetchStatus struct {
+	Repository          string
+	LastAttempt         *time.Time
+	LastSuccess         *time.Time `json:",omitempty"`
+	ConsecutiveFailures int
+	LastError           string `json:",omitempty"`
+}
+
+// Healthy is true if the last attempt to fetch the repository succeeded
+func (s *FetchStatus) Healthy() bool {
+	return s.ConsecutiveFailures == 0
+}
+
+// RecordFetchStatus records the result of an attempt to fetch a repository,
+// in a separate transaction from the fetch, since a failed fetch is rolled
+// back.
+func RecordFetchStatus(ctx context.Context, db Database, repository string, fetchErr error) (*FetchStatus, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := tx.SetFetchStatus(repository, fetchErr)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// GetFetchStatus returns the fetch status of repositories, ordered by name.
+// If unhealthyOnly is set, only repositories where the last fetch failed
+// are returned.
+func GetFetchStatus(ctx context.Context, db Database, unhealthyOnly bool) ([]*FetchStatus, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return tx.GetFetchStatus(unhealthyOnly)
+}
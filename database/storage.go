@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"github.com/docker/distribution/digest"
+	"sort"
+	"strings"
+)
+
+// StorageUsage is the storage used by a repository or namespace. Blobs
+// shared between images are only counted once.
+type StorageUsage struct {
+	Name  string
+	Blobs int
+	Size  int64
+}
+
+// StorageReport is the result of GetStorageReport
+type StorageReport struct {
+	Total        StorageUsage
+	Repositories []StorageUsage
+	Namespaces   []StorageUsage
+}
+
+// namespaceOf returns the namespace of a repository - the path without the
+// last component - truncated to at most depth components if depth > 0.
+func namespaceOf(repository string, depth int) string {
+	parts := strings.Split(repository, "/")
+	parts = parts[:len(parts)-1]
+	if depth > 0 && len(parts) > depth {
+		parts = parts[:depth]
+	}
+
+	return strings.Join(parts, "/")
+}
+
+type usageAccumulator struct {
+	usage StorageUsage
+	seen  map[digest.Digest]bool
+}
+
+func (ua *usageAccumulator) add(blob RepositoryBlob) {
+	if ua.seen[blob.Digest] {
+		return
+	}
+	ua.seen[blob.Digest] = true
+	ua.usage.Blobs++
+	ua.usage.Size += blob.Size
+}
+
+type usageMap map[string]*usageAccumulator
+
+func (um usageMap) add(name string, blob RepositoryBlob) {
+	ua, ok := um[name]
+	if !ok {
+		ua = &usageAccumulator{
+			usage: StorageUsage{Name: name},
+			seen:  make(map[digest.Digest]bool),
+		}
+		um[name] = ua
+	}
+	ua.add(blob)
+}
+
+func (um usageMap) sorted() []StorageUsage {
+	result := make([]StorageUsage, 0, len(um))
+	for _, ua := range um {
+		result = append(result, ua.usage)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+func makeStorageReport(blobs []RepositoryBlob, namespaceDepth int) *StorageReport {
+	total := usageMap{}
+	repositories := usageMap{}
+	namespaces := usageMap{}
+
+	for _, blob := range blobs {
+		total.add("", blob)
+		repositories.add(blob.Repository, blob)
+		namespaces.add(namespaceOf(blob.Repository, namespaceDepth), blob)
+	}
+
+	report := &StorageReport{
+		Repositories: repositories.sorted(),
+		Namespaces:   namespaces.sorted(),
+	}
+	if ua, ok := total[""]; ok {
+		report.Total = ua.usage
+	}
+
+	return report
+}
+
+// GetStorageReport computes the compressed storage used by the tagged
+// images in the registry, aggregated by repository and by namespace.
+// Namespaces are truncated to namespaceDepth components if it is positive.
+func GetStorageReport(ctx context.Context, db Database, namespaceDepth int) (*StorageReport, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	blobs, err := tx.RepositoryBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	return makeStorageReport(blobs, namespaceDepth), nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"github.com/docker/distribution/digest"
+	"testing"
+)
+
+func TestNamespaceOf(t *testing.T) {
+	for _, c := range []struct {
+		repository string
+		depth      int
+		expected   string
+	}{
+		{"fedora", 0, ""},
+		{"org/app", 0, "org"},
+		{"org/team/app", 0, "org/team"},
+		{"org/team/app", 1, "org"},
+		{"org/team/app", 2, "org/team"},
+		{"org/team/app", 3, "org/team"},
+	} {
+		result := namespaceOf(c.repository, c.depth)
+		if result != c.expected {
+			t.Errorf("%s at depth %d, expected '%s', got '%s'", c.repository, c.depth, c.expected, result)
+		}
+	}
+}
+
+func expectUsage(t *testing.T, usage StorageUsage, name string, blobs int, size int64) {
+	if usage.Name != name || usage.Blobs != blobs || usage.Size != size {
+		t.Errorf("Expected {%s %d %d}, got %+v", name, blobs, size, usage)
+	}
+}
+
+func TestMakeStorageReport(t *testing.T) {
+	base := digest.Digest("sha256:base")
+	blobs := []RepositoryBlob{
+		{"org/team/a", base, 100},
+		{"org/team/a", "sha256:a", 10},
+		{"org/team/b", base, 100},
+		{"org/team/b", "sha256:b", 20},
+		{"org/other/c", base, 100},
+		{"single", "sha256:single", 5},
+	}
+
+	report := makeStorageReport(blobs, 0)
+	expectUsage(t, report.Total, "", 4, 135)
+
+	if len(report.Repositories) != 4 {
+		t.Fatalf("Unexpected repositories %+v", report.Repositories)
+	}
+	expectUsage(t, report.Repositories[0], "org/other/c", 1, 100)
+	expectUsage(t, report.Repositories[1], "org/team/a", 2, 110)
+	expectUsage(t, report.Repositories[2], "org/team/b", 2, 120)
+	expectUsage(t, report.Repositories[3], "single", 1, 5)
+
+	if len(report.Namespaces) != 3 {
+		t.Fatalf("Unexpected namespaces %+v", report.Namespaces)
+	}
+	expectUsage(t, report.Namespaces[0], "", 1, 5)
+	expectUsage(t, report.Namespaces[1], "org/other", 1, 100)
+	expectUsage(t, report.Namespaces[2], "org/team", 3, 130)
+
+	report = makeStorageReport(blobs, 1)
+	if len(report.Namespaces) != 2 {
+		t.Fatalf("Unexpected namespaces %+v", report.Namespaces)
+	}
+	expectUsage(t, report.Namespaces[1], "org", 3, 130)
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+)
+
+// ErrImageListDigest is returned when scanner results are imported for an
+// image list. Scanners only scan the image for one platform, so the
+// digest of that image is needed.
+var ErrImageListDigest = errors.New("Digest is an image list; use the digest of the scanned image for a single architecture")
+
+// RepositoryVulnerabilities counts the vulnerabilities in the images tagged
+// in a repository, directly or through an image list. A vulnerability
+// found in several images is counted for each image.
+type RepositoryVulnerabilities struct {
+	Repository string
+	// The number of images with vulnerabilities
+	Images int
+	flagstate.VulnerabilityCounts
+}
+
+// ImportVulnerabilities replaces the vulnerabilities stored for an image
+// with the results from a scanner. The image must already be indexed, and
+// dgst must be the digest of the image rather than of an image list
+// containing it.
+func ImportVulnerabilities(ctx context.Context, db Database, dgst digest.Digest, scanner string, vulnerabilities []*flagstate.Vulnerability) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	image, err := tx.GetImage(dgst)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if image == nil {
+		list, err := tx.GetImageList(dgst)
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		if list != nil {
+			return ErrImageListDigest
+		}
+		return ErrImageNotFound
+	}
+
+	err = tx.SetVulnerabilities(dgst, scanner, vulnerabilities)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetVulnerabilityReport returns the repositories with vulnerabilities at
+// least as severe as minSeverity, most affected first. If limit is
+// greater than 0, at most limit repositories are returned.
+func GetVulnerabilityReport(ctx context.Context, db Database, minSeverity string, limit int) ([]*RepositoryVulnerabilities, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	minRank, _ := flagstate.SeverityRank(minSeverity)
+	report, err := tx.GetVulnerabilityReport(minRank)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(report) > limit {
+		report = report[:limit]
+	}
+
+	return report, nil
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"encoding/json"
 	"strconv"
+	"strings"
 )
 
 type whereBuilder struct {
@@ -86,6 +87,10 @@ func (wb *whereBuilder) makeWhereSubclause(subject string, terms []QueryTerm) {
 			wb.addPiece(subject + ` = ` + wb.addArg(term.argument))
 		case QueryMatches:
 			wb.addPiece(subject + ` like ` + wb.addArg(likePattern(term.argument)))
+		case QueryBefore:
+			wb.addPiece(subject + ` < ` + wb.addArg(term.argument))
+		case QueryAfter:
+			wb.addPiece(subject + ` >= ` + wb.addArg(term.argument))
 		case QueryExists:
 			panic("QueryExists cannot be handled generically")
 		}
@@ -93,6 +98,18 @@ func (wb *whereBuilder) makeWhereSubclause(subject string, terms []QueryTerm) {
 	wb.addPiece("")
 }
 
+func (wb *whereBuilder) makeArraySubclause(subject string, terms []QueryTerm) {
+	for _, term := range terms {
+		switch term.queryType {
+		case QueryIs:
+			wb.addPiece(subject + ` ? ` + wb.addArg(term.argument))
+		default:
+			panic("Only QueryIs can be used for array subclauses")
+		}
+	}
+	wb.addPiece("")
+}
+
 func (wb *whereBuilder) makeMapSubclause(name string, key string, terms []QueryTerm) {
 	for _, term := range terms {
 		switch term.queryType {
@@ -111,12 +128,223 @@ func (wb *whereBuilder) makeMapSubclause(name string, key string, terms []QueryT
 	wb.addPiece("")
 }
 
-func makeWhereClause(query *Query) (clause string, args []interface{}) {
+// makeFlatpakListSubclause matches images where one of the terms is in a
+// list field of the Flatpak metadata. Filesystems can be listed with an
+// access mode.
+func (wb *whereBuilder) makeFlatpakListSubclause(field string, terms []QueryTerm) {
+	for _, term := range terms {
+		values := []string{term.argument}
+		if field == "Filesystems" && !strings.Contains(term.argument, ":") {
+			for _, mode := range []string{"ro", "rw", "create"} {
+				values = append(values, term.argument+":"+mode)
+			}
+		}
+		for _, value := range values {
+			argJson, _ := json.Marshal(map[string][]string{
+				field: {value},
+			})
+			wb.addPiece(`i.Flatpak @> ` + wb.addArg(string(argJson)))
+		}
+	}
+	wb.addPiece("")
+}
+
+// makeBasedOnSubclause matches images based on one of the given images or
+// image lists, either by layers or by annotation.
+func (wb *whereBuilder) makeBasedOnSubclause(terms []QueryTerm) {
+	for _, term := range terms {
+		arg := wb.addArg(term.argument)
+		wb.addPiece(`(jsonb_object_field_text(i.Annotations, '` + AnnotationBaseDigest + `') = ` + arg + ` OR ` +
+			`EXISTS (SELECT 1 FROM image b ` +
+			`WHERE (b.Digest = ` + arg + ` OR b.Digest IN (SELECT le.Image FROM listEntry le WHERE le.List = ` + arg + `)) ` +
+			`AND ` + layerPrefixExpr(`b`, `i`) + `))`)
+	}
+	wb.addPiece("")
+}
+
+// makeReferrerSubclause matches if the subject has referrers of each of the
+// given types in the repository of the tag
+func (wb *whereBuilder) makeReferrerSubclause(subject string, terms []QueryTerm) {
+	for _, term := range terms {
+		wb.addPiece(`EXISTS (SELECT 1 FROM referrer r ` +
+			`WHERE r.Repository = t.Repository AND r.Subject = ` + subject + ` ` +
+			`AND r.Type = ` + wb.addArg(term.argument) + `)`)
+		wb.addPiece("")
+	}
+}
+
+// makeSignedBySubclause matches if the subject has a verified signature for
+// each of the given key ids in the repository of the tag
+func (wb *whereBuilder) makeSignedBySubclause(subject string, terms []QueryTerm) {
+	for _, term := range terms {
+		wb.addPiece(`EXISTS (SELECT 1 FROM signatureVerification v ` +
+			`WHERE v.Repository = t.Repository AND v.Subject = ` + subject + ` ` +
+			`AND v.KeyId = ` + wb.addArg(term.argument) + ` AND v.Verified)`)
+		wb.addPiece("")
+	}
+}
+
+// makePackageSubclause matches if the image, or the list with the digest
+// subject, has a package from an SBOM in the repository of the tag that
+// matches all the package terms of the query
+func (wb *whereBuilder) makePackageSubclause(subject string, query *Query) {
+	inner := whereBuilder{
+		args:   wb.args,
+		pieces: make([]string, 0, 10),
+	}
+
+	if len(query.packageName) > 0 {
+		inner.makeWhereSubclause(`p.Name`, query.packageName)
+	}
+
+	for _, term := range query.packageVersion {
+		if term.queryType == QueryIs {
+			inner.makeWhereSubclause(`p.Version`, []QueryTerm{term})
+		} else {
+			// Version keys are compared byte by byte
+			inner.makeWhereSubclause(`p.VersionKey COLLATE "C"`,
+				[]QueryTerm{{term.queryType, versionKey(term.argument)}})
+		}
+	}
+
+	if len(query.packagePurl) > 0 {
+		inner.makeWhereSubclause(`p.PurlBase`, query.packagePurl)
+	}
+
+	wb.args = inner.args
+	wb.addPiece(`EXISTS (SELECT 1 FROM package p ` +
+		`WHERE p.Repository = t.Repository AND p.Image IN (i.Digest, ` + subject + `) AND ` + inner.flatten() + `)`)
+	wb.addPiece("")
+}
+
+// makeMaxSeveritySubclause matches on the most severe vulnerability found
+// in the image
+func (wb *whereBuilder) makeMaxSeveritySubclause(terms []QueryTerm) {
+	for _, term := range terms {
+		severe := `EXISTS (SELECT 1 FROM vulnerability v ` +
+			`WHERE v.Image = i.Digest AND v.SeverityRank >= ` + wb.addArg(term.argument) + `)`
+		switch term.queryType {
+		case QueryBefore:
+			// An image that hasn't been scanned has no known maximum
+			wb.addPiece(`(EXISTS (SELECT 1 FROM vulnerabilityScan s WHERE s.Image = i.Digest) ` +
+				`AND NOT ` + severe + `)`)
+		case QueryAfter:
+			wb.addPiece(severe)
+		default:
+			panic("Only QueryBefore and QueryAfter can be used for severities")
+		}
+		wb.addPiece("")
+	}
+}
+
+// makeSearchSubclause matches if each full-text search query is found in
+// the repository name of the tag together with the search text of the image
+func (wb *whereBuilder) makeSearchSubclause(repository string, search []string) {
+	for _, text := range search {
+		wb.addPiece(`(` + repositorySearchExpr(repository) + ` || i.SearchText) @@ ` +
+			searchQueryExpr(wb.addArg(text)))
+		wb.addPiece("")
+	}
+}
+
+// makeFailedTagWhereClause creates a WHERE clause for the failedTag table,
+// which only has repository and tag columns to match against
+func makeFailedTagWhereClause(query *Query) (clause string, args []interface{}) {
+	wb := whereBuilder{
+		args:   make([]interface{}, 0, 20),
+		pieces: make([]string, 0, 20),
+	}
+
+	if len(query.repository) > 0 {
+		wb.makeWhereSubclause(`f.Repository`, query.repository)
+	}
+
+	if len(query.tag) > 0 {
+		wb.makeWhereSubclause(`f.Tag`, query.tag)
+	}
+
+	// Failed tags have no image, so only the name can match
+	for _, text := range query.search {
+		wb.addPiece(repositorySearchExpr(`f.Repository`) + ` @@ ` + searchQueryExpr(wb.addArg(text)))
+		wb.addPiece("")
+	}
+
+	args = wb.args
+	if len(wb.pieces) > 0 {
+		clause = ` WHERE ` + wb.flatten()
+	}
+
+	return
+}
+
+// makeArtifactWhereClause creates a WHERE clause for the artifact and
+// artifactTag tables, using the terms of the query that apply to artifacts
+func makeArtifactWhereClause(query *Query) (clause string, args []interface{}) {
+	wb := whereBuilder{
+		args:   make([]interface{}, 0, 20),
+		pieces: make([]string, 0, 20),
+	}
+
+	// Artifacts never match terms about the image configuration
+	if query.hasImageTerms() {
+		wb.addPiece(`false`)
+		wb.addPiece("")
+	}
+
+	if len(query.repository) > 0 {
+		wb.makeWhereSubclause(`t.Repository`, query.repository)
+	}
+
+	if len(query.tag) > 0 {
+		wb.makeWhereSubclause(`t.Tag`, query.tag)
+	}
+
+	if len(query.mediaType) > 0 {
+		wb.makeWhereSubclause(`i.MediaType`, query.mediaType)
+	}
+
+	if len(query.artifactType) > 0 {
+		wb.makeWhereSubclause(`i.ArtifactType`, query.artifactType)
+	}
+
+	if len(query.referrerType) > 0 {
+		wb.makeReferrerSubclause(`t.Artifact`, query.referrerType)
+	}
+
+	if len(query.signedBy) > 0 {
+		wb.makeSignedBySubclause(`t.Artifact`, query.signedBy)
+	}
+
+	for _, term := range query.pushed {
+		wb.makeWhereSubclause(`t.FirstSeen`, []QueryTerm{term})
+	}
+
+	for annotation, terms := range query.annotations {
+		wb.makeMapSubclause("Annotations", annotation, terms)
+	}
+
+	args = wb.args
+	if len(wb.pieces) > 0 {
+		clause = ` WHERE ` + wb.flatten()
+	}
+
+	return
+}
+
+// makeWhereClause creates a WHERE clause for the image and list queries.
+// subject is the SQL expression for the digest that referrers point to.
+func makeWhereClause(query *Query, subject string) (clause string, args []interface{}) {
 	wb := whereBuilder{
 		args:   make([]interface{}, 0, 20),
 		pieces: make([]string, 0, 20),
 	}
 
+	// Images and lists never match artifact types
+	if len(query.artifactType) > 0 {
+		wb.addPiece(`false`)
+		wb.addPiece("")
+	}
+
 	if len(query.repository) > 0 {
 		wb.makeWhereSubclause(`t.Repository`, query.repository)
 	}
@@ -129,10 +357,56 @@ func makeWhereClause(query *Query) (clause string, args []interface{}) {
 		wb.makeWhereSubclause(`i.OS`, query.os)
 	}
 
+	if len(query.osVersion) > 0 {
+		wb.makeWhereSubclause(`i.OSVersion`, query.osVersion)
+	}
+
+	if len(query.osFeature) > 0 {
+		wb.makeArraySubclause(`i.OSFeatures`, query.osFeature)
+	}
+
 	if len(query.architecture) > 0 {
 		wb.makeWhereSubclause(`i.Architecture`, query.architecture)
 	}
 
+	if len(query.variant) > 0 {
+		wb.makeWhereSubclause(`i.Variant`, query.variant)
+	}
+
+	if len(query.mediaType) > 0 {
+		wb.makeWhereSubclause(`i.MediaType`, query.mediaType)
+	}
+
+	// Each before/after term is separately ANDed, since ORing them together
+	// isn't useful
+	for _, term := range query.created {
+		wb.makeWhereSubclause(`i.Created`, []QueryTerm{term})
+	}
+
+	for _, term := range query.pushed {
+		wb.makeWhereSubclause(`t.FirstSeen`, []QueryTerm{term})
+	}
+
+	if len(query.basedOn) > 0 {
+		wb.makeBasedOnSubclause(query.basedOn)
+	}
+
+	if len(query.referrerType) > 0 {
+		wb.makeReferrerSubclause(subject, query.referrerType)
+	}
+
+	if len(query.signedBy) > 0 {
+		wb.makeSignedBySubclause(subject, query.signedBy)
+	}
+
+	if query.hasPackageTerms() {
+		wb.makePackageSubclause(subject, query)
+	}
+
+	if len(query.maxSeverity) > 0 {
+		wb.makeMaxSeveritySubclause(query.maxSeverity)
+	}
+
 	for annotation, terms := range query.annotations {
 		wb.makeMapSubclause("Annotations", annotation, terms)
 	}
@@ -141,6 +415,22 @@ func makeWhereClause(query *Query) (clause string, args []interface{}) {
 		wb.makeMapSubclause("Labels", label, terms)
 	}
 
+	for key, terms := range query.osRelease {
+		wb.makeMapSubclause("OSRelease", key, terms)
+	}
+
+	for field, terms := range query.flatpak {
+		wb.makeMapSubclause("Flatpak", field, terms)
+	}
+
+	for field, terms := range query.flatpakLists {
+		wb.makeFlatpakListSubclause(field, terms)
+	}
+
+	if len(query.search) > 0 {
+		wb.makeSearchSubclause(`t.Repository`, query.search)
+	}
+
 	args = wb.args
 	if len(wb.pieces) > 0 {
 		clause = ` WHERE ` + wb.flatten()
@@ -1,6 +1,9 @@
 package database
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func expectFlattenWhere(t *testing.T, input []string, expected string) {
 	wb := whereBuilder{
@@ -39,7 +42,7 @@ func TestLikePattern(t *testing.T) {
 }
 
 func expectWhereClause(t *testing.T, query *Query, expected string, expectedArgs ...interface{}) {
-	result, args := makeWhereClause(query)
+	result, args := makeWhereClause(query, `t.Image`)
 	if result != expected {
 		t.Errorf("Expected '%s', got '%s'", expected, result)
 	}
@@ -69,6 +72,27 @@ func TestMakeWhereClause(t *testing.T) {
 	expectWhereClause(t, NewQuery().Architecture("foo"),
 		" WHERE i.Architecture = $1",
 		"foo")
+	expectWhereClause(t, NewQuery().OSVersion("10.0.14393.1066"),
+		" WHERE i.OSVersion = $1",
+		"10.0.14393.1066")
+	expectWhereClause(t, NewQuery().OSVersionMatches("10.0.14393.*"),
+		" WHERE i.OSVersion like $1",
+		"10.0.14393.%")
+	expectWhereClause(t, NewQuery().OSFeature("win32k"),
+		" WHERE i.OSFeatures ? $1",
+		"win32k")
+	expectWhereClause(t, NewQuery().Variant("v7"),
+		" WHERE i.Variant = $1",
+		"v7")
+	expectWhereClause(t, NewQuery().MediaType("application/vnd.docker.distribution.manifest.v1+prettyjws"),
+		" WHERE i.MediaType = $1",
+		"application/vnd.docker.distribution.manifest.v1+prettyjws")
+	expectWhereClause(t, NewQuery().CreatedBefore(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)),
+		" WHERE i.Created < $1",
+		"2018-01-01T00:00:00Z")
+	expectWhereClause(t, NewQuery().PushedAfter(time.Date(2018, 1, 1, 12, 0, 0, 0, time.FixedZone("EST", -5*3600))),
+		" WHERE t.FirstSeen >= $1",
+		"2018-01-01T17:00:00Z")
 	expectWhereClause(t, NewQuery().AnnotationIs("org.fishsoup.nonsense", "foo"),
 		" WHERE i.Annotations @> $1",
 		`{"org.fishsoup.nonsense":"foo"}`)
@@ -87,6 +111,25 @@ func TestMakeWhereClause(t *testing.T) {
 	expectWhereClause(t, NewQuery().LabelMatches("org.fishsoup.nonsense", "foo-*"),
 		" WHERE jsonb_object_field_text(i.Labels, $1) like $2",
 		"org.fishsoup.nonsense", "foo-%")
+	expectWhereClause(t, NewQuery().OSReleaseIs("ID", "fedora"),
+		" WHERE i.OSRelease @> $1",
+		`{"ID":"fedora"}`)
+	expectWhereClause(t, NewQuery().OSReleaseMatches("VERSION_ID", "3*"),
+		" WHERE jsonb_object_field_text(i.OSRelease, $1) like $2",
+		"VERSION_ID", "3%")
+	expectWhereClause(t, NewQuery().FlatpakRuntimeMatches("org.gnome.Platform/*"),
+		" WHERE jsonb_object_field_text(i.Flatpak, $1) like $2",
+		"Runtime", "org.gnome.Platform/%")
+	expectWhereClause(t, NewQuery().FlatpakSocket("x11").FlatpakSocket("wayland"),
+		" WHERE (i.Flatpak @> $1 OR i.Flatpak @> $2)",
+		`{"Sockets":["x11"]}`, `{"Sockets":["wayland"]}`)
+	expectWhereClause(t, NewQuery().FlatpakFilesystem("home"),
+		" WHERE (i.Flatpak @> $1 OR i.Flatpak @> $2 OR i.Flatpak @> $3 OR i.Flatpak @> $4)",
+		`{"Filesystems":["home"]}`, `{"Filesystems":["home:ro"]}`,
+		`{"Filesystems":["home:rw"]}`, `{"Filesystems":["home:create"]}`)
+	expectWhereClause(t, NewQuery().FlatpakFilesystem("home:ro"),
+		" WHERE i.Flatpak @> $1",
+		`{"Filesystems":["home:ro"]}`)
 
 	expectWhereClause(t, NewQuery(), "")
 	expectWhereClause(t, NewQuery().Repository("foo").Repository("bar"),
@@ -95,4 +138,110 @@ func TestMakeWhereClause(t *testing.T) {
 	expectWhereClause(t, NewQuery().Repository("foo").Tag("bar").Tag("baz"),
 		" WHERE t.Repository = $1 AND (t.Tag = $2 OR t.Tag = $3)",
 		"foo", "bar", "baz")
+	expectWhereClause(t, NewQuery().Architecture("arm").Variant("v6").Variant("v7"),
+		" WHERE i.Architecture = $1 AND (i.Variant = $2 OR i.Variant = $3)",
+		"arm", "v6", "v7")
+	expectWhereClause(t, NewQuery().CreatedAfter(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)).
+		CreatedBefore(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)),
+		" WHERE i.Created >= $1 AND i.Created < $2",
+		"2017-01-01T00:00:00Z", "2018-01-01T00:00:00Z")
+}
+
+func TestMakeFailedTagWhereClause(t *testing.T) {
+	result, args := makeFailedTagWhereClause(NewQuery().Repository("foo").Tag("bar").Tag("baz").OS("linux"))
+	expected := " WHERE f.Repository = $1 AND (f.Tag = $2 OR f.Tag = $3)"
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+	if len(args) != 3 {
+		t.Errorf("Expected 3 args, got %+v", args)
+	}
+}
+
+func TestBasedOnWhereClause(t *testing.T) {
+	expectWhereClause(t, NewQuery().BasedOn("sha256:abcd"),
+		" WHERE (jsonb_object_field_text(i.Annotations, 'org.opencontainers.image.base.digest') = $1 OR "+
+			"EXISTS (SELECT 1 FROM image b "+
+			"WHERE (b.Digest = $1 OR b.Digest IN (SELECT le.Image FROM listEntry le WHERE le.List = $1)) "+
+			"AND i.LayerDigests @> b.LayerDigests "+
+			"AND cardinality(b.LayerDigests) > 0 "+
+			"AND cardinality(b.LayerDigests) < cardinality(i.LayerDigests) "+
+			"AND i.LayerDigests[1:cardinality(b.LayerDigests)] = b.LayerDigests))",
+		"sha256:abcd")
+}
+
+func TestArtifactWhereClause(t *testing.T) {
+	expectWhereClause(t, NewQuery().Repository("foo").ArtifactType("application/vnd.cncf.helm.config.v1+json"),
+		" WHERE false AND t.Repository = $1",
+		"foo")
+
+	result, args := makeArtifactWhereClause(NewQuery().Repository("foo").ArtifactType("application/vnd.cncf.helm.config.v1+json"))
+	expected := " WHERE t.Repository = $1 AND i.ArtifactType = $2"
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+	if len(args) != 2 {
+		t.Errorf("Expected 2 args, got %+v", args)
+	}
+
+	result, _ = makeArtifactWhereClause(NewQuery().Repository("foo").OS("linux"))
+	expected = " WHERE false AND t.Repository = $1"
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+}
+
+func TestReferrerWhereClause(t *testing.T) {
+	expectWhereClause(t, NewQuery().HasSignature().HasSBOM(),
+		" WHERE EXISTS (SELECT 1 FROM referrer r WHERE r.Repository = t.Repository AND r.Subject = t.Image AND r.Type = $1) "+
+			"AND EXISTS (SELECT 1 FROM referrer r WHERE r.Repository = t.Repository AND r.Subject = t.Image AND r.Type = $2)",
+		"signature", "sbom")
+}
+
+func TestSignedByWhereClause(t *testing.T) {
+	expectWhereClause(t, NewQuery().SignedBy("release"),
+		" WHERE EXISTS (SELECT 1 FROM signatureVerification v WHERE v.Repository = t.Repository AND v.Subject = t.Image AND v.KeyId = $1 AND v.Verified)",
+		"release")
+}
+
+func TestPackageWhereClause(t *testing.T) {
+	expectWhereClause(t, NewQuery().PackageName("openssl").PackageVersionBefore("3.0.7"),
+		` WHERE EXISTS (SELECT 1 FROM package p WHERE p.Repository = t.Repository AND p.Image IN (i.Digest, t.Image) AND p.Name = $1 AND p.VersionKey COLLATE "C" < $2)`,
+		"openssl", ".1013.100.1017")
+	expectWhereClause(t, NewQuery().Repository("foo").PackagePurl("pkg:rpm/fedora/bash@5.2?arch=x86_64"),
+		` WHERE t.Repository = $1 AND EXISTS (SELECT 1 FROM package p WHERE p.Repository = t.Repository AND p.Image IN (i.Digest, t.Image) AND p.Version = $2 AND p.PurlBase = $3)`,
+		"foo", "5.2", "pkg:rpm/fedora/bash")
+}
+
+func TestMaxSeverityWhereClause(t *testing.T) {
+	expectWhereClause(t, NewQuery().MaxSeverityBelow("HIGH"),
+		" WHERE (EXISTS (SELECT 1 FROM vulnerabilityScan s WHERE s.Image = i.Digest) "+
+			"AND NOT EXISTS (SELECT 1 FROM vulnerability v WHERE v.Image = i.Digest AND v.SeverityRank >= $1))",
+		"3")
+	expectWhereClause(t, NewQuery().MaxSeverityAtLeast("CRITICAL"),
+		" WHERE EXISTS (SELECT 1 FROM vulnerability v WHERE v.Image = i.Digest AND v.SeverityRank >= $1)",
+		"4")
+}
+
+func TestSearchWhereClause(t *testing.T) {
+	expectWhereClause(t, NewQuery().Repository("foo").Search("postgres backup"),
+		" WHERE t.Repository = $1 AND "+
+			"(setweight(to_tsvector('english', translate(t.Repository, '/._-', '    ')), 'A') || i.SearchText) "+
+			"@@ websearch_to_tsquery('english', $2)",
+		"foo", "postgres backup")
+
+	result, args := makeFailedTagWhereClause(NewQuery().Search("postgres"))
+	expected := " WHERE setweight(to_tsvector('english', translate(f.Repository, '/._-', '    ')), 'A') " +
+		"@@ websearch_to_tsquery('english', $1)"
+	if result != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, result)
+	}
+	if len(args) != 1 {
+		t.Errorf("Expected 1 arg, got %+v", args)
+	}
+
+	result, _ = makeArtifactWhereClause(NewQuery().Search("postgres"))
+	if result != " WHERE false" {
+		t.Errorf("Expected artifacts not to match, got '%s'", result)
+	}
 }
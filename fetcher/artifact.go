@@ -0,0 +1,167 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+)
+
+const mediaTypeHelmConfig = "application/vnd.cncf.helm.config.v1+json"
+
+// Config media types that mean that a manifest is a container image. Some
+// older tools push images with a config of application/octet-stream.
+var imageConfigMediaTypes = map[string]bool{
+	"":                         true,
+	schema2.MediaTypeConfig:    true,
+	v1.MediaTypeImageConfig:    true,
+	"application/octet-stream": true,
+}
+
+// manifestExtras holds fields of an OCI image manifest that were added
+// in version 1.1 of the specification, and aren't in ocischema.Manifest
+type manifestExtras struct {
+	ArtifactType string                   `json:"artifactType"`
+	Subject      *distribution.Descriptor `json:"subject"`
+}
+
+// manifestArtifactType returns the artifact type of a manifest, or "" if
+// the manifest is a container image.
+func manifestArtifactType(mfst distribution.Manifest) (string, error) {
+	var config distribution.Descriptor
+	var extras manifestExtras
+
+	switch v := mfst.(type) {
+	case *schema2.DeserializedManifest:
+		config = v.Config
+	case *ocischema.DeserializedManifest:
+		config = v.Config
+		_, payload, err := v.Payload()
+		if err != nil {
+			return "", err
+		}
+		err = json.Unmarshal(payload, &extras)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", nil
+	}
+
+	if extras.ArtifactType != "" {
+		return extras.ArtifactType, nil
+	}
+	if !imageConfigMediaTypes[config.MediaType] {
+		return config.MediaType, nil
+	}
+
+	return "", nil
+}
+
+// fetchHelmChart downloads the config blob of a Helm chart, which holds
+// the contents of the chart's Chart.yaml converted to JSON
+func (f *Fetcher) fetchHelmChart(op *fetchOperation, dgst digest.Digest) (*flagstate.HelmChart, error) {
+	bytes, err := op.blobs.Get(op.ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	var chart struct {
+		Name        string `json:"name"`
+		Version     string `json:"version"`
+		AppVersion  string `json:"appVersion"`
+		Description string `json:"description"`
+	}
+	err = json.Unmarshal(bytes, &chart)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flagstate.HelmChart{
+		Name:        chart.Name,
+		Version:     chart.Version,
+		AppVersion:  chart.AppVersion,
+		Description: chart.Description,
+	}, nil
+}
+
+func (f *Fetcher) artifactFromManifest(op *fetchOperation, dgst digest.Digest, mfst distribution.Manifest, artifactType string, artifact *flagstate.Artifact) error {
+	artifact.Digest = dgst
+	artifact.ArtifactType = artifactType
+
+	var config distribution.Descriptor
+	var layers []distribution.Descriptor
+	switch v := mfst.(type) {
+	case *schema2.DeserializedManifest:
+		artifact.MediaType = v.MediaType
+		config = v.Config
+		layers = v.Layers
+	case *ocischema.DeserializedManifest:
+		artifact.MediaType = v.MediaType
+		if artifact.MediaType == "" {
+			artifact.MediaType = v1.MediaTypeImageManifest
+		}
+		if len(v.Annotations) > 0 {
+			artifact.Annotations = make(map[string]string)
+			for key, value := range v.Annotations {
+				artifact.Annotations[key] = value
+			}
+		}
+		config = v.Config
+		layers = v.Layers
+	default:
+		return badManifest("Can't handle manifest %T", mfst)
+	}
+
+	configBlob := blobFromDescriptor(config)
+	artifact.ConfigBlob = &configBlob
+	artifact.Size = configBlob.Size
+	for _, layer := range layers {
+		artifact.Layers = append(artifact.Layers, blobFromDescriptor(layer))
+		artifact.Size += layer.Size
+	}
+
+	if config.MediaType == mediaTypeHelmConfig {
+		chart, err := f.fetchHelmChart(op, config.Digest)
+		if err != nil {
+			return err
+		}
+		artifact.Helm = chart
+	}
+
+	return nil
+}
+
+// fetchManifest fetches a manifest that is either an image or an
+// artifact, and returns whichever it turned out to be.
+func (f *Fetcher) fetchManifest(op *fetchOperation, dgst digest.Digest) (*flagstate.Image, *flagstate.Artifact, error) {
+	mfst, err := op.manifests.Get(op.ctx, dgst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	artifactType, err := manifestArtifactType(mfst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if artifactType != "" {
+		var artifact flagstate.Artifact
+		err = f.artifactFromManifest(op, dgst, mfst, artifactType, &artifact)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &artifact, nil
+	}
+
+	var image flagstate.Image
+	err = f.imageFromManifest(op, dgst, mfst, &image)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &image, nil, nil
+}
@@ -0,0 +1,141 @@
+package fetcher
+
+import (
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+	"testing"
+)
+
+// addArtifact adds an OCI manifest with the given config and layers, and
+// returns the digest of the manifest. If artifactType is empty, the
+// manifest has no artifactType field.
+func (tr *testRegistry) addArtifact(artifactType string, configMediaType string, config []byte, layerMediaType string, layers []string) digest.Digest {
+	layerDescriptors := make([]interface{}, 0)
+	for _, layer := range layers {
+		layerDescriptors = append(layerDescriptors, map[string]interface{}{
+			"mediaType": layerMediaType,
+			"digest":    tr.addBlob([]byte(layer)),
+			"size":      len(layer),
+		})
+	}
+
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"config": map[string]interface{}{
+			"mediaType": configMediaType,
+			"digest":    tr.addBlob(config),
+			"size":      len(config),
+		},
+		"layers": layerDescriptors,
+		"annotations": map[string]string{
+			"org.opencontainers.image.title": "test",
+		},
+	}
+	if artifactType != "" {
+		manifest["artifactType"] = artifactType
+	}
+
+	return tr.addManifest(v1.MediaTypeImageManifest, manifest)
+}
+
+func TestFetchHelmChart(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	config := []byte(`{"name":"mychart","version":"1.2.3","appVersion":"4.5","description":"A chart","apiVersion":"v2"}`)
+	chartDigest := tr.addArtifact("", mediaTypeHelmConfig, config,
+		"application/vnd.cncf.helm.chart.content.v1.tar+gzip", []string{"CHART"})
+
+	op := newTestOperation(t, tr, "charts/mychart")
+	image, artifact, err := op.fetcher.fetchManifest(op, chartDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image != nil || artifact == nil {
+		t.Fatalf("Expected an artifact, got image=%+v artifact=%+v", image, artifact)
+	}
+	if artifact.ArtifactType != mediaTypeHelmConfig {
+		t.Errorf("Unexpected artifact type %s", artifact.ArtifactType)
+	}
+	if artifact.MediaType != v1.MediaTypeImageManifest {
+		t.Errorf("Unexpected media type %s", artifact.MediaType)
+	}
+	if artifact.Annotations["org.opencontainers.image.title"] != "test" {
+		t.Errorf("Unexpected annotations %v", artifact.Annotations)
+	}
+	if len(artifact.Layers) != 1 || artifact.Size != int64(len(config)+5) {
+		t.Errorf("Unexpected layers %+v, size %d", artifact.Layers, artifact.Size)
+	}
+	expected := flagstate.HelmChart{
+		Name:        "mychart",
+		Version:     "1.2.3",
+		AppVersion:  "4.5",
+		Description: "A chart",
+	}
+	if artifact.Helm == nil || *artifact.Helm != expected {
+		t.Errorf("Unexpected chart %+v", artifact.Helm)
+	}
+}
+
+func TestManifestArtifactType(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	ociImage := tr.addImage(v1.MediaTypeImageManifest, testConfig("linux", "amd64"), nil)
+	wasm := tr.addArtifact("", "application/vnd.wasm.config.v0+json", []byte("{}"),
+		"application/wasm", []string{"WASM"})
+	sbom := tr.addArtifact("application/spdx+json", "application/vnd.oci.empty.v1+json", []byte("{}"),
+		"application/spdx+json", []string{"{}"})
+
+	op := newTestOperation(t, tr, "foo")
+	for dgst, expected := range map[digest.Digest]string{
+		image:    "",
+		ociImage: "",
+		wasm:     "application/vnd.wasm.config.v0+json",
+		sbom:     "application/spdx+json",
+	} {
+		mfst, err := op.manifests.Get(op.ctx, dgst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		artifactType, err := manifestArtifactType(mfst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if artifactType != expected {
+			t.Errorf("Expected artifact type '%s', got '%s'", expected, artifactType)
+		}
+	}
+}
+
+func TestFetchStoresArtifacts(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	wasm := tr.addArtifact("", "application/vnd.wasm.config.v0+json", []byte("{}"),
+		"application/wasm", []string{"WASM"})
+
+	tx := newTestTx()
+	imageTags := map[string]digest.Digest{"image": image, "wasm": wasm}
+
+	op := newTestOperation(t, tr, "foo")
+	err := op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, map[string]digest.Digest{}, map[string]*flagstate.FailedTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.images[image] == nil || tx.images[wasm] != nil {
+		t.Errorf("Unexpected images %v", tx.images)
+	}
+	if tx.artifacts[wasm] == nil || tx.artifacts[image] != nil {
+		t.Errorf("Unexpected artifacts %v", tx.artifacts)
+	}
+	if !stringsEqual(tx.artifactTags["foo"][wasm], []string{"wasm"}) {
+		t.Errorf("Unexpected artifact tags %v", tx.artifactTags["foo"])
+	}
+}
@@ -0,0 +1,174 @@
+package fetcher
+
+import (
+	"fmt"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/owtaylor/flagstate"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// credentialStore implements auth.CredentialStore using the credentials
+// from the registry section of the configuration file.
+type credentialStore struct {
+	username     string
+	password     string
+	refreshToken string
+
+	mutex         sync.Mutex
+	refreshTokens map[string]string
+}
+
+func newCredentialStore(config *flagstate.Config) (*credentialStore, error) {
+	cs := &credentialStore{
+		username:      config.Registry.Username,
+		password:      config.Registry.Password,
+		refreshToken:  config.Registry.RefreshToken,
+		refreshTokens: make(map[string]string),
+	}
+
+	if config.Registry.PasswordFile != "" {
+		if cs.password != "" {
+			return nil, fmt.Errorf("Only one of registry.password and registry.password_file can be set")
+		}
+		bytes, err := ioutil.ReadFile(config.Registry.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		cs.password = strings.TrimRight(string(bytes), "\r\n")
+	}
+
+	return cs, nil
+}
+
+func (cs *credentialStore) Basic(*url.URL) (string, string) {
+	return cs.username, cs.password
+}
+
+func (cs *credentialStore) RefreshToken(realm *url.URL, service string) string {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if token, ok := cs.refreshTokens[service]; ok {
+		return token
+	}
+
+	return cs.refreshToken
+}
+
+func (cs *credentialStore) SetRefreshToken(realm *url.URL, service string, token string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.refreshTokens[service] = token
+}
+
+// authenticator creates transports that respond to WWW-Authenticate
+// challenges from the registry. Token handlers are cached per-scope, so
+// that a token is reused until it expires.
+type authenticator struct {
+	registryUrl string
+	base        http.RoundTripper
+	creds       *credentialStore
+	challenges  challenge.Manager
+
+	mutex         sync.Mutex
+	pinged        bool
+	tokenHandlers map[string]auth.AuthenticationHandler
+}
+
+func newAuthenticator(registryUrl string, base http.RoundTripper, creds *credentialStore) *authenticator {
+	return &authenticator{
+		registryUrl:   registryUrl,
+		base:          base,
+		creds:         creds,
+		challenges:    challenge.NewSimpleManager(),
+		tokenHandlers: make(map[string]auth.AuthenticationHandler),
+	}
+}
+
+// ping requests /v2/ from the registry to find out what authentication
+// schemes it supports. It's only done successfully once per authenticator.
+func (a *authenticator) ping() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.pinged {
+		return nil
+	}
+
+	client := &http.Client{
+		Transport: a.base,
+	}
+	resp, err := client.Get(strings.TrimRight(a.registryUrl, "/") + "/v2/")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("Unexpected status pinging registry: %s", resp.Status)
+	}
+
+	err = a.challenges.AddResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	a.pinged = true
+
+	return nil
+}
+
+func (a *authenticator) tokenHandler(scope auth.Scope) auth.AuthenticationHandler {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := scope.String()
+	handler := a.tokenHandlers[key]
+	if handler == nil {
+		handler = auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+			Transport:   a.base,
+			Credentials: a.creds,
+			Scopes:      []auth.Scope{scope},
+		})
+		a.tokenHandlers[key] = handler
+	}
+
+	return handler
+}
+
+// transport returns a transport for requests that need access with the
+// given scope.
+func (a *authenticator) transport(scope auth.Scope) (http.RoundTripper, error) {
+	err := a.ping()
+	if err != nil {
+		return nil, err
+	}
+
+	handlers := []auth.AuthenticationHandler{a.tokenHandler(scope)}
+	if a.creds.username != "" {
+		handlers = append(handlers, auth.NewBasicHandler(a.creds))
+	}
+
+	return transport.NewTransport(a.base, auth.NewAuthorizer(a.challenges, handlers...)), nil
+}
+
+func catalogScope() auth.Scope {
+	return auth.RegistryScope{
+		Name:    "catalog",
+		Actions: []string{"*"},
+	}
+}
+
+func repositoryScope(repository string) auth.Scope {
+	return auth.RepositoryScope{
+		Repository: repository,
+		Actions:    []string{"pull"},
+	}
+}
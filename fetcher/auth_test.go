@@ -0,0 +1,241 @@
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	"github.com/owtaylor/flagstate"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// testAuthServer is a stand-in for a registry that delegates authentication
+// to a separate token server.
+type testAuthServer struct {
+	registry *httptest.Server
+	token    *httptest.Server
+
+	mutex         sync.Mutex
+	tokenRequests int
+	lastGrantType string
+}
+
+func newTestAuthServer(t *testing.T) *testAuthServer {
+	ts := &testAuthServer{}
+	ts.token = httptest.NewServer(http.HandlerFunc(ts.serveToken))
+	ts.registry = httptest.NewServer(http.HandlerFunc(ts.serveRegistry))
+
+	return ts
+}
+
+func (ts *testAuthServer) Close() {
+	ts.registry.Close()
+	ts.token.Close()
+}
+
+func (ts *testAuthServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	ts.mutex.Lock()
+	ts.tokenRequests++
+	ts.mutex.Unlock()
+
+	var scope string
+	if r.Method == "POST" {
+		r.ParseForm()
+		ts.mutex.Lock()
+		ts.lastGrantType = r.PostForm.Get("grant_type")
+		ts.mutex.Unlock()
+		switch r.PostForm.Get("grant_type") {
+		case "refresh_token":
+			if r.PostForm.Get("refresh_token") != "REFRESH" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		scope = r.PostForm.Get("scope")
+	} else {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "flagstate" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		scope = r.URL.Query().Get("scope")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":         "TOKEN " + scope,
+		"access_token":  "TOKEN " + scope,
+		"refresh_token": "REFRESH",
+		"expires_in":    300,
+	})
+}
+
+func (ts *testAuthServer) challenge(w http.ResponseWriter, scope string) {
+	header := fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, ts.token.URL)
+	if scope != "" {
+		header += fmt.Sprintf(`,scope="%s"`, scope)
+	}
+	w.Header().Set("WWW-Authenticate", header)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (ts *testAuthServer) serveRegistry(w http.ResponseWriter, r *http.Request) {
+	var scope string
+	var response interface{}
+
+	switch {
+	case r.URL.Path == "/v2/":
+		scope = ""
+		response = map[string]string{}
+	case r.URL.Path == "/v2/_catalog":
+		scope = "registry:catalog:*"
+		response = map[string][]string{
+			"repositories": {"foo/bar"},
+		}
+	case r.URL.Path == "/v2/foo/bar/tags/list":
+		scope = "repository:foo/bar:pull"
+		response = map[string]interface{}{
+			"name": "foo/bar",
+			"tags": []string{"latest"},
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer TOKEN "+scope {
+		ts.challenge(w, scope)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func testAuthenticator(t *testing.T, ts *testAuthServer, config *flagstate.Config) *authenticator {
+	config.Registry.Url = ts.registry.URL
+	creds, err := newCredentialStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newAuthenticator(config.Registry.Url, http.DefaultTransport, creds)
+}
+
+func expectCatalog(t *testing.T, a *authenticator) {
+	trans, err := a.transport(catalogScope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := client.NewRegistry(context.Background(), a.registryUrl, trans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := make([]string, 10)
+	filled, err := registry.Repositories(context.Background(), page, "")
+	if filled != 1 || page[0] != "foo/bar" {
+		t.Errorf("Expected [foo/bar], got %v (%v)", page[:filled], err)
+	}
+}
+
+func expectTags(t *testing.T, a *authenticator) {
+	trans, err := a.transport(repositoryScope("foo/bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := reference.ParseNamed("foo/bar")
+	repo, err := client.NewRepository(context.Background(), ref, a.registryUrl, trans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := repo.Tags(context.Background()).All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0] != "latest" {
+		t.Errorf("Expected [latest], got %v", tags)
+	}
+}
+
+func TestAuthBasicCredentials(t *testing.T) {
+	ts := newTestAuthServer(t)
+	defer ts.Close()
+
+	var config flagstate.Config
+	config.Registry.Username = "flagstate"
+	config.Registry.Password = "secret"
+	a := testAuthenticator(t, ts, &config)
+
+	expectCatalog(t, a)
+	expectTags(t, a)
+	// Tokens should be cached per-scope and not refetched
+	expectCatalog(t, a)
+	expectTags(t, a)
+
+	if ts.tokenRequests != 2 {
+		t.Errorf("Expected 2 token requests, got %d", ts.tokenRequests)
+	}
+}
+
+func TestAuthPasswordFile(t *testing.T) {
+	ts := newTestAuthServer(t)
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "flagstate-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+
+	var config flagstate.Config
+	config.Registry.Username = "flagstate"
+	config.Registry.PasswordFile = f.Name()
+	a := testAuthenticator(t, ts, &config)
+
+	expectTags(t, a)
+}
+
+func TestAuthRefreshToken(t *testing.T) {
+	ts := newTestAuthServer(t)
+	defer ts.Close()
+
+	var config flagstate.Config
+	config.Registry.RefreshToken = "REFRESH"
+	a := testAuthenticator(t, ts, &config)
+
+	expectCatalog(t, a)
+	if ts.lastGrantType != "refresh_token" {
+		t.Errorf("Expected refresh_token grant, got '%s'", ts.lastGrantType)
+	}
+}
+
+func TestAuthNoCredentials(t *testing.T) {
+	ts := newTestAuthServer(t)
+	defer ts.Close()
+
+	var config flagstate.Config
+	a := testAuthenticator(t, ts, &config)
+
+	trans, err := a.transport(catalogScope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, _ := client.NewRegistry(context.Background(), a.registryUrl, trans)
+	_, err = registry.Repositories(context.Background(), make([]string, 10), "")
+	if err == nil {
+		t.Errorf("Expected an authorization failure, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package fetcher
+
+import (
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+)
+
+// testTx is an in-memory stand-in for the parts of database.Tx that
+// updateRepositoryInDatabase uses; calling any other method panics.
+type testTx struct {
+	database.Tx
+
+	// What DoQuery returns as already stored for the repository
+	stored *flagstate.Repository
+
+	images        map[digest.Digest]*flagstate.Image
+	lists         map[digest.Digest]*flagstate.ImageList
+	artifacts     map[digest.Digest]*flagstate.Artifact
+	imageTags     map[string]map[digest.Digest][]string
+	listTags      map[string]map[digest.Digest][]string
+	artifactTags  map[string]map[digest.Digest][]string
+	referrers     map[string]map[digest.Digest][]*flagstate.Referrer
+	verifications map[string]map[digest.Digest][]*flagstate.SignatureVerification
+	packages      map[string]map[digest.Digest][]*flagstate.Package
+	failedTags    map[string][]*flagstate.FailedTag
+}
+
+func newTestTx() *testTx {
+	return &testTx{
+		images:        make(map[digest.Digest]*flagstate.Image),
+		lists:         make(map[digest.Digest]*flagstate.ImageList),
+		artifacts:     make(map[digest.Digest]*flagstate.Artifact),
+		imageTags:     make(map[string]map[digest.Digest][]string),
+		listTags:      make(map[string]map[digest.Digest][]string),
+		artifactTags:  make(map[string]map[digest.Digest][]string),
+		referrers:     make(map[string]map[digest.Digest][]*flagstate.Referrer),
+		verifications: make(map[string]map[digest.Digest][]*flagstate.SignatureVerification),
+		packages:      make(map[string]map[digest.Digest][]*flagstate.Package),
+		failedTags:    make(map[string][]*flagstate.FailedTag),
+	}
+}
+
+func (tx *testTx) DoQuery(query *database.Query) ([]*flagstate.Repository, error) {
+	// Only used to find what is already stored for the repository; most
+	// tests start with nothing stored for it
+	if tx.stored != nil {
+		return []*flagstate.Repository{tx.stored}, nil
+	}
+	return []*flagstate.Repository{}, nil
+}
+
+func (tx *testTx) GetImage(dgst digest.Digest) (*flagstate.Image, error) {
+	return tx.images[dgst], nil
+}
+
+func (tx *testTx) GetImageList(dgst digest.Digest) (*flagstate.ImageList, error) {
+	return tx.lists[dgst], nil
+}
+
+func (tx *testTx) GetArtifact(dgst digest.Digest) (*flagstate.Artifact, error) {
+	return tx.artifacts[dgst], nil
+}
+
+func (tx *testTx) StoreImage(repository string, image *flagstate.TaggedImage) error {
+	if tx.images[image.Digest] == nil {
+		tx.images[image.Digest] = &image.Image
+	}
+	return tx.SetImageTags(repository, image.Digest, image.Tags)
+}
+
+func (tx *testTx) StoreImageList(repository string, list *flagstate.TaggedImageList) error {
+	if tx.lists[list.Digest] == nil {
+		tx.lists[list.Digest] = &list.ImageList
+		for _, image := range list.Images {
+			if tx.images[image.Digest] == nil {
+				tx.images[image.Digest] = image
+			}
+		}
+	}
+	return tx.SetImageListTags(repository, list.Digest, list.Tags)
+}
+
+func (tx *testTx) StoreArtifact(repository string, artifact *flagstate.TaggedArtifact) error {
+	if tx.artifacts[artifact.Digest] == nil {
+		tx.artifacts[artifact.Digest] = &artifact.Artifact
+	}
+	return tx.SetArtifactTags(repository, artifact.Digest, artifact.Tags)
+}
+
+func (tx *testTx) SetImageTags(repository string, dgst digest.Digest, tags []string) error {
+	if tx.imageTags[repository] == nil {
+		tx.imageTags[repository] = make(map[digest.Digest][]string)
+	}
+	tx.imageTags[repository][dgst] = tags
+	return nil
+}
+
+func (tx *testTx) SetImageListTags(repository string, dgst digest.Digest, tags []string) error {
+	if tx.listTags[repository] == nil {
+		tx.listTags[repository] = make(map[digest.Digest][]string)
+	}
+	tx.listTags[repository][dgst] = tags
+	return nil
+}
+
+func (tx *testTx) SetArtifactTags(repository string, dgst digest.Digest, tags []string) error {
+	if tx.artifactTags[repository] == nil {
+		tx.artifactTags[repository] = make(map[digest.Digest][]string)
+	}
+	tx.artifactTags[repository][dgst] = tags
+	return nil
+}
+
+func (tx *testTx) DeleteImage(repository string, dgst digest.Digest) error {
+	delete(tx.imageTags[repository], dgst)
+	return nil
+}
+
+func (tx *testTx) DeleteImageList(repository string, dgst digest.Digest) error {
+	delete(tx.listTags[repository], dgst)
+	return nil
+}
+
+func (tx *testTx) DeleteArtifact(repository string, dgst digest.Digest) error {
+	delete(tx.artifactTags[repository], dgst)
+	return nil
+}
+
+func (tx *testTx) GetReferrers(repository string, subject digest.Digest) ([]*flagstate.Referrer, error) {
+	return tx.referrers[repository][subject], nil
+}
+
+func (tx *testTx) SetReferrers(repository string, subject digest.Digest, referrers []*flagstate.Referrer) error {
+	if tx.referrers[repository] == nil {
+		tx.referrers[repository] = make(map[digest.Digest][]*flagstate.Referrer)
+	}
+	tx.referrers[repository][subject] = referrers
+	return nil
+}
+
+func (tx *testTx) GetSignatureVerifications(repository string, subject digest.Digest) ([]*flagstate.SignatureVerification, error) {
+	return tx.verifications[repository][subject], nil
+}
+
+func (tx *testTx) SetSignatureVerifications(repository string, subject digest.Digest, verifications []*flagstate.SignatureVerification) error {
+	if tx.verifications[repository] == nil {
+		tx.verifications[repository] = make(map[digest.Digest][]*flagstate.SignatureVerification)
+	}
+	tx.verifications[repository][subject] = verifications
+	return nil
+}
+
+func (tx *testTx) SetPackages(repository string, dgst digest.Digest, packages []*flagstate.Package) error {
+	if tx.packages[repository] == nil {
+		tx.packages[repository] = make(map[digest.Digest][]*flagstate.Package)
+	}
+	tx.packages[repository][dgst] = packages
+	return nil
+}
+
+func (tx *testTx) SetFailedTags(repository string, failedTags []*flagstate.FailedTag) error {
+	tx.failedTags[repository] = failedTags
+	return nil
+}
@@ -11,21 +11,32 @@ import (
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/client"
-	"github.com/docker/distribution/registry/client/transport"
 	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/owtaylor/flagstate"
 	"github.com/owtaylor/flagstate/database"
 	"github.com/owtaylor/flagstate/util"
 	"io"
 	"log"
+	"net/http"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Fetcher struct {
-	db          database.Database
-	changes     *util.ChangeBroadcaster
-	registryUrl string
-	channel     chan fetchRequest
+	db            database.Database
+	changes       *util.ChangeBroadcaster
+	registryUrl   string
+	authenticator *authenticator
+	keys          []*verificationKey
+	// If set, the layers of new images are read to find /etc/os-release
+	inspectLayers bool
+	maxLayerSize  int64
+	channel       chan fetchRequest
+	// Pending retries of failed fetches, at most one per repository
+	retryLock   sync.Mutex
+	retryTimers map[string]*time.Timer
 }
 
 type requestType int
@@ -34,6 +45,7 @@ const (
 	requestNone = iota
 	requestFetchAll
 	requestFetchRepository
+	requestFetchTag
 	requestGarbageCollect
 )
 
@@ -41,19 +53,45 @@ type fetchRequest struct {
 	which       requestType
 	repository  string
 	lowPriority bool
+	tagUpdate   util.TagUpdate
 }
 
-func NewFetcher(db database.Database, changes *util.ChangeBroadcaster, registryUrl string) *Fetcher {
+func NewFetcher(db database.Database, changes *util.ChangeBroadcaster, config *flagstate.Config) (*Fetcher, error) {
+	creds, err := newCredentialStore(config)
+	if err != nil {
+		return nil, err
+	}
+
+	trans, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := loadVerificationKeys(config)
+	if err != nil {
+		return nil, err
+	}
+
+	maxLayerSize := config.Inspection.MaxLayerSize
+	if maxLayerSize == 0 {
+		maxLayerSize = defaultMaxLayerSize
+	}
+
 	f := Fetcher{
-		db:          db,
-		changes:     changes,
-		registryUrl: registryUrl,
-		channel:     make(chan fetchRequest, 100),
+		db:            db,
+		changes:       changes,
+		registryUrl:   config.Registry.Url,
+		authenticator: newAuthenticator(config.Registry.Url, trans, creds),
+		keys:          keys,
+		inspectLayers: config.Inspection.OSRelease,
+		maxLayerSize:  maxLayerSize,
+		channel:       make(chan fetchRequest, 100),
+		retryTimers:   make(map[string]*time.Timer),
 	}
 
 	go f.dispatch()
 
-	return &f
+	return &f, nil
 }
 
 func (f *Fetcher) FetchAll() {
@@ -69,6 +107,16 @@ func (f *Fetcher) FetchRepository(repository string) {
 	}
 }
 
+// FetchTag updates a single tag of a repository, without listing and
+// checking all the other tags.
+func (f *Fetcher) FetchTag(repository string, update util.TagUpdate) {
+	f.channel <- fetchRequest{
+		which:      requestFetchTag,
+		repository: repository,
+		tagUpdate:  update,
+	}
+}
+
 func (f *Fetcher) GarbageCollect() {
 	f.channel <- fetchRequest{
 		which: requestGarbageCollect,
@@ -85,11 +133,17 @@ func (f *Fetcher) dispatch() {
 		go func() {
 			ctx := context.Background()
 			for true {
-				repo := dispatcher.Take()
-				err := f.fetchRepository(ctx, repo)
+				repo, tagUpdates := dispatcher.Take()
+				var err error
+				if tagUpdates == nil {
+					err = f.fetchRepository(ctx, repo)
+				} else {
+					err = f.fetchTags(ctx, repo, tagUpdates)
+				}
 				if err != nil {
 					log.Printf("Error fetching %s: %v", repo, err)
 				}
+				f.recordFetchStatus(ctx, repo, err)
 				dispatcher.Release(repo)
 			}
 		}()
@@ -107,6 +161,8 @@ func (f *Fetcher) dispatch() {
 			dispatcher.Unlock()
 		case requestFetchRepository:
 			dispatcher.Add(request.repository, request.lowPriority)
+		case requestFetchTag:
+			dispatcher.AddTagUpdate(request.repository, request.tagUpdate)
 		case requestGarbageCollect:
 			dispatcher.Lock()
 			err := f.garbageCollect(ctx)
@@ -118,6 +174,69 @@ func (f *Fetcher) dispatch() {
 	}
 }
 
+// Failed fetches are retried after a delay between these limits, depending
+// on the number of consecutive failures
+const (
+	retryMinInterval = 30 * time.Second
+	retryMaxInterval = time.Hour
+)
+
+// recordFetchStatus stores the result of fetching a repository, and if the
+// fetch failed, schedules a retry.
+func (f *Fetcher) recordFetchStatus(ctx context.Context, repository string, fetchErr error) {
+	status, err := database.RecordFetchStatus(ctx, f.db, repository, fetchErr)
+	if err != nil {
+		log.Printf("Error recording fetch status for %s: %v", repository, err)
+		return
+	}
+
+	if status.Healthy() {
+		f.cancelRetry(repository)
+	} else {
+		delay := util.Backoff(status.ConsecutiveFailures, retryMinInterval, retryMaxInterval)
+		log.Printf("Retrying %s in %v", repository, delay)
+		f.scheduleRetry(repository, delay)
+	}
+}
+
+// scheduleRetry arranges for the repository to be fetched after delay,
+// replacing any retry that is already pending for it
+func (f *Fetcher) scheduleRetry(repository string, delay time.Duration) {
+	f.retryLock.Lock()
+	defer f.retryLock.Unlock()
+
+	if timer := f.retryTimers[repository]; timer != nil {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		f.retryLock.Lock()
+		if f.retryTimers[repository] == timer {
+			delete(f.retryTimers, repository)
+		}
+		f.retryLock.Unlock()
+
+		f.channel <- fetchRequest{
+			which:       requestFetchRepository,
+			repository:  repository,
+			lowPriority: true,
+		}
+	})
+	f.retryTimers[repository] = timer
+}
+
+// cancelRetry stops any pending retry of the repository
+func (f *Fetcher) cancelRetry(repository string) {
+	f.retryLock.Lock()
+	defer f.retryLock.Unlock()
+
+	if timer := f.retryTimers[repository]; timer != nil {
+		timer.Stop()
+		delete(f.retryTimers, repository)
+	}
+}
+
 func (f *Fetcher) garbageCollect(ctx context.Context) error {
 	tx, err := f.db.Begin(ctx)
 	if err != nil {
@@ -143,7 +262,10 @@ func (f *Fetcher) checkModification(tx database.Tx) {
 func (f *Fetcher) fetchAll(ctx context.Context) error {
 	const pageSize = 100
 
-	trans := transport.NewTransport(nil)
+	trans, err := f.authenticator.transport(catalogScope())
+	if err != nil {
+		return err
+	}
 	registry, err := client.NewRegistry(ctx, f.registryUrl, trans)
 	if err != nil {
 		return err
@@ -205,92 +327,409 @@ func (f *Fetcher) fetchImage(op *fetchOperation, dgst digest.Digest, image *flag
 		return err
 	}
 
-	image.Digest = dgst
-	image.Annotations = make(map[string]string)
-	image.Labels = make(map[string]string)
+	return f.imageFromManifest(op, dgst, mfst, image)
+}
 
-	var labelMap *map[string]interface{}
+func stringList(value interface{}) []string {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
 
-	switch v := mfst.(type) {
-	case *schema2.DeserializedManifest:
-		image.MediaType = v.MediaType
+	var result []string
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+func parseTime(value interface{}) *time.Time {
+	s, ok := value.(string)
+	if !ok {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+
+	return &t
+}
+
+func parseRunConfig(configEntry map[string]interface{}) *flagstate.ImageConfig {
+	var runConfig flagstate.ImageConfig
+
+	runConfig.Entrypoint = stringList(configEntry["Entrypoint"])
+	runConfig.Cmd = stringList(configEntry["Cmd"])
+	runConfig.Env = stringList(configEntry["Env"])
+
+	exposedPorts, ok := configEntry["ExposedPorts"].(map[string]interface{})
+	if ok {
+		for port := range exposedPorts {
+			runConfig.ExposedPorts = append(runConfig.ExposedPorts, port)
+		}
+		sort.Strings(runConfig.ExposedPorts)
+	}
+
+	user, ok := configEntry["User"].(string)
+	if ok {
+		runConfig.User = user
+	}
+
+	workingDir, ok := configEntry["WorkingDir"].(string)
+	if ok {
+		runConfig.WorkingDir = workingDir
+	}
+
+	return &runConfig
+}
+
+func parseHistory(value interface{}) []flagstate.ImageHistory {
+	entries, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var result []flagstate.ImageHistory
+	for _, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
 
-		bytes, err := op.blobs.Get(op.ctx, v.Config.Digest)
+		var history flagstate.ImageHistory
+		history.Created = parseTime(entry["created"])
+		history.CreatedBy, _ = entry["created_by"].(string)
+		history.Author, _ = entry["author"].(string)
+		history.Comment, _ = entry["comment"].(string)
+		history.EmptyLayer, _ = entry["empty_layer"].(bool)
+
+		result = append(result, history)
+	}
+
+	return result
+}
+
+// fetchConfig downloads and parses the image configuration blob, filling
+// in the fields of image that are taken from it.
+func (f *Fetcher) fetchConfig(op *fetchOperation, dgst digest.Digest, image *flagstate.Image) error {
+	bytes, err := op.blobs.Get(op.ctx, dgst)
+	if err != nil {
+		return err
+	}
+	config := make(map[string]interface{})
+	err = json.Unmarshal(bytes, &config)
+	if err != nil {
+		return err
+	}
+
+	applyConfig(config, image)
+
+	return nil
+}
+
+// applyConfig fills in the fields of image that are taken from a parsed
+// image configuration.
+func applyConfig(config map[string]interface{}, image *flagstate.Image) {
+	architecture, ok := config["architecture"].(string)
+	if ok {
+		image.Architecture = architecture
+	}
+
+	variant, ok := config["variant"].(string)
+	if ok {
+		image.Variant = variant
+	}
+
+	os, ok := config["os"].(string)
+	if ok {
+		image.OS = os
+	}
+
+	osVersion, ok := config["os.version"].(string)
+	if ok {
+		image.OSVersion = osVersion
+	}
+
+	image.OSFeatures = stringList(config["os.features"])
+
+	image.Created = parseTime(config["created"])
+
+	author, ok := config["author"].(string)
+	if ok {
+		image.Author = author
+	}
+
+	image.History = parseHistory(config["history"])
+
+	configEntry, ok := config["config"].(map[string]interface{})
+	if ok {
+		image.Config = parseRunConfig(configEntry)
+
+		labels, ok := configEntry["Labels"].(map[string]interface{})
+		if ok {
+			for label, value := range labels {
+				valueString, ok := value.(string)
+				if ok {
+					image.Labels[label] = valueString
+				}
+			}
+		}
+	}
+}
+
+// applySchema1 fills in image from a schema1 manifest. There is no separate
+// configuration blob; instead each layer has a v1Compatibility entry, and
+// the entry for the top layer holds the configuration of the image.
+func (f *Fetcher) applySchema1(op *fetchOperation, m *schema1Manifest, image *flagstate.Image) error {
+	if len(m.History) == 0 || len(m.History) != len(m.FSLayers) {
+		return badManifest("Invalid schema1 manifest: %d layers, %d history entries", len(m.FSLayers), len(m.History))
+	}
+
+	entries := make([]map[string]interface{}, len(m.History))
+	for i, history := range m.History {
+		entries[i] = make(map[string]interface{})
+		err := json.Unmarshal([]byte(history.V1Compatibility), &entries[i])
 		if err != nil {
 			return err
 		}
-		config := make(map[string]interface{})
-		err = json.Unmarshal(bytes, &config)
+	}
+
+	applyConfig(entries[0], image)
+	if image.Architecture == "" {
+		image.Architecture = m.Architecture
+	}
+
+	// Layers and history are listed with the top layer first; throwaway
+	// layers are empty and don't correspond to a layer in the image
+	image.Layers = make([]flagstate.Blob, 0, len(m.FSLayers))
+	image.History = nil
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		throwaway, _ := entry["throwaway"].(bool)
+
+		var history flagstate.ImageHistory
+		history.Created = parseTime(entry["created"])
+		history.Author, _ = entry["author"].(string)
+		history.Comment, _ = entry["comment"].(string)
+		history.EmptyLayer = throwaway
+		if containerConfig, ok := entry["container_config"].(map[string]interface{}); ok {
+			history.CreatedBy = strings.Join(stringList(containerConfig["Cmd"]), " ")
+		}
+		image.History = append(image.History, history)
+
+		if throwaway {
+			continue
+		}
+
+		// The manifest doesn't include layer sizes
+		descriptor, err := op.blobs.Stat(op.ctx, m.FSLayers[i].BlobSum)
 		if err != nil {
 			return err
 		}
-		architecture, ok := config["architecture"].(string)
-		if ok {
-			image.Architecture = architecture
-		}
+		image.Layers = append(image.Layers, flagstate.Blob{
+			Digest:    m.FSLayers[i].BlobSum,
+			MediaType: mediaTypeSchema1Layer,
+			Size:      descriptor.Size,
+		})
+		image.Size += descriptor.Size
+	}
 
-		os, ok := config["os"].(string)
-		if ok {
-			image.OS = os
+	return nil
+}
+
+func (f *Fetcher) imageFromManifest(op *fetchOperation, dgst digest.Digest, mfst distribution.Manifest, image *flagstate.Image) error {
+	image.Digest = dgst
+	image.Annotations = make(map[string]string)
+	image.Labels = make(map[string]string)
+
+	switch v := mfst.(type) {
+	case *schema1Manifest:
+		image.MediaType = v.mediaType
+
+		err := f.applySchema1(op, v, image)
+		if err != nil {
+			return err
 		}
+	case *schema2.DeserializedManifest:
+		image.MediaType = v.MediaType
+		setBlobs(image, v.Config, v.Layers)
 
-		configEntry, ok := config["config"].(map[string]interface{})
-		if ok {
-			labels, ok := configEntry["Labels"].(map[string]interface{})
-			if ok {
-				labelMap = &labels
-			}
+		err := f.fetchConfig(op, v.Config.Digest, image)
+		if err != nil {
+			return err
 		}
 	case *ocischema.DeserializedManifest:
 		image.MediaType = v.MediaType
+		if image.MediaType == "" {
+			image.MediaType = v1.MediaTypeImageManifest
+		}
 
 		for key, value := range v.Annotations {
 			image.Annotations[key] = value
 		}
+		setBlobs(image, v.Config, v.Layers)
 
-		bytes, err := op.blobs.Get(op.ctx, v.Config.Digest)
+		err := f.fetchConfig(op, v.Config.Digest, image)
 		if err != nil {
 			return err
 		}
-		config := make(map[string]interface{})
-		err = json.Unmarshal(bytes, &config)
+	default:
+		return badManifest("Can't handle manifest %T", mfst)
+	}
+
+	flatpak, err := parseFlatpakMetadata(image.Labels)
+	if err != nil {
+		log.Printf("Can't parse Flatpak labels of %s@%s: %v", op.repo.Named().Name(), dgst, err)
+	}
+	image.Flatpak = flatpak
+
+	// Layers that can't be inspected don't prevent indexing the image, but
+	// if reading them failed, the image is fetched again later, since
+	// nothing checks the layers of images that are already stored
+	if f.inspectLayers && (image.OS == "" || image.OS == "linux") {
+		err := f.inspectOSRelease(op, image)
+		if err != nil && isTransient(err) {
+			return err
+		} else if err != nil {
+			log.Printf("Can't inspect layers of %s@%s: %v", op.repo.Named().Name(), dgst, err)
+		}
+	}
+
+	return nil
+}
+
+func blobFromDescriptor(descriptor distribution.Descriptor) flagstate.Blob {
+	return flagstate.Blob{
+		Digest:    descriptor.Digest,
+		MediaType: descriptor.MediaType,
+		Size:      descriptor.Size,
+	}
+}
+
+// setBlobs records the configuration and layers of an image, and computes
+// the total compressed size.
+func setBlobs(image *flagstate.Image, config distribution.Descriptor, layers []distribution.Descriptor) {
+	configBlob := blobFromDescriptor(config)
+	image.ConfigBlob = &configBlob
+	image.Size = configBlob.Size
+
+	image.Layers = make([]flagstate.Blob, 0, len(layers))
+	for _, layer := range layers {
+		image.Layers = append(image.Layers, blobFromDescriptor(layer))
+		image.Size += layer.Size
+	}
+}
+
+// listSize computes the size of an image list, counting blobs shared
+// between the images only once.
+func listSize(list *flagstate.ImageList) int64 {
+	var size int64
+	seen := make(map[digest.Digest]bool)
+	for _, image := range list.Images {
+		blobs := image.Layers
+		if image.ConfigBlob != nil {
+			blobs = append([]flagstate.Blob{*image.ConfigBlob}, blobs...)
+		}
+		for _, blob := range blobs {
+			if !seen[blob.Digest] {
+				seen[blob.Digest] = true
+				size += blob.Size
+			}
+		}
+	}
+
+	return size
+}
+
+// applyPlatform fills in platform details from a manifest list entry that
+// weren't present in the image configuration.
+func applyPlatform(image *flagstate.Image, platform *manifestlist.PlatformSpec) {
+	if image.Architecture == "" {
+		image.Architecture = platform.Architecture
+	}
+	if image.Variant == "" {
+		image.Variant = platform.Variant
+	}
+	if image.OS == "" {
+		image.OS = platform.OS
+	}
+	if image.OSVersion == "" {
+		image.OSVersion = platform.OSVersion
+	}
+	if len(image.OSFeatures) == 0 && len(platform.OSFeatures) > 0 {
+		image.OSFeatures = append([]string(nil), platform.OSFeatures...)
+	}
+}
+
+// Nested indexes aren't expected to go more than a level or two deep; this
+// just protects against pathological content.
+const maxListDepth = 8
+
+func (f *Fetcher) fetchListEntries(op *fetchOperation, tx database.Tx, v *manifestlist.DeserializedManifestList, list *flagstate.ImageList, seen map[digest.Digest]bool, depth int) error {
+	for _, descriptor := range v.Manifests {
+		if seen[descriptor.Digest] {
+			continue
+		}
+		seen[descriptor.Digest] = true
+
+		// Lists for different tags or repositories often share images
+		stored, err := tx.GetImage(descriptor.Digest)
 		if err != nil {
 			return err
 		}
-		architecture, ok := config["architecture"].(string)
-		if ok {
-			image.Architecture = architecture
+		if stored != nil {
+			image := *stored
+			applyPlatform(&image, &descriptor.Platform)
+			list.Images = append(list.Images, &image)
+			continue
 		}
 
-		os, ok := config["os"].(string)
-		if ok {
-			image.OS = os
+		// We don't trust descriptor.MediaType, since it's optional for
+		// an OCI image index, and instead check what we actually get.
+		mfst, err := op.manifests.Get(op.ctx, descriptor.Digest)
+		if err != nil {
+			return err
 		}
 
-		configEntry, ok := config["config"].(map[string]interface{})
-		if ok {
-			labels, ok := configEntry["Labels"].(map[string]interface{})
-			if ok {
-				labelMap = &labels
+		if nested, ok := mfst.(*manifestlist.DeserializedManifestList); ok {
+			if depth >= maxListDepth {
+				return badManifest("Image lists nested too deeply at %s", descriptor.Digest)
+			}
+			err = f.fetchListEntries(op, tx, nested, list, seen, depth+1)
+			if err != nil {
+				return err
 			}
+			continue
 		}
-	default:
-		return fmt.Errorf("Can't handle manifest %T", mfst)
-	}
 
-	if labelMap != nil {
-		for label, value := range *labelMap {
-			valueString, ok := value.(string)
-			if ok {
-				image.Labels[label] = valueString
-			}
+		// Indexes can also reference artifacts, such as attestations,
+		// which aren't images for a platform
+		artifactType, err := manifestArtifactType(mfst)
+		if err != nil {
+			return err
 		}
+		if artifactType != "" {
+			continue
+		}
+
+		var image flagstate.Image
+		err = f.imageFromManifest(op, descriptor.Digest, mfst, &image)
+		if err != nil {
+			return err
+		}
+		applyPlatform(&image, &descriptor.Platform)
+		list.Images = append(list.Images, &image)
 	}
 
 	return nil
 }
 
-func (f *Fetcher) fetchImageList(op *fetchOperation, dgst digest.Digest, list *flagstate.ImageList) error {
+func (f *Fetcher) fetchImageList(op *fetchOperation, tx database.Tx, dgst digest.Digest, list *flagstate.ImageList) error {
 	mfst, err := op.manifests.Get(op.ctx, dgst)
 	if err != nil {
 		return err
@@ -302,54 +741,165 @@ func (f *Fetcher) fetchImageList(op *fetchOperation, dgst digest.Digest, list *f
 	switch v := mfst.(type) {
 	case *manifestlist.DeserializedManifestList:
 		list.MediaType = v.MediaType
-		for _, descriptor := range v.Manifests {
-			var image flagstate.Image
-			err := f.fetchImage(op, descriptor.Digest, &image)
-			if err != nil {
-				return err
-			}
-			list.Images = append(list.Images, &image)
+		_, payload, err := v.Payload()
+		if err != nil {
+			return err
+		}
+
+		// manifestlist.ManifestList doesn't have the annotations field
+		// of an OCI image index, so parse the payload again to get them
+		var index v1.Index
+		err = json.Unmarshal(payload, &index)
+		if err != nil {
+			return err
+		}
+		for key, value := range index.Annotations {
+			list.Annotations[key] = value
+		}
+		// The mediaType field is optional for an OCI image index
+		if list.MediaType == "" {
+			list.MediaType = v1.MediaTypeImageIndex
+		}
+
+		seen := map[digest.Digest]bool{dgst: true}
+		err = f.fetchListEntries(op, tx, v, list, seen, 1)
+		if err != nil {
+			return err
 		}
+		list.Size = listSize(list)
 	default:
-		return fmt.Errorf("Can't handle manifest %T", mfst)
+		return badManifest("Can't handle manifest %T", mfst)
 	}
 
 	return nil
 }
 
-func (f *Fetcher) getTagsFromRegistry(op *fetchOperation) (imageTags map[string]digest.Digest, listTags map[string]digest.Digest, err error) {
+func (f *Fetcher) getTagsFromRegistry(op *fetchOperation) (imageTags map[string]digest.Digest, listTags map[string]digest.Digest, failedTags map[string]*flagstate.FailedTag, err error) {
 	imageTags = make(map[string]digest.Digest)
 	listTags = make(map[string]digest.Digest)
+	failedTags = make(map[string]*flagstate.FailedTag)
 
 	allTags, err := op.tags.All(op.ctx)
 	if err != nil {
 		return
 	}
 
-	for t, digest := range allTags {
-		descriptor, e := op.tags.Get(op.ctx, digest)
+	op.allTags = make(map[string]bool)
+	for _, tag := range allTags {
+		op.allTags[tag] = true
+
+		// Fallback tags for referrers are found when we look for the
+		// referrers of their subjects
+		if _, _, ok := parseFallbackTag(tag); ok {
+			continue
+		}
+
+		descriptor, e := op.tags.Get(op.ctx, tag)
 		if e != nil {
-			err = e
-			return
-		}
-
-		switch descriptor.MediaType {
-		case schema2.MediaTypeManifest:
-			imageTags[allTags[t]] = descriptor.Digest
-		case manifestlist.MediaTypeManifestList:
-			listTags[allTags[t]] = descriptor.Digest
-		case v1.MediaTypeImageManifest:
-			imageTags[allTags[t]] = descriptor.Digest
-		case v1.MediaTypeImageIndex:
-			listTags[allTags[t]] = descriptor.Digest
-		default:
+			op.failTag(failedTags, tag, descriptor, e)
 			continue
 		}
+
+		if !addTag(tag, descriptor, imageTags, listTags) {
+			failTag(failedTags, tag, descriptor, unsupportedError(descriptor))
+		}
 	}
 
 	return
 }
 
+func unsupportedError(descriptor distribution.Descriptor) error {
+	return badManifest("Unsupported media type '%s'", descriptor.MediaType)
+}
+
+// badManifestError is returned for manifests, or the content they reference,
+// that we can never handle, as opposed to errors talking to the registry,
+// which may go away on retry
+type badManifestError struct {
+	message string
+}
+
+func (e *badManifestError) Error() string {
+	return e.message
+}
+
+func badManifest(format string, args ...interface{}) error {
+	return &badManifestError{message: fmt.Sprintf(format, args...)}
+}
+
+// isTransient returns true unless err shows that the manifest itself
+// can't be handled
+func isTransient(err error) bool {
+	switch err.(type) {
+	case *badManifestError, *json.SyntaxError, *json.UnmarshalTypeError:
+		return false
+	}
+	// Returned by distribution.UnmarshalManifest
+	return !strings.HasPrefix(err.Error(), "unsupported manifest mediatype")
+}
+
+// failTag records a tag that we couldn't look up, remembering
+// whether the failure might go away so that the stored digest can be kept
+func (op *fetchOperation) failTag(failedTags map[string]*flagstate.FailedTag, tag string, descriptor distribution.Descriptor, err error) {
+	failTag(failedTags, tag, descriptor, err)
+	if isTransient(err) {
+		op.transientTags[tag] = true
+	} else {
+		delete(op.transientTags, tag)
+	}
+}
+
+func failTag(failedTags map[string]*flagstate.FailedTag, tag string, descriptor distribution.Descriptor, err error) {
+	failedTags[tag] = &flagstate.FailedTag{
+		Tag:       tag,
+		Digest:    descriptor.Digest,
+		MediaType: descriptor.MediaType,
+		Error:     err.Error(),
+	}
+}
+
+func sortedFailedTags(failedTags map[string]*flagstate.FailedTag) []*flagstate.FailedTag {
+	result := make([]*flagstate.FailedTag, 0, len(failedTags))
+	for _, failedTag := range failedTags {
+		result = append(result, failedTag)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Tag < result[j].Tag
+	})
+
+	return result
+}
+
+func failedTagsEqual(a []*flagstate.FailedTag, b []*flagstate.FailedTag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addTag records the tag in imageTags or listTags, depending on the media
+// type of the manifest it points to. Artifacts use the same media types as
+// images, so are included in imageTags. False is returned for manifests we
+// can't handle.
+func addTag(tag string, descriptor distribution.Descriptor, imageTags map[string]digest.Digest, listTags map[string]digest.Digest) bool {
+	switch descriptor.MediaType {
+	case mediaTypeSchema1SignedManifest, mediaTypeSchema1Manifest,
+		schema2.MediaTypeManifest, v1.MediaTypeImageManifest:
+		imageTags[tag] = descriptor.Digest
+	case manifestlist.MediaTypeManifestList, v1.MediaTypeImageIndex:
+		listTags[tag] = descriptor.Digest
+	default:
+		return false
+	}
+
+	return true
+}
+
 func stringsEqual(a []string, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -362,15 +912,30 @@ func stringsEqual(a []string, b []string) bool {
 	return true
 }
 
-func (f *Fetcher) updateRepositoryInDatabase(op *fetchOperation, tx database.Tx, imageTags map[string]digest.Digest, listTags map[string]digest.Digest) error {
+func tagsByDigest(tags map[string]digest.Digest) map[digest.Digest][]string {
+	result := make(map[digest.Digest][]string)
+	for tag, dgst := range tags {
+		result[dgst] = append(result[dgst], tag)
+	}
+	return result
+}
+
+// updateRepositoryInDatabase makes the stored tags of the repository match
+// imageTags and listTags, fetching any images, artifacts, and lists that
+// aren't already stored. Tags for manifests that can't be fetched are added to
+// failedTags, and stored separately, unless the failure might be temporary
+// and the tag was already stored.
+func (f *Fetcher) updateRepositoryInDatabase(op *fetchOperation, tx database.Tx, imageTags map[string]digest.Digest, listTags map[string]digest.Digest, failedTags map[string]*flagstate.FailedTag) error {
 	repository := op.repo.Named().Name()
-	repositories, err := tx.DoQuery(database.NewQuery().Repository(repository))
+	repositories, err := tx.DoQuery(database.NewQuery().Repository(repository).IncludeFailedTags())
 	if err != nil {
 		return err
 	}
 
 	oldImages := make(map[digest.Digest]*flagstate.TaggedImage)
 	oldLists := make(map[digest.Digest]*flagstate.TaggedImageList)
+	oldArtifacts := make(map[digest.Digest]*flagstate.TaggedArtifact)
+	var oldFailedTags []*flagstate.FailedTag
 	if len(repositories) > 0 {
 		oldRepo := repositories[0]
 		for _, image := range oldRepo.Images {
@@ -379,39 +944,169 @@ func (f *Fetcher) updateRepositoryInDatabase(op *fetchOperation, tx database.Tx,
 		for _, list := range oldRepo.Lists {
 			oldLists[list.Digest] = list
 		}
+		for _, artifact := range oldRepo.Artifacts {
+			oldArtifacts[artifact.Digest] = artifact
+		}
+		oldFailedTags = oldRepo.FailedTags
 	}
 
 	changed := false
+	// Subjects to check for new referrers. Referrers can be added without
+	// the tags of the subject changing, so when we've listed all the tags
+	// of the repository we check everything.
+	subjects := make(map[digest.Digest]bool)
+	checkReferrers := func(dgst digest.Digest, isNew bool) {
+		if isNew || op.allTags != nil || op.referrerSubjects[dgst] {
+			subjects[dgst] = true
+		}
+	}
 
-	newImages := make(map[digest.Digest][]string)
-	for tag, dgst := range imageTags {
-		newImages[dgst] = append(newImages[dgst], tag)
+	// Where each tag pointed before. If we can't find out where a tag
+	// points now because of an error talking to the registry, we keep the
+	// stored digest rather than dropping the tag until the next fetch.
+	oldImageTags := make(map[string]digest.Digest)
+	oldListTags := make(map[string]digest.Digest)
+	for dgst, image := range oldImages {
+		for _, tag := range image.Tags {
+			oldImageTags[tag] = dgst
+		}
+	}
+	for dgst, artifact := range oldArtifacts {
+		for _, tag := range artifact.Tags {
+			oldImageTags[tag] = dgst
+		}
+	}
+	for dgst, list := range oldLists {
+		for _, tag := range list.Tags {
+			oldListTags[tag] = dgst
+		}
 	}
 
-	for dgst, newTags := range newImages {
-		sort.Strings(newTags)
-		oldImage := oldImages[dgst]
-		if oldImage == nil {
-			var image flagstate.TaggedImage
-			err := f.fetchImage(op, dgst, &image.Image)
+	keepOldTag := func(tag string) bool {
+		if dgst, ok := oldImageTags[tag]; ok {
+			imageTags[tag] = dgst
+		} else if dgst, ok := oldListTags[tag]; ok {
+			listTags[tag] = dgst
+		} else {
+			return false
+		}
+		delete(failedTags, tag)
+		return true
+	}
+
+	failTags := func(tags []string, dgst digest.Digest, err error) {
+		for _, tag := range tags {
+			delete(imageTags, tag)
+			delete(listTags, tag)
+			if !isTransient(err) || !keepOldTag(tag) {
+				failTag(failedTags, tag, distribution.Descriptor{Digest: dgst}, err)
+			}
+		}
+	}
+
+	for tag := range failedTags {
+		if op.transientTags[tag] {
+			keepOldTag(tag)
+		}
+	}
+
+	// Fetch everything new first, since a failure can move a tag back to
+	// an image or list we'd otherwise have deleted
+	fetchedImages := make(map[digest.Digest]*flagstate.Image)
+	fetchedArtifacts := make(map[digest.Digest]*flagstate.Artifact)
+	for dgst, newTags := range tagsByDigest(imageTags) {
+		if oldImages[dgst] != nil || oldArtifacts[dgst] != nil {
+			continue
+		}
+
+		// The image may already be stored for another repository,
+		// typically because it was promoted from one to another
+		image, err := tx.GetImage(dgst)
+		if err != nil {
+			return err
+		}
+		var artifact *flagstate.Artifact
+		if image == nil {
+			artifact, err = tx.GetArtifact(dgst)
 			if err != nil {
 				return err
 			}
-			image.Tags = newTags
-			err = tx.StoreImage(repository, &image)
+		}
+		if image == nil && artifact == nil {
+			image, artifact, err = f.fetchManifest(op, dgst)
 			if err != nil {
-				return err
+				log.Printf("Error fetching image %s@%s: %v", repository, dgst, err)
+				failTags(newTags, dgst, err)
+				continue
+			}
+		}
+		fetchedImages[dgst] = image
+		fetchedArtifacts[dgst] = artifact
+	}
+
+	fetchedLists := make(map[digest.Digest]*flagstate.ImageList)
+	for dgst, newTags := range tagsByDigest(listTags) {
+		if oldLists[dgst] != nil {
+			continue
+		}
+
+		list, err := tx.GetImageList(dgst)
+		if err != nil {
+			return err
+		}
+		if list == nil {
+			list = &flagstate.ImageList{}
+			err = f.fetchImageList(op, tx, dgst, list)
+			if err != nil {
+				log.Printf("Error fetching image list %s@%s: %v", repository, dgst, err)
+				failTags(newTags, dgst, err)
+				continue
+			}
+		}
+		fetchedLists[dgst] = list
+	}
+
+	for dgst, newTags := range tagsByDigest(imageTags) {
+		sort.Strings(newTags)
+		oldImage := oldImages[dgst]
+		oldArtifact := oldArtifacts[dgst]
+		if oldImage != nil {
+			if !stringsEqual(oldImage.Tags, newTags) {
+				err = tx.SetImageTags(repository, dgst, newTags)
+				if err != nil {
+					return err
+				}
+				changed = true
+			}
+		} else if oldArtifact != nil {
+			if !stringsEqual(oldArtifact.Tags, newTags) {
+				err = tx.SetArtifactTags(repository, dgst, newTags)
+				if err != nil {
+					return err
+				}
+				changed = true
+			}
+		} else {
+			if artifact := fetchedArtifacts[dgst]; artifact != nil {
+				err = tx.StoreArtifact(repository, &flagstate.TaggedArtifact{
+					Artifact: *artifact,
+					Tags:     newTags,
+				})
+			} else {
+				err = tx.StoreImage(repository, &flagstate.TaggedImage{
+					Image: *fetchedImages[dgst],
+					Tags:  newTags,
+				})
 			}
-			changed = true
-		} else if !stringsEqual(oldImage.Tags, newTags) {
-			err = tx.SetImageTags(repository, dgst, newTags)
 			if err != nil {
 				return err
 			}
 			changed = true
 		}
 
+		checkReferrers(dgst, oldImage == nil && oldArtifact == nil)
 		delete(oldImages, dgst)
+		delete(oldArtifacts, dgst)
 	}
 
 	for dgst := range oldImages {
@@ -419,22 +1114,19 @@ func (f *Fetcher) updateRepositoryInDatabase(op *fetchOperation, tx database.Tx,
 		changed = true
 	}
 
-	newLists := make(map[digest.Digest][]string)
-	for tag, dgst := range listTags {
-		newLists[dgst] = append(newLists[dgst], tag)
+	for dgst := range oldArtifacts {
+		tx.DeleteArtifact(repository, dgst)
+		changed = true
 	}
 
-	for dgst, newTags := range newLists {
+	for dgst, newTags := range tagsByDigest(listTags) {
 		sort.Strings(newTags)
 		oldList := oldLists[dgst]
 		if oldList == nil {
-			var list flagstate.TaggedImageList
-			err := f.fetchImageList(op, dgst, &list.ImageList)
-			if err != nil {
-				return err
-			}
-			list.Tags = newTags
-			err = tx.StoreImageList(repository, &list)
+			err = tx.StoreImageList(repository, &flagstate.TaggedImageList{
+				ImageList: *fetchedLists[dgst],
+				Tags:      newTags,
+			})
 			if err != nil {
 				return err
 			}
@@ -447,6 +1139,7 @@ func (f *Fetcher) updateRepositoryInDatabase(op *fetchOperation, tx database.Tx,
 			changed = true
 		}
 
+		checkReferrers(dgst, oldList == nil)
 		delete(oldLists, dgst)
 	}
 
@@ -455,6 +1148,23 @@ func (f *Fetcher) updateRepositoryInDatabase(op *fetchOperation, tx database.Tx,
 		changed = true
 	}
 
+	referrersChanged, err := f.updateReferrers(op, tx, subjects)
+	if err != nil {
+		return err
+	}
+	if referrersChanged {
+		changed = true
+	}
+
+	newFailedTags := sortedFailedTags(failedTags)
+	if !failedTagsEqual(oldFailedTags, newFailedTags) {
+		err = tx.SetFailedTags(repository, newFailedTags)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+
 	if changed {
 		f.changes.Change()
 	}
@@ -470,25 +1180,56 @@ type fetchOperation struct {
 	blobs     distribution.BlobService
 	tags      distribution.TagService
 	manifests distribution.ManifestService
+	// For parts of the registry API that the client library doesn't handle
+	client *http.Client
+
+	// Set when we've listed all the tags of the repository
+	allTags map[string]bool
+	// Set when a request to the referrers API fails with 404
+	referrersUnsupported bool
+	// Subjects that notifications told us might have new referrers
+	referrerSubjects map[digest.Digest]bool
+	// Failed tags whose lookup might succeed if retried
+	transientTags map[string]bool
+}
+
+// request makes a request to the registry for path, relative to the
+// repository's part of the API
+func (op *fetchOperation) request(method string, path string, accept string) (*http.Response, error) {
+	url := strings.TrimRight(op.fetcher.registryUrl, "/") + "/v2/" + op.repo.Named().Name() + "/" + path
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(op.ctx)
+	req.Header.Set("Accept", accept)
+
+	return op.client.Do(req)
 }
 
 func (f *Fetcher) newFetchOperation(ctx context.Context, repository string) (*fetchOperation, error) {
 	op := &fetchOperation{
-		ctx:     ctx,
-		fetcher: f,
+		ctx:              ctx,
+		fetcher:          f,
+		referrerSubjects: make(map[digest.Digest]bool),
+		transientTags:    make(map[string]bool),
 	}
 
-	trans := transport.NewTransport(nil)
-
 	ref, err := reference.ParseNamed(repository)
 	if err != nil {
 		return nil, err
 	}
 
+	trans, err := f.authenticator.transport(repositoryScope(ref.Name()))
+	if err != nil {
+		return nil, err
+	}
+
 	op.repo, err = client.NewRepository(ctx, ref, f.registryUrl, trans)
 	if err != nil {
 		return nil, err
 	}
+	op.client = &http.Client{Transport: trans}
 
 	op.tags = op.repo.Tags(op.ctx)
 
@@ -507,7 +1248,7 @@ func (f *Fetcher) fetchRepository(ctx context.Context, repository string) error
 		return err
 	}
 
-	imageTags, listTags, err := f.getTagsFromRegistry(op)
+	imageTags, listTags, failedTags, err := f.getTagsFromRegistry(op)
 	if err != nil {
 		return err
 	}
@@ -517,7 +1258,153 @@ func (f *Fetcher) fetchRepository(ctx context.Context, repository string) error
 		return err
 	}
 
-	err = f.updateRepositoryInDatabase(op, tx, imageTags, listTags)
+	err = f.updateRepositoryInDatabase(op, tx, imageTags, listTags, failedTags)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	f.checkModification(tx)
+
+	return nil
+}
+
+func (f *Fetcher) getTagsFromDatabase(tx database.Tx, repository string) (imageTags map[string]digest.Digest, listTags map[string]digest.Digest, failedTags map[string]*flagstate.FailedTag, err error) {
+	imageTags = make(map[string]digest.Digest)
+	listTags = make(map[string]digest.Digest)
+	failedTags = make(map[string]*flagstate.FailedTag)
+
+	repositories, err := tx.DoQuery(database.NewQuery().Repository(repository).IncludeFailedTags())
+	if err != nil {
+		return
+	}
+
+	for _, repo := range repositories {
+		for _, image := range repo.Images {
+			for _, tag := range image.Tags {
+				imageTags[tag] = image.Digest
+			}
+		}
+		for _, list := range repo.Lists {
+			for _, tag := range list.Tags {
+				listTags[tag] = list.Digest
+			}
+		}
+		// Artifacts are tagged with manifest media types, like images
+		for _, artifact := range repo.Artifacts {
+			for _, tag := range artifact.Tags {
+				imageTags[tag] = artifact.Digest
+			}
+		}
+		for _, failedTag := range repo.FailedTags {
+			failedTags[failedTag.Tag] = failedTag
+		}
+	}
+
+	return
+}
+
+func (f *Fetcher) applyTagUpdate(op *fetchOperation, update util.TagUpdate, imageTags map[string]digest.Digest, listTags map[string]digest.Digest, failedTags map[string]*flagstate.FailedTag) {
+	if subject, _, ok := parseFallbackTag(update.Tag); ok {
+		op.referrerSubjects[subject] = true
+		return
+	}
+
+	if update.Deleted {
+		if update.Tag != "" {
+			delete(imageTags, update.Tag)
+			delete(listTags, update.Tag)
+			delete(failedTags, update.Tag)
+		} else {
+			for tag, dgst := range imageTags {
+				if dgst == update.Digest {
+					delete(imageTags, tag)
+				}
+			}
+			for tag, dgst := range listTags {
+				if dgst == update.Digest {
+					delete(listTags, tag)
+				}
+			}
+			for tag, failedTag := range failedTags {
+				if failedTag.Digest == update.Digest {
+					delete(failedTags, tag)
+				}
+			}
+		}
+
+		return
+	}
+
+	// A manifest pushed by digest doesn't change any tags, but it might
+	// be a referrer to something that is tagged
+	if update.Tag == "" {
+		if update.MediaType == v1.MediaTypeImageManifest || update.MediaType == v1.MediaTypeImageIndex {
+			f.addReferrerSubject(op, update.Digest)
+		}
+		return
+	}
+
+	delete(imageTags, update.Tag)
+	delete(listTags, update.Tag)
+	delete(failedTags, update.Tag)
+	delete(op.transientTags, update.Tag)
+
+	descriptor := distribution.Descriptor{
+		Digest:    update.Digest,
+		MediaType: update.MediaType,
+	}
+	if descriptor.Digest != "" && addTag(update.Tag, descriptor, imageTags, listTags) {
+		return
+	}
+
+	// The notification didn't tell us what the tag points to, or it
+	// points to something we can't handle; ask the registry
+	descriptor, err := op.tags.Get(op.ctx, update.Tag)
+	if err != nil {
+		op.failTag(failedTags, update.Tag, descriptor, err)
+		return
+	}
+	if !addTag(update.Tag, descriptor, imageTags, listTags) {
+		failTag(failedTags, update.Tag, descriptor, unsupportedError(descriptor))
+	}
+}
+
+// fetchTags applies tag updates from registry notifications to the
+// information stored for a repository. If nothing is stored for the
+// repository yet, the entire repository is fetched instead.
+func (f *Fetcher) fetchTags(ctx context.Context, repository string, updates []util.TagUpdate) error {
+	op, err := f.newFetchOperation(ctx, repository)
+	if err != nil {
+		return err
+	}
+
+	tx, err := f.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	imageTags, listTags, failedTags, err := f.getTagsFromDatabase(tx, repository)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if len(imageTags) == 0 && len(listTags) == 0 && len(failedTags) == 0 {
+		tx.Rollback()
+		return f.fetchRepository(ctx, repository)
+	}
+
+	for _, update := range updates {
+		f.applyTagUpdate(op, update, imageTags, listTags, failedTags)
+	}
+
+	err = f.updateRepositoryInDatabase(op, tx, imageTags, listTags, failedTags)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -0,0 +1,589 @@
+package fetcher
+
+import (
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/util"
+	"testing"
+	"time"
+)
+
+func testConfig(os string, architecture string) map[string]interface{} {
+	return map[string]interface{}{
+		"os":           os,
+		"architecture": architecture,
+		"config": map[string]interface{}{
+			"Labels": map[string]string{
+				"org.example.label": architecture,
+			},
+		},
+	}
+}
+
+func TestFetchManifestList(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	amd64 := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	ppc64le := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "ppc64le"), nil)
+	listDigest := tr.addManifest(manifestlist.MediaTypeManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestlist.MediaTypeManifestList,
+		"manifests": []interface{}{
+			tr.descriptor(amd64),
+			tr.descriptor(ppc64le),
+		},
+	})
+
+	op := newTestOperation(t, tr, "foo/bar")
+	var list flagstate.ImageList
+	err := op.fetcher.fetchImageList(op, newTestTx(), listDigest, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.MediaType != manifestlist.MediaTypeManifestList {
+		t.Errorf("Expected media type %s, got %s", manifestlist.MediaTypeManifestList, list.MediaType)
+	}
+	if len(list.Images) != 2 || list.Images[0].Digest != amd64 || list.Images[1].Digest != ppc64le {
+		t.Fatalf("Unexpected images %+v", list.Images)
+	}
+	if list.Images[1].Architecture != "ppc64le" || list.Images[1].Labels["org.example.label"] != "ppc64le" {
+		t.Errorf("Unexpected image %+v", list.Images[1])
+	}
+}
+
+func TestFetchOCIIndex(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	amd64 := tr.addImage(v1.MediaTypeImageManifest, testConfig("linux", "amd64"),
+		map[string]string{"org.opencontainers.image.title": "Amd64"})
+	arm64 := tr.addImage(v1.MediaTypeImageManifest, testConfig("linux", "arm64"), nil)
+	s390x := tr.addImage(v1.MediaTypeImageManifest, testConfig("linux", "s390x"), nil)
+
+	nestedDigest := tr.addManifest(v1.MediaTypeImageIndex, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []interface{}{
+			tr.descriptor(arm64),
+			tr.descriptor(s390x),
+		},
+		"annotations": map[string]string{
+			"org.example.nested": "true",
+		},
+	})
+	indexDigest := tr.addManifest(v1.MediaTypeImageIndex, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageIndex,
+		"manifests": []interface{}{
+			tr.descriptor(amd64),
+			tr.descriptor(nestedDigest),
+			tr.descriptor(arm64),
+		},
+		"annotations": map[string]string{
+			"org.opencontainers.image.title": "Foo",
+		},
+	})
+
+	op := newTestOperation(t, tr, "foo/bar")
+	var list flagstate.ImageList
+	err := op.fetcher.fetchImageList(op, newTestTx(), indexDigest, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.MediaType != v1.MediaTypeImageIndex {
+		t.Errorf("Expected media type %s, got %s", v1.MediaTypeImageIndex, list.MediaType)
+	}
+	if len(list.Annotations) != 1 || list.Annotations["org.opencontainers.image.title"] != "Foo" {
+		t.Errorf("Unexpected annotations %v", list.Annotations)
+	}
+
+	// Images from the nested index are flattened, and duplicates removed
+	if len(list.Images) != 3 ||
+		list.Images[0].Digest != amd64 || list.Images[1].Digest != arm64 || list.Images[2].Digest != s390x {
+		t.Fatalf("Unexpected images %+v", list.Images)
+	}
+	if list.Images[0].MediaType != v1.MediaTypeImageManifest ||
+		list.Images[0].Annotations["org.opencontainers.image.title"] != "Amd64" {
+		t.Errorf("Unexpected image %+v", list.Images[0])
+	}
+}
+
+func TestFetchOCIIndexNestedNoMediaType(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	amd64 := tr.addImage(v1.MediaTypeImageManifest, testConfig("linux", "amd64"), nil)
+	nestedDigest := tr.addManifest(v1.MediaTypeImageIndex, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []interface{}{
+			tr.descriptor(amd64),
+		},
+	})
+	// The descriptor for the nested index doesn't say it's an index
+	descriptor := tr.descriptor(nestedDigest)
+	delete(descriptor, "mediaType")
+	indexDigest := tr.addManifest(v1.MediaTypeImageIndex, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []interface{}{descriptor},
+	})
+
+	op := newTestOperation(t, tr, "foo/bar")
+	var list flagstate.ImageList
+	err := op.fetcher.fetchImageList(op, newTestTx(), indexDigest, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Images) != 1 || list.Images[0].Digest != amd64 {
+		t.Fatalf("Unexpected images %+v", list.Images)
+	}
+}
+
+func TestFetchPlatformDetails(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	windowsConfig := testConfig("windows", "amd64")
+	windowsConfig["os.version"] = "10.0.14393.1066"
+	windowsConfig["os.features"] = []string{"win32k"}
+	windows := tr.addImage(schema2.MediaTypeManifest, windowsConfig, nil)
+
+	// Variant only in the manifest list
+	armv7 := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "arm"), nil)
+	armv7Descriptor := tr.descriptor(armv7)
+	armv7Descriptor["platform"] = map[string]interface{}{
+		"os":           "linux",
+		"architecture": "arm",
+		"variant":      "v7",
+	}
+
+	// Variant in both; the image config wins
+	armv6Config := testConfig("linux", "arm")
+	armv6Config["variant"] = "v6"
+	armv6 := tr.addImage(schema2.MediaTypeManifest, armv6Config, nil)
+	armv6Descriptor := tr.descriptor(armv6)
+	armv6Descriptor["platform"] = map[string]interface{}{
+		"os":           "linux",
+		"architecture": "arm",
+		"variant":      "v5",
+	}
+
+	listDigest := tr.addManifest(manifestlist.MediaTypeManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestlist.MediaTypeManifestList,
+		"manifests": []interface{}{
+			tr.descriptor(windows),
+			armv7Descriptor,
+			armv6Descriptor,
+		},
+	})
+
+	op := newTestOperation(t, tr, "foo/bar")
+	var list flagstate.ImageList
+	err := op.fetcher.fetchImageList(op, newTestTx(), listDigest, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Images) != 3 {
+		t.Fatalf("Unexpected images %+v", list.Images)
+	}
+
+	image := list.Images[0]
+	if image.OS != "windows" || image.OSVersion != "10.0.14393.1066" ||
+		len(image.OSFeatures) != 1 || image.OSFeatures[0] != "win32k" {
+		t.Errorf("Unexpected image %+v", image)
+	}
+	if v := list.Images[1].Variant; v != "v7" {
+		t.Errorf("Expected variant v7, got '%s'", v)
+	}
+	if v := list.Images[2].Variant; v != "v6" {
+		t.Errorf("Expected variant v6, got '%s'", v)
+	}
+}
+
+func TestFetchConfigMetadata(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	config := testConfig("linux", "amd64")
+	config["created"] = "2017-09-05T14:23:41.123456789Z"
+	config["author"] = "Jane Doe <jane@example.com>"
+	config["config"] = map[string]interface{}{
+		"Entrypoint": []string{"/usr/bin/foo"},
+		"Cmd":        []string{"--help"},
+		"Env":        []string{"PATH=/usr/bin:/bin"},
+		"ExposedPorts": map[string]interface{}{
+			"8080/tcp": map[string]interface{}{},
+			"53/udp":   map[string]interface{}{},
+		},
+		"User":       "1001",
+		"WorkingDir": "/srv",
+	}
+	config["history"] = []interface{}{
+		map[string]interface{}{
+			"created":    "2017-09-05T14:20:00Z",
+			"created_by": "/bin/sh -c #(nop) ADD file:abc in /",
+		},
+		map[string]interface{}{
+			"created":     "2017-09-05T14:23:41Z",
+			"created_by":  "/bin/sh -c #(nop) CMD [\"--help\"]",
+			"empty_layer": true,
+		},
+	}
+	dgst := tr.addImage(schema2.MediaTypeManifest, config, nil)
+
+	op := newTestOperation(t, tr, "foo/bar")
+	var image flagstate.Image
+	err := op.fetcher.fetchImage(op, dgst, &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.Created == nil || image.Created.Nanosecond() != 123456789 || image.Created.Year() != 2017 {
+		t.Errorf("Unexpected created time %v", image.Created)
+	}
+	if image.Author != "Jane Doe <jane@example.com>" {
+		t.Errorf("Unexpected author %s", image.Author)
+	}
+
+	c := image.Config
+	if c == nil {
+		t.Fatal("Expected config to be set")
+	}
+	if len(c.Entrypoint) != 1 || c.Entrypoint[0] != "/usr/bin/foo" ||
+		len(c.Cmd) != 1 || c.Cmd[0] != "--help" ||
+		len(c.Env) != 1 || c.Env[0] != "PATH=/usr/bin:/bin" ||
+		c.User != "1001" || c.WorkingDir != "/srv" {
+		t.Errorf("Unexpected config %+v", c)
+	}
+	if len(c.ExposedPorts) != 2 || c.ExposedPorts[0] != "53/udp" || c.ExposedPorts[1] != "8080/tcp" {
+		t.Errorf("Unexpected exposed ports %v", c.ExposedPorts)
+	}
+
+	if len(image.History) != 2 ||
+		image.History[0].EmptyLayer || !image.History[1].EmptyLayer ||
+		image.History[0].CreatedBy != "/bin/sh -c #(nop) ADD file:abc in /" ||
+		image.History[1].Created == nil {
+		t.Errorf("Unexpected history %+v", image.History)
+	}
+}
+
+func TestFetchLayers(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	amd64 := tr.addImageWithLayers(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil,
+		[]string{"base layer", "amd64 layer"})
+	arm64 := tr.addImageWithLayers(schema2.MediaTypeManifest, testConfig("linux", "arm64"), nil,
+		[]string{"base layer", "arm64 layer!"})
+	listDigest := tr.addManifest(manifestlist.MediaTypeManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestlist.MediaTypeManifestList,
+		"manifests": []interface{}{
+			tr.descriptor(amd64),
+			tr.descriptor(arm64),
+		},
+	})
+
+	op := newTestOperation(t, tr, "foo/bar")
+	var list flagstate.ImageList
+	err := op.fetcher.fetchImageList(op, newTestTx(), listDigest, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := list.Images[0]
+	if len(image.Layers) != 2 || image.Layers[0].Size != 10 || image.Layers[1].Size != 11 {
+		t.Fatalf("Unexpected layers %+v", image.Layers)
+	}
+	if image.Layers[0].MediaType != schema2.MediaTypeLayer {
+		t.Errorf("Unexpected layer media type %s", image.Layers[0].MediaType)
+	}
+	if image.ConfigBlob == nil || image.ConfigBlob.MediaType != schema2.MediaTypeConfig {
+		t.Fatalf("Unexpected config blob %+v", image.ConfigBlob)
+	}
+	if image.Size != image.ConfigBlob.Size+21 {
+		t.Errorf("Expected size %d, got %d", image.ConfigBlob.Size+21, image.Size)
+	}
+
+	// The base layer is shared, and should only be counted once
+	expected := list.Images[0].ConfigBlob.Size + list.Images[1].ConfigBlob.Size + 10 + 11 + 12
+	if list.Size != expected {
+		t.Errorf("Expected list size %d, got %d", expected, list.Size)
+	}
+}
+
+func TestFetchReusesStoredDigests(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	amd64 := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	ppc64le := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "ppc64le"), nil)
+	listDigest := tr.addManifest(manifestlist.MediaTypeManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestlist.MediaTypeManifestList,
+		"manifests": []interface{}{
+			tr.descriptor(amd64),
+			tr.descriptor(ppc64le),
+		},
+	})
+
+	tx := newTestTx()
+	imageTags := map[string]digest.Digest{"image": amd64}
+	listTags := map[string]digest.Digest{"list": listDigest}
+
+	op := newTestOperation(t, tr, "staging/foo")
+	err := op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, listTags, map[string]*flagstate.FailedTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.gets == 0 {
+		t.Fatalf("Expected images to be fetched")
+	}
+
+	// Promoting the same digests to another repository shouldn't require
+	// fetching anything from the registry
+	tr.gets = 0
+	op = newTestOperation(t, tr, "prod/foo")
+	err = op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, listTags, map[string]*flagstate.FailedTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.gets != 0 {
+		t.Errorf("Expected no fetches, got %d", tr.gets)
+	}
+	if !stringsEqual(tx.imageTags["prod/foo"][amd64], []string{"image"}) ||
+		!stringsEqual(tx.listTags["prod/foo"][listDigest], []string{"list"}) {
+		t.Errorf("Unexpected tags %v %v", tx.imageTags["prod/foo"], tx.listTags["prod/foo"])
+	}
+
+	// A new list made of images that are already stored only needs the
+	// list itself to be fetched
+	otherListDigest := tr.addManifest(manifestlist.MediaTypeManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestlist.MediaTypeManifestList,
+		"manifests": []interface{}{
+			tr.descriptor(ppc64le),
+			tr.descriptor(amd64),
+		},
+	})
+	listTags["other"] = otherListDigest
+
+	tr.gets = 0
+	err = op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, listTags, map[string]*flagstate.FailedTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.gets != 1 {
+		t.Errorf("Expected only the list to be fetched, got %d fetches", tr.gets)
+	}
+	otherList := tx.lists[otherListDigest]
+	if otherList == nil || len(otherList.Images) != 2 ||
+		otherList.Images[0].Architecture != "ppc64le" || otherList.Images[1].Architecture != "amd64" {
+		t.Errorf("Unexpected list %+v", otherList)
+	}
+}
+
+func TestApplyTagUpdate(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	amd64 := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	ppc64le := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "ppc64le"), nil)
+	listDigest := tr.addManifest(manifestlist.MediaTypeManifestList, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     manifestlist.MediaTypeManifestList,
+		"manifests": []interface{}{
+			tr.descriptor(amd64),
+		},
+	})
+	tr.tag("foo/bar", "list", listDigest)
+
+	op := newTestOperation(t, tr, "foo/bar")
+	imageTags := map[string]digest.Digest{"a": amd64, "b": amd64, "list": amd64}
+	listTags := map[string]digest.Digest{}
+	failedTags := map[string]*flagstate.FailedTag{}
+
+	apply := func(update util.TagUpdate) {
+		op.fetcher.applyTagUpdate(op, update, imageTags, listTags, failedTags)
+	}
+
+	apply(util.TagUpdate{Tag: "c", Digest: ppc64le, MediaType: schema2.MediaTypeManifest})
+	if imageTags["c"] != ppc64le {
+		t.Errorf("Expected c to be added, got %v", imageTags)
+	}
+
+	// Without a media type, the registry is asked what the tag points to
+	apply(util.TagUpdate{Tag: "list", Digest: listDigest})
+	if _, ok := imageTags["list"]; ok || listTags["list"] != listDigest {
+		t.Errorf("Expected list to move to a list, got %v %v", imageTags, listTags)
+	}
+
+	apply(util.TagUpdate{Tag: "c", Deleted: true})
+	if _, ok := imageTags["c"]; ok {
+		t.Errorf("Expected c to be removed, got %v", imageTags)
+	}
+
+	apply(util.TagUpdate{Digest: amd64, Deleted: true})
+	if len(imageTags) != 0 || len(listTags) != 1 {
+		t.Errorf("Expected a and b to be removed, got %v %v", imageTags, listTags)
+	}
+
+	apply(util.TagUpdate{Tag: "missing"})
+	if failedTags["missing"] == nil {
+		t.Errorf("Expected missing to fail, got %v", failedTags)
+	}
+	apply(util.TagUpdate{Tag: "missing", Deleted: true})
+	if len(failedTags) != 0 {
+		t.Errorf("Expected missing to be removed, got %v", failedTags)
+	}
+}
+
+func TestFetchKeepsPartialResults(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	good := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	tr.tag("foo/bar", "good", good)
+
+	// The config blob is missing
+	broken := tr.addManifest(schema2.MediaTypeManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     schema2.MediaTypeManifest,
+		"config": map[string]interface{}{
+			"mediaType": schema2.MediaTypeConfig,
+			"digest":    digest.FromBytes([]byte("missing")),
+			"size":      7,
+		},
+		"layers": []interface{}{},
+	})
+	tr.tag("foo/bar", "broken", broken)
+
+	unsupported := tr.addManifest("application/vnd.example.unknown+json", map[string]interface{}{
+		"schemaVersion": 2,
+	})
+	tr.tag("foo/bar", "unsupported", unsupported)
+
+	op := newTestOperation(t, tr, "foo/bar")
+	imageTags, listTags, failedTags, err := op.fetcher.getTagsFromRegistry(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failedTags["unsupported"] == nil || failedTags["unsupported"].Digest != unsupported {
+		t.Errorf("Expected unsupported to fail, got %v", failedTags)
+	}
+
+	tx := newTestTx()
+	err = op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, listTags, failedTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stringsEqual(tx.imageTags["foo/bar"][good], []string{"good"}) {
+		t.Errorf("Expected good to be stored, got %v", tx.imageTags["foo/bar"])
+	}
+	if _, ok := tx.imageTags["foo/bar"][broken]; ok {
+		t.Errorf("Expected broken not to be stored")
+	}
+
+	stored := tx.failedTags["foo/bar"]
+	if len(stored) != 2 || stored[0].Tag != "broken" || stored[0].Digest != broken || stored[1].Tag != "unsupported" {
+		t.Errorf("Unexpected failed tags %+v", stored)
+	}
+}
+
+func TestFetchKeepsTagsOnTransientErrors(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	old := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	tr.tag("foo/bar", "latest", old)
+	tr.unavailable["latest"] = true
+
+	moved := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "arm64"), nil)
+	tr.tag("foo/bar", "moved", moved)
+	tr.unavailable[moved.String()] = true
+
+	added := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "s390x"), nil)
+	tr.tag("foo/bar", "added", added)
+	tr.unavailable[added.String()] = true
+
+	unsupported := tr.addManifest("application/vnd.example.unknown+json", map[string]interface{}{
+		"schemaVersion": 2,
+	})
+	tr.tag("foo/bar", "unsupported", unsupported)
+
+	tx := newTestTx()
+	oldTags := []string{"latest", "moved", "unsupported"}
+	tx.stored = &flagstate.Repository{
+		Name: "foo/bar",
+		Images: []*flagstate.TaggedImage{
+			{Image: flagstate.Image{Digest: old}, Tags: oldTags},
+		},
+	}
+	tx.SetImageTags("foo/bar", old, oldTags)
+
+	op := newTestOperation(t, tr, "foo/bar")
+	imageTags, listTags, failedTags, err := op.fetcher.getTagsFromRegistry(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, listTags, failedTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tags that we couldn't look up keep their stored digest, but a tag
+	// that now points to something we can't handle is dropped
+	if !stringsEqual(tx.imageTags["foo/bar"][old], []string{"latest", "moved"}) {
+		t.Errorf("Expected stored tags to be kept, got %v", tx.imageTags["foo/bar"])
+	}
+	if _, ok := tx.imageTags["foo/bar"][moved]; ok {
+		t.Errorf("Expected moved not to be stored")
+	}
+
+	stored := tx.failedTags["foo/bar"]
+	if len(stored) != 2 || stored[0].Tag != "added" || stored[0].Digest != added || stored[1].Tag != "unsupported" {
+		t.Errorf("Unexpected failed tags %+v", stored)
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	f := &Fetcher{
+		channel:     make(chan fetchRequest, 10),
+		retryTimers: make(map[string]*time.Timer),
+	}
+
+	// Failures from different sources each schedule a retry, but only the
+	// last one stays pending
+	for i := 0; i < 3; i++ {
+		f.scheduleRetry("foo", 50*time.Millisecond)
+	}
+	f.scheduleRetry("bar", time.Hour)
+	if len(f.retryTimers) != 2 {
+		t.Fatalf("Expected 2 pending retries, got %d", len(f.retryTimers))
+	}
+
+	f.cancelRetry("bar")
+
+	request := <-f.channel
+	if request.which != requestFetchRepository || request.repository != "foo" {
+		t.Errorf("Unexpected request %+v", request)
+	}
+	select {
+	case request := <-f.channel:
+		t.Errorf("Unexpected second request %+v", request)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	f.retryLock.Lock()
+	pending := len(f.retryTimers)
+	f.retryLock.Unlock()
+	if pending != 0 {
+		t.Errorf("Expected no pending retries, got %d", pending)
+	}
+}
@@ -0,0 +1,111 @@
+package fetcher
+
+import (
+	"fmt"
+	"github.com/owtaylor/flagstate"
+	"sort"
+	"strings"
+)
+
+// Labels that flatpak build-bundle --oci puts on images
+const (
+	labelFlatpakRef      = "org.flatpak.ref"
+	labelFlatpakMetadata = "org.flatpak.metadata"
+)
+
+// parseKeyFile parses a file in the GLib key file format, returning the
+// keys of each group
+func parseKeyFile(content string) (map[string]map[string]string, error) {
+	groups := make(map[string]map[string]string)
+	var group map[string]string
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			name := line[1 : len(line)-1]
+			group = groups[name]
+			if group == nil {
+				group = make(map[string]string)
+				groups[name] = group
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 || group == nil {
+			return nil, fmt.Errorf("Invalid line %d in key file", i+1)
+		}
+		group[strings.TrimSpace(line[:eq])] = strings.TrimSpace(line[eq+1:])
+	}
+
+	return groups, nil
+}
+
+// splitList splits a semicolon-separated key file list
+func splitList(value string) []string {
+	var result []string
+	for _, v := range strings.Split(value, ";") {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// parseFlatpakMetadata returns the Flatpak metadata from an image's labels,
+// or nil if it isn't a Flatpak
+func parseFlatpakMetadata(labels map[string]string) (*flagstate.FlatpakMetadata, error) {
+	ref, haveRef := labels[labelFlatpakRef]
+	metadata, haveMetadata := labels[labelFlatpakMetadata]
+	if !haveRef && !haveMetadata {
+		return nil, nil
+	}
+
+	groups, err := parseKeyFile(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var result flagstate.FlatpakMetadata
+	var main map[string]string
+	if group, ok := groups["Application"]; ok {
+		result.Kind = "app"
+		main = group
+	} else if group, ok := groups["Runtime"]; ok {
+		result.Kind = "runtime"
+		main = group
+	}
+	result.Id = main["name"]
+	result.Runtime = main["runtime"]
+	result.Sdk = main["sdk"]
+
+	// The ref is KIND/ID/ARCH/BRANCH
+	if haveRef {
+		parts := strings.Split(ref, "/")
+		if len(parts) != 4 || parts[0] != "app" && parts[0] != "runtime" {
+			return nil, fmt.Errorf("Invalid Flatpak ref '%s'", ref)
+		}
+		result.Kind, result.Id, result.Arch, result.Branch = parts[0], parts[1], parts[2], parts[3]
+	}
+	if result.Kind == "" || result.Id == "" {
+		return nil, fmt.Errorf("Flatpak metadata doesn't have an ID")
+	}
+
+	context := groups["Context"]
+	result.Shared = splitList(context["shared"])
+	result.Sockets = splitList(context["sockets"])
+	result.Devices = splitList(context["devices"])
+	result.Filesystems = splitList(context["filesystems"])
+
+	for name := range groups {
+		if strings.HasPrefix(name, "Extension ") {
+			result.Extensions = append(result.Extensions, strings.TrimPrefix(name, "Extension "))
+		}
+	}
+	sort.Strings(result.Extensions)
+
+	return &result, nil
+}
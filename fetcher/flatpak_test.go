@@ -0,0 +1,107 @@
+package fetcher
+
+import (
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/owtaylor/flagstate"
+	"reflect"
+	"testing"
+)
+
+const mapsMetadata = `[Application]
+name=org.gnome.Maps
+runtime=org.gnome.Platform/x86_64/46
+sdk=org.gnome.Sdk/x86_64/46
+command=gnome-maps
+
+[Context]
+shared=network;ipc;
+sockets=x11;wayland;fallback-x11;
+devices=dri;
+filesystems=xdg-download;home:ro;
+
+[Extension org.gnome.Maps.Plugin]
+directory=lib/plugins
+
+[Extension org.freedesktop.Platform.ffmpeg-full]
+directory=lib/ffmpeg
+`
+
+func TestParseFlatpakMetadata(t *testing.T) {
+	metadata, err := parseFlatpakMetadata(map[string]string{
+		labelFlatpakRef:      "app/org.gnome.Maps/x86_64/stable",
+		labelFlatpakMetadata: mapsMetadata,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := flagstate.FlatpakMetadata{
+		Kind:        "app",
+		Id:          "org.gnome.Maps",
+		Arch:        "x86_64",
+		Branch:      "stable",
+		Runtime:     "org.gnome.Platform/x86_64/46",
+		Sdk:         "org.gnome.Sdk/x86_64/46",
+		Shared:      []string{"network", "ipc"},
+		Sockets:     []string{"x11", "wayland", "fallback-x11"},
+		Devices:     []string{"dri"},
+		Filesystems: []string{"xdg-download", "home:ro"},
+		Extensions:  []string{"org.freedesktop.Platform.ffmpeg-full", "org.gnome.Maps.Plugin"},
+	}
+	if !reflect.DeepEqual(*metadata, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, *metadata)
+	}
+
+	// Without a ref, the ID comes from the metadata
+	metadata, err = parseFlatpakMetadata(map[string]string{
+		labelFlatpakMetadata: "[Runtime]\nname=org.gnome.Platform\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Kind != "runtime" || metadata.Id != "org.gnome.Platform" || metadata.Filesystems != nil {
+		t.Errorf("Unexpected metadata %+v", *metadata)
+	}
+
+	metadata, err = parseFlatpakMetadata(map[string]string{"name": "foo"})
+	if metadata != nil || err != nil {
+		t.Errorf("Expected no metadata, got %+v, %v", metadata, err)
+	}
+
+	for _, labels := range []map[string]string{
+		{labelFlatpakRef: "org.gnome.Maps"},
+		{labelFlatpakMetadata: "name=org.gnome.Maps\n"},
+		{labelFlatpakMetadata: "[Context]\nshared=network;\n"},
+	} {
+		_, err := parseFlatpakMetadata(labels)
+		if err == nil {
+			t.Errorf("Expected an error for %v", labels)
+		}
+	}
+}
+
+func TestFetchFlatpak(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	dgst := tr.addImage(schema2.MediaTypeManifest, map[string]interface{}{
+		"os":           "linux",
+		"architecture": "amd64",
+		"config": map[string]interface{}{
+			"Labels": map[string]string{
+				labelFlatpakRef:      "app/org.gnome.Maps/x86_64/stable",
+				labelFlatpakMetadata: mapsMetadata,
+			},
+		},
+	}, nil)
+
+	op := newTestOperation(t, tr, "maps")
+	var image flagstate.Image
+	err := op.fetcher.fetchImage(op, dgst, &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Flatpak == nil || image.Flatpak.Id != "org.gnome.Maps" ||
+		image.Flatpak.Runtime != "org.gnome.Platform/x86_64/46" {
+		t.Errorf("Unexpected Flatpak metadata %+v", image.Flatpak)
+	}
+}
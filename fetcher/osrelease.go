@@ -0,0 +1,311 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"io"
+	"path"
+	"strings"
+)
+
+// Paths of the os-release file, without the leading '/'. If the first
+// doesn't exist, the second is used, as described in os-release(5).
+const (
+	osReleasePath         = "etc/os-release"
+	osReleaseFallbackPath = "usr/lib/os-release"
+)
+
+// Used when the configuration doesn't set a maximum layer size
+const defaultMaxLayerSize = 256 * 1024 * 1024
+
+// An os-release file bigger than this is treated as empty
+const maxOSReleaseSize = 64 * 1024
+
+// The keys from os-release that are stored for an image
+var osReleaseKeys = []string{"ID", "VERSION_ID", "PRETTY_NAME"}
+
+// layerFile is what the topmost layer touching a path put there
+type layerFile struct {
+	// false if the path was deleted by a whiteout
+	exists     bool
+	linkTarget string
+	content    []byte
+}
+
+// osReleaseScan tracks the os-release paths while layers are read from
+// the top of the image down. Once a path is in files, lower layers can't
+// change it.
+type osReleaseScan struct {
+	files map[string]*layerFile
+}
+
+func newOSReleaseScan() *osReleaseScan {
+	return &osReleaseScan{
+		files: make(map[string]*layerFile),
+	}
+}
+
+// cleanLayerPath converts a path in a layer tarball, which might start
+// with "./" or "/", to a path relative to the root
+func cleanLayerPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// resolveLink returns the path that a symbolic link at linkPath points to
+func resolveLink(linkPath string, target string) string {
+	if !path.IsAbs(target) {
+		target = "/" + path.Dir(linkPath) + "/" + target
+	}
+	return cleanLayerPath(target)
+}
+
+// hides is true if a whiteout or opaque directory for dir hides p
+func hides(dir string, p string) bool {
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// addLayer reads a layer tarball, recording what it does to the os-release
+// paths that upper layers left alone
+func (s *osReleaseScan) addLayer(r io.Reader) error {
+	paths := []string{osReleasePath, osReleaseFallbackPath}
+	found := make(map[string]*layerFile)
+	var hidden []string
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cleanLayerPath(header.Name)
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		if base == ".wh..wh..opq" {
+			// The contents of dir in lower layers are hidden
+			hidden = append(hidden, dir)
+			continue
+		} else if strings.HasPrefix(base, ".wh.") {
+			hidden = append(hidden, path.Join(dir, base[len(".wh."):]))
+			continue
+		}
+
+		for _, p := range paths {
+			if p != name {
+				continue
+			}
+			file := layerFile{exists: true}
+			switch header.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				if header.Size <= maxOSReleaseSize {
+					file.content = make([]byte, header.Size)
+					_, err = io.ReadFull(tr, file.content)
+					if err != nil {
+						return err
+					}
+				}
+			case tar.TypeSymlink:
+				file.linkTarget = header.Linkname
+			}
+			found[p] = &file
+		}
+	}
+
+	for _, p := range paths {
+		if _, ok := s.files[p]; ok {
+			continue
+		}
+		if file, ok := found[p]; ok {
+			s.files[p] = file
+			continue
+		}
+		for _, dir := range hidden {
+			if hides(dir, p) {
+				s.files[p] = &layerFile{exists: false}
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// result returns the contents of the os-release file, and whether the
+// layers read so far determine it. If complete is set, all the layers have
+// been read, so a path that wasn't found doesn't exist.
+func (s *osReleaseScan) result(complete bool) ([]byte, bool) {
+	p := osReleasePath
+	// /etc/os-release is normally a symlink to /usr/lib/os-release, so
+	// one symlink is followed
+	for i := 0; i < 2; i++ {
+		file, ok := s.files[p]
+		if !ok {
+			if !complete {
+				return nil, false
+			}
+			file = &layerFile{exists: false}
+		}
+
+		if file.linkTarget != "" {
+			p = resolveLink(p, file.linkTarget)
+			if p != osReleaseFallbackPath {
+				return nil, true
+			}
+		} else if file.exists {
+			return file.content, true
+		} else if p == osReleasePath {
+			p = osReleaseFallbackPath
+		} else {
+			return nil, true
+		}
+	}
+
+	return nil, true
+}
+
+// unescapeShell removes the backslashes from a string that was inside
+// double quotes in a shell script
+func unescapeShell(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// parseOSRelease returns the osReleaseKeys found in the contents of an
+// os-release file, or nil if there are none. Values are shell-style
+// assignments, possibly quoted.
+func parseOSRelease(content []byte) map[string]string {
+	var result map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		key, value := line[:eq], line[eq+1:]
+
+		wanted := false
+		for _, k := range osReleaseKeys {
+			if k == key {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			continue
+		}
+
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = unescapeShell(value[1 : len(value)-1])
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+
+		if result == nil {
+			result = make(map[string]string)
+		}
+		result[key] = value
+	}
+
+	return result
+}
+
+// openLayer returns a reader for the uncompressed tarball of a layer. Only
+// gzip compression is supported.
+func openLayer(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, fmt.Errorf("Zstandard compression is not supported")
+	}
+
+	return br, nil
+}
+
+// readErrorReader remembers errors reading from the registry, to tell them
+// apart from errors in the content of a layer
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *readErrorReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+func (f *Fetcher) scanLayer(op *fetchOperation, dgst digest.Digest, scan *osReleaseScan) error {
+	blob, err := op.blobs.Open(op.ctx, dgst)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	rr := &readErrorReader{r: blob}
+	r, err := openLayer(rr)
+	if err == nil {
+		err = scan.addLayer(r)
+	}
+	if err != nil && rr.err == nil {
+		// Reading the layer again won't help
+		return badManifest("%v", err)
+	}
+
+	return err
+}
+
+// inspectOSRelease reads the layers of image from the top down, until the
+// contents of /etc/os-release are known, and sets image.OSRelease
+func (f *Fetcher) inspectOSRelease(op *fetchOperation, image *flagstate.Image) error {
+	scan := newOSReleaseScan()
+	for i := len(image.Layers) - 1; i >= 0; i-- {
+		layer := image.Layers[i]
+		if layer.Size > f.maxLayerSize {
+			return badManifest("Layer %s is bigger than %d bytes", layer.Digest, f.maxLayerSize)
+		}
+
+		err := f.scanLayer(op, layer.Digest, scan)
+		if err != nil && isTransient(err) {
+			return fmt.Errorf("Can't read layer %s: %v", layer.Digest, err)
+		} else if err != nil {
+			return badManifest("Can't read layer %s: %v", layer.Digest, err)
+		}
+
+		if content, done := scan.result(false); done {
+			image.OSRelease = parseOSRelease(content)
+			return nil
+		}
+	}
+
+	content, _ := scan.result(true)
+	image.OSRelease = parseOSRelease(content)
+
+	return nil
+}
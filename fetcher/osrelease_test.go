@@ -0,0 +1,208 @@
+package fetcher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/docker/distribution/digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+	"testing"
+)
+
+const fedoraOSRelease = `NAME="Fedora Linux"
+VERSION="40 (Container Image)"
+ID=fedora
+VERSION_ID=40
+# A comment
+PRETTY_NAME="Fedora Linux 40 (Container Image)"
+`
+
+// testLayer is a gzipped tarball. Entries are given as name, contents
+// pairs; contents starting with "->" make a symbolic link.
+func testLayer(t *testing.T, entries ...string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for i := 0; i+1 < len(entries); i += 2 {
+		name, contents := entries[i], entries[i+1]
+		header := tar.Header{Name: name, Mode: 0644}
+		if len(contents) > 2 && contents[:2] == "->" {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = contents[2:]
+			contents = ""
+		} else {
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(contents))
+		}
+		err := tw.WriteHeader(&header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestParseOSRelease(t *testing.T) {
+	parsed := parseOSRelease([]byte(fedoraOSRelease +
+		`VARIANT_ID=container
+BAD LINE
+`))
+	expected := map[string]string{
+		"ID":          "fedora",
+		"VERSION_ID":  "40",
+		"PRETTY_NAME": "Fedora Linux 40 (Container Image)",
+	}
+	if len(parsed) != len(expected) {
+		t.Fatalf("Unexpected result %v", parsed)
+	}
+	for k, v := range expected {
+		if parsed[k] != v {
+			t.Errorf("Expected %s=%q, got %q", k, v, parsed[k])
+		}
+	}
+
+	parsed = parseOSRelease([]byte(`PRETTY_NAME="Say \"hi\""` + "\nID='single'\n"))
+	if parsed["PRETTY_NAME"] != `Say "hi"` || parsed["ID"] != "single" {
+		t.Errorf("Unexpected result %v", parsed)
+	}
+
+	if parsed := parseOSRelease([]byte("NAME=Nothing\n")); parsed != nil {
+		t.Errorf("Expected nil, got %v", parsed)
+	}
+}
+
+func expectScanResult(t *testing.T, layers []string, expected string) {
+	scan := newOSReleaseScan()
+	for i := len(layers) - 1; i >= 0; i-- {
+		r, err := openLayer(bytes.NewReader([]byte(layers[i])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = scan.addLayer(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, _ := scan.result(true)
+	if string(content) != expected {
+		t.Errorf("Expected %q, got %q", expected, content)
+	}
+}
+
+func TestOSReleaseScan(t *testing.T) {
+	base := testLayer(t,
+		"etc/os-release", "->../usr/lib/os-release",
+		"usr/lib/os-release", "base")
+
+	expectScanResult(t, []string{base}, "base")
+	expectScanResult(t, []string{base, testLayer(t, "./usr/lib/os-release", "updated")}, "updated")
+	// A regular file replacing the symlink
+	expectScanResult(t, []string{base, testLayer(t, "/etc/os-release", "replaced")}, "replaced")
+	// Without /etc/os-release, /usr/lib/os-release is used
+	expectScanResult(t, []string{testLayer(t, "usr/lib/os-release", "fallback")}, "fallback")
+	expectScanResult(t, []string{base, testLayer(t, "etc/.wh.os-release", "")}, "base")
+	expectScanResult(t, []string{base, testLayer(t, "usr/lib/.wh.os-release", "")}, "")
+	expectScanResult(t, []string{base, testLayer(t, "usr/.wh..wh..opq", "")}, "")
+	expectScanResult(t, []string{base, testLayer(t, ".wh.usr", "")}, "")
+	// An opaque directory only hides the contents of lower layers
+	expectScanResult(t, []string{base, testLayer(t,
+		"usr/lib/.wh..wh..opq", "",
+		"usr/lib/os-release", "opaque")}, "opaque")
+	expectScanResult(t, []string{testLayer(t, "etc/hostname", "foo")}, "")
+
+	// Uncompressed layers work too
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("plain"))
+	tw.Close()
+	expectScanResult(t, []string{buf.String()}, "plain")
+}
+
+func TestInspectOSRelease(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	base := testLayer(t,
+		"etc/os-release", "->../usr/lib/os-release",
+		"usr/lib/os-release", fedoraOSRelease)
+	app := testLayer(t, "usr/bin/app", "#!/bin/sh\n")
+	top := testLayer(t, "etc/os-release", "ID=custom\n")
+
+	fedora := tr.addImageWithLayers(v1.MediaTypeImageManifest, testConfig("linux", "amd64"), nil,
+		[]string{base, app})
+	custom := tr.addImageWithLayers(v1.MediaTypeImageManifest, testConfig("linux", "amd64"), nil,
+		[]string{base, app, top})
+
+	op := newTestOperation(t, tr, "foo")
+	var image flagstate.Image
+	err := op.fetcher.fetchImage(op, fedora, &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.OSRelease != nil {
+		t.Errorf("Layers inspected without being enabled")
+	}
+
+	op.fetcher.inspectLayers = true
+	op.fetcher.maxLayerSize = defaultMaxLayerSize
+
+	expectOSRelease := func(dgst digest.Digest, expected map[string]string, expectedGets int) {
+		tr.gets = 0
+		var image flagstate.Image
+		err := op.fetcher.fetchImage(op, dgst, &image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(image.OSRelease) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, image.OSRelease)
+		}
+		for k, v := range expected {
+			if image.OSRelease[k] != v {
+				t.Errorf("Expected %v, got %v", expected, image.OSRelease)
+			}
+		}
+		// The manifest and config, then the layers
+		if tr.gets != 2+expectedGets {
+			t.Errorf("Expected %d layer fetches, got %d", expectedGets, tr.gets-2)
+		}
+	}
+
+	expectOSRelease(fedora, map[string]string{
+		"ID":          "fedora",
+		"VERSION_ID":  "40",
+		"PRETTY_NAME": "Fedora Linux 40 (Container Image)",
+	}, 2)
+	// Lower layers aren't needed once /etc/os-release is found
+	expectOSRelease(custom, map[string]string{"ID": "custom"}, 1)
+
+	// A layer that isn't a tarball is skipped like one that's too big
+	broken := tr.addImageWithLayers(v1.MediaTypeImageManifest, testConfig("linux", "amd64"), nil,
+		[]string{base, "not a tarball"})
+	expectOSRelease(broken, nil, 1)
+
+	op.fetcher.maxLayerSize = 1
+	expectOSRelease(fedora, nil, 0)
+
+	// But if the registry fails, the image isn't stored without the
+	// information, so that it's fetched again later
+	op.fetcher.maxLayerSize = defaultMaxLayerSize
+	tr.unavailable[digest.FromBytes([]byte(app)).String()] = true
+	err = op.fetcher.fetchImage(op, fedora, &image)
+	if err == nil || !isTransient(err) {
+		t.Errorf("Expected a transient error, got %v", err)
+	}
+}
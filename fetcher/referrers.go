@@ -0,0 +1,355 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	artifactTypeCosignSignature = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	artifactTypeCosignSBOM      = "application/vnd.dev.cosign.artifact.sbom.v1+json"
+	artifactTypeNotarySignature = "application/vnd.cncf.notary.signature"
+	artifactTypeInToto          = "application/vnd.in-toto+json"
+	artifactTypeDSSE            = "application/vnd.dsse.envelope.v1+json"
+	artifactTypeSigstoreBundle  = "application/vnd.dev.sigstore.bundle"
+)
+
+// referrerType classifies a referrer by its artifact type
+func referrerType(artifactType string) string {
+	switch {
+	case artifactType == artifactTypeCosignSignature,
+		artifactType == artifactTypeNotarySignature:
+		return flagstate.ReferrerSignature
+	case artifactType == artifactTypeCosignSBOM,
+		strings.Contains(artifactType, "spdx"),
+		strings.Contains(artifactType, "cyclonedx"):
+		return flagstate.ReferrerSBOM
+	case artifactType == artifactTypeInToto,
+		artifactType == artifactTypeDSSE,
+		strings.HasPrefix(artifactType, artifactTypeSigstoreBundle):
+		return flagstate.ReferrerAttestation
+	default:
+		return flagstate.ReferrerOther
+	}
+}
+
+// Registries without the referrers API get tags instead: sha256-<hex> for an
+// image index listing the referrers, as described in the OCI distribution
+// spec, and sha256-<hex>.sig, .att and .sbom, as pushed by cosign.
+var fallbackTagRegexp = regexp.MustCompile(`^sha256-([0-9a-f]{64})(?:\.(sig|att|sbom))?$`)
+
+// parseFallbackTag returns the subject of a referrers fallback tag, and the
+// suffix of the tag without the '.'
+func parseFallbackTag(tag string) (subject digest.Digest, suffix string, ok bool) {
+	match := fallbackTagRegexp.FindStringSubmatch(tag)
+	if match == nil {
+		return "", "", false
+	}
+
+	return digest.Digest("sha256:" + match[1]), match[2], true
+}
+
+func fallbackTagType(suffix string) string {
+	switch suffix {
+	case "sig":
+		return flagstate.ReferrerSignature
+	case "att":
+		return flagstate.ReferrerAttestation
+	case "sbom":
+		return flagstate.ReferrerSBOM
+	default:
+		return flagstate.ReferrerOther
+	}
+}
+
+// referrersIndex is the image index returned by the referrers API or
+// tagged with a fallback tag. manifestlist.ManifestList doesn't have the
+// artifactType field of the descriptors, so we parse it ourselves.
+type referrersIndex struct {
+	Manifests []struct {
+		MediaType    string        `json:"mediaType"`
+		Digest       digest.Digest `json:"digest"`
+		ArtifactType string        `json:"artifactType"`
+	} `json:"manifests"`
+}
+
+func (f *Fetcher) referrersFromIndex(resp *http.Response, subject digest.Digest, tag string) ([]*flagstate.Referrer, error) {
+	var index referrersIndex
+	err := json.NewDecoder(resp.Body).Decode(&index)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*flagstate.Referrer, 0, len(index.Manifests))
+	for _, m := range index.Manifests {
+		result = append(result, &flagstate.Referrer{
+			Subject:      subject,
+			Digest:       m.Digest,
+			MediaType:    m.MediaType,
+			ArtifactType: m.ArtifactType,
+			Type:         referrerType(m.ArtifactType),
+			Tag:          tag,
+		})
+	}
+
+	return result, nil
+}
+
+// getReferrersFromAPI uses the referrers API. If the registry doesn't
+// support the API, supported is false.
+func (f *Fetcher) getReferrersFromAPI(op *fetchOperation, subject digest.Digest) (referrers []*flagstate.Referrer, supported bool, err error) {
+	resp, err := op.request("GET", "referrers/"+subject.String(), v1.MediaTypeImageIndex)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		referrers, err = f.referrersFromIndex(resp, subject, "")
+		return referrers, true, err
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("Error getting referrers: %s", resp.Status)
+	}
+}
+
+var fallbackTagAccept = strings.Join([]string{
+	v1.MediaTypeImageManifest,
+	v1.MediaTypeImageIndex,
+	schema2.MediaTypeManifest,
+}, ", ")
+
+// getFallbackTag returns the referrers found through a single fallback tag
+func (f *Fetcher) getFallbackTag(op *fetchOperation, subject digest.Digest, tag string, suffix string) ([]*flagstate.Referrer, error) {
+	// A fallback tag without a suffix is an index of the referrers
+	method := "HEAD"
+	if suffix == "" {
+		method = "GET"
+	}
+	resp, err := op.request(method, "manifests/"+tag, fallbackTagAccept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error getting %s: %s", tag, resp.Status)
+	}
+
+	if suffix == "" {
+		return f.referrersFromIndex(resp, subject, tag)
+	}
+
+	return []*flagstate.Referrer{{
+		Subject:   subject,
+		Digest:    digest.Digest(resp.Header.Get("Docker-Content-Digest")),
+		MediaType: resp.Header.Get("Content-Type"),
+		Type:      fallbackTagType(suffix),
+		Tag:       tag,
+	}}, nil
+}
+
+// getReferrersFromTags looks for the fallback tags with the given suffixes
+// for subject; the empty suffix is the tag for an index of referrers
+func (f *Fetcher) getReferrersFromTags(op *fetchOperation, subject digest.Digest, suffixes []string) ([]*flagstate.Referrer, error) {
+	result := make([]*flagstate.Referrer, 0)
+	for _, suffix := range suffixes {
+		tag := strings.Replace(subject.String(), ":", "-", 1)
+		if suffix != "" {
+			tag += "." + suffix
+		}
+		// If we know all the tags, don't bother asking for missing ones
+		if op.allTags != nil && !op.allTags[tag] {
+			continue
+		}
+
+		referrers, err := f.getFallbackTag(op, subject, tag, suffix)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, referrers...)
+	}
+
+	return result, nil
+}
+
+// getReferrers finds the referrers to subject, sorted by digest
+func (f *Fetcher) getReferrers(op *fetchOperation, subject digest.Digest) ([]*flagstate.Referrer, error) {
+	var referrers []*flagstate.Referrer
+	supported := false
+	if !op.referrersUnsupported {
+		var err error
+		referrers, supported, err = f.getReferrersFromAPI(op, subject)
+		if err != nil {
+			return nil, err
+		}
+		op.referrersUnsupported = !supported
+	}
+	if !supported {
+		var err error
+		referrers, err = f.getReferrersFromTags(op, subject, []string{"", "sig", "att", "sbom"})
+		if err != nil {
+			return nil, err
+		}
+	} else if op.allTags != nil {
+		// cosign pushes signatures and attestations without a subject
+		// under suffixed tags by default, even if the registry supports
+		// the referrers API
+		tagged, err := f.getReferrersFromTags(op, subject, []string{"sig", "att", "sbom"})
+		if err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, tagged...)
+	}
+
+	seen := make(map[digest.Digest]bool)
+	result := make([]*flagstate.Referrer, 0, len(referrers))
+	for _, referrer := range referrers {
+		if referrer.Digest == "" || seen[referrer.Digest] {
+			continue
+		}
+		seen[referrer.Digest] = true
+		result = append(result, referrer)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Digest < result[j].Digest
+	})
+
+	return result, nil
+}
+
+func referrersEqual(a []*flagstate.Referrer, b []*flagstate.Referrer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateReferrers refreshes the stored referrers for each of subjects, the
+// packages from their SBOMs, and the results of verifying their signatures.
+// Errors talking to the registry are logged rather than failing the fetch,
+// since the subjects themselves were fetched successfully.
+func (f *Fetcher) updateReferrers(op *fetchOperation, tx database.Tx, subjects map[digest.Digest]bool) (changed bool, err error) {
+	repository := op.repo.Named().Name()
+
+	sorted := make([]digest.Digest, 0, len(subjects))
+	for subject := range subjects {
+		sorted = append(sorted, subject)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	for _, subject := range sorted {
+		referrers, e := f.getReferrers(op, subject)
+		if e != nil {
+			log.Printf("Error getting referrers for %s@%s: %v", repository, subject, e)
+			continue
+		}
+
+		oldReferrers, err := tx.GetReferrers(repository, subject)
+		if err != nil {
+			return false, err
+		}
+		referrersChanged := !referrersEqual(oldReferrers, referrers)
+
+		oldVerifications, err := tx.GetSignatureVerifications(repository, subject)
+		if err != nil {
+			return false, err
+		}
+
+		// Checking signatures means fetching them again, so it's only
+		// done when they or the keys might have changed
+		if referrersChanged || !verifiedWithKeys(oldVerifications, f.keys) {
+			verifications, e := f.verifySignatures(op, subject, referrers)
+			if e != nil {
+				// The new referrers aren't stored, so the next
+				// fetch tries again
+				log.Printf("Error verifying signatures for %s@%s: %v", repository, subject, e)
+				continue
+			}
+
+			if !verificationsEqual(oldVerifications, verifications) {
+				err = tx.SetSignatureVerifications(repository, subject, verifications)
+				if err != nil {
+					return false, err
+				}
+				changed = true
+			}
+		}
+
+		if referrersChanged {
+			// The new referrers are only stored once their SBOMs have
+			// been read, so that the next fetch tries again on failure
+			updated, err := f.updatePackages(op, tx, subject, referrers)
+			if err != nil {
+				return false, err
+			}
+			if updated {
+				err = tx.SetReferrers(repository, subject, referrers)
+				if err != nil {
+					return false, err
+				}
+				changed = true
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// addReferrerSubject records the subject of a manifest pushed by digest, so
+// that the referrers to it are refreshed.
+func (f *Fetcher) addReferrerSubject(op *fetchOperation, dgst digest.Digest) {
+	mfst, err := op.manifests.Get(op.ctx, dgst)
+	if err != nil {
+		log.Printf("Error fetching %s@%s: %v", op.repo.Named().Name(), dgst, err)
+		return
+	}
+
+	subject, err := manifestSubject(mfst)
+	if err != nil {
+		log.Printf("Error parsing %s@%s: %v", op.repo.Named().Name(), dgst, err)
+		return
+	}
+	if subject != nil {
+		op.referrerSubjects[subject.Digest] = true
+	}
+}
+
+// manifestSubject returns the subject of an OCI image manifest or index,
+// or nil if it doesn't have one.
+func manifestSubject(mfst distribution.Manifest) (*distribution.Descriptor, error) {
+	_, payload, err := mfst.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	var extras manifestExtras
+	err = json.Unmarshal(payload, &extras)
+	if err != nil {
+		return nil, err
+	}
+
+	return extras.Subject, nil
+}
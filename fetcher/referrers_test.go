@@ -0,0 +1,225 @@
+package fetcher
+
+import (
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/util"
+	"strings"
+	"testing"
+)
+
+func TestParseFallbackTag(t *testing.T) {
+	hex := strings.Repeat("0123456789abcdef", 4)
+	for tag, expected := range map[string]string{
+		"sha256-" + hex:           "",
+		"sha256-" + hex + ".sig":  "sig",
+		"sha256-" + hex + ".att":  "att",
+		"sha256-" + hex + ".sbom": "sbom",
+	} {
+		subject, suffix, ok := parseFallbackTag(tag)
+		if !ok || subject != digest.Digest("sha256:"+hex) || suffix != expected {
+			t.Errorf("Unexpected result for %s: %s %s %v", tag, subject, suffix, ok)
+		}
+	}
+
+	for _, tag := range []string{"latest", "sha256-1234.sig", "sha256-" + hex + ".foo"} {
+		if _, _, ok := parseFallbackTag(tag); ok {
+			t.Errorf("%s shouldn't be a fallback tag", tag)
+		}
+	}
+}
+
+func TestReferrerType(t *testing.T) {
+	for artifactType, expected := range map[string]string{
+		artifactTypeCosignSignature:                     flagstate.ReferrerSignature,
+		artifactTypeNotarySignature:                     flagstate.ReferrerSignature,
+		"application/spdx+json":                         flagstate.ReferrerSBOM,
+		"application/vnd.cyclonedx+json":                flagstate.ReferrerSBOM,
+		artifactTypeInToto:                              flagstate.ReferrerAttestation,
+		"application/vnd.dev.sigstore.bundle.v0.3+json": flagstate.ReferrerAttestation,
+		"application/vnd.example+json":                  flagstate.ReferrerOther,
+	} {
+		if result := referrerType(artifactType); result != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, artifactType, result)
+		}
+	}
+}
+
+// addReferrer adds a manifest with the given artifact type that refers to
+// subject, and returns its digest
+func (tr *testRegistry) addReferrer(artifactType string, subject digest.Digest) digest.Digest {
+	config := []byte("{}")
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"artifactType":  artifactType,
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.empty.v1+json",
+			"digest":    tr.addBlob(config),
+			"size":      len(config),
+		},
+		"layers": []interface{}{},
+	}
+	if subject != "" {
+		manifest["subject"] = tr.descriptor(subject)
+	}
+
+	return tr.addManifest(v1.MediaTypeImageManifest, manifest)
+}
+
+func expectReferrers(t *testing.T, tx *testTx, repository string, subject digest.Digest, expected map[digest.Digest]string) {
+	referrers := tx.referrers[repository][subject]
+	if len(referrers) != len(expected) {
+		t.Fatalf("Expected %d referrers, got %+v", len(expected), referrers)
+	}
+	for _, referrer := range referrers {
+		if referrer.Subject != subject || referrer.Type != expected[referrer.Digest] {
+			t.Errorf("Unexpected referrer %+v", referrer)
+		}
+	}
+}
+
+func TestReferrersAPI(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+	tr.referrersAPI = true
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	signature := tr.addReferrer(artifactTypeCosignSignature, image)
+	sbom := tr.addReferrer("application/spdx+json", image)
+
+	tx := newTestTx()
+	op := newTestOperation(t, tr, "foo")
+	err := op.fetcher.updateRepositoryInDatabase(op, tx,
+		map[string]digest.Digest{"latest": image}, map[string]digest.Digest{}, map[string]*flagstate.FailedTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectReferrers(t, tx, "foo", image, map[digest.Digest]string{
+		signature: flagstate.ReferrerSignature,
+		sbom:      flagstate.ReferrerSBOM,
+	})
+	if op.referrersUnsupported {
+		t.Errorf("Referrers API should be supported")
+	}
+}
+
+func TestReferrerFallbackTags(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	signature := tr.addReferrer(artifactTypeCosignSignature, "")
+	sbom := tr.addReferrer("application/spdx+json", "")
+	index := tr.addManifest(v1.MediaTypeImageIndex, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageIndex,
+		"manifests": []interface{}{
+			map[string]interface{}{
+				"mediaType":    v1.MediaTypeImageManifest,
+				"digest":       sbom,
+				"size":         100,
+				"artifactType": "application/spdx+json",
+			},
+		},
+	})
+
+	fallbackTag := strings.Replace(image.String(), ":", "-", 1)
+	tr.tag("foo", "latest", image)
+	tr.tag("foo", fallbackTag+".sig", signature)
+	tr.tag("foo", fallbackTag, index)
+
+	op := newTestOperation(t, tr, "foo")
+	imageTags, listTags, failedTags, err := op.fetcher.getTagsFromRegistry(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imageTags) != 1 || len(listTags) != 0 || len(failedTags) != 0 {
+		t.Errorf("Fallback tags should be skipped, got %v %v %v", imageTags, listTags, failedTags)
+	}
+
+	tx := newTestTx()
+	err = op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, listTags, failedTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectReferrers(t, tx, "foo", image, map[digest.Digest]string{
+		signature: flagstate.ReferrerSignature,
+		sbom:      flagstate.ReferrerSBOM,
+	})
+	for _, referrer := range tx.referrers["foo"][image] {
+		if !strings.HasPrefix(referrer.Tag, fallbackTag) {
+			t.Errorf("Expected referrer to be found through a fallback tag, got %+v", referrer)
+		}
+	}
+}
+
+func TestReferrersAPIWithFallbackTags(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+	tr.referrersAPI = true
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	sbom := tr.addReferrer("application/spdx+json", image)
+	// Pushed by cosign in its default mode, without a subject
+	signature := tr.addReferrer(artifactTypeCosignSignature, "")
+
+	tr.tag("foo", "latest", image)
+	tr.tag("foo", strings.Replace(image.String(), ":", "-", 1)+".sig", signature)
+
+	op := newTestOperation(t, tr, "foo")
+	imageTags, listTags, failedTags, err := op.fetcher.getTagsFromRegistry(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := newTestTx()
+	err = op.fetcher.updateRepositoryInDatabase(op, tx, imageTags, listTags, failedTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectReferrers(t, tx, "foo", image, map[digest.Digest]string{
+		signature: flagstate.ReferrerSignature,
+		sbom:      flagstate.ReferrerSBOM,
+	})
+}
+
+func TestApplyFallbackTagUpdate(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+	tr.referrersAPI = true
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	signature := tr.addReferrer(artifactTypeCosignSignature, image)
+
+	op := newTestOperation(t, tr, "foo")
+	imageTags := map[string]digest.Digest{"latest": image}
+	listTags := map[string]digest.Digest{}
+	failedTags := map[string]*flagstate.FailedTag{}
+
+	// Pushing a signature by digest should cause the referrers of its
+	// subject to be checked
+	op.fetcher.applyTagUpdate(op, util.TagUpdate{
+		Digest:    signature,
+		MediaType: v1.MediaTypeImageManifest,
+	}, imageTags, listTags, failedTags)
+	if !op.referrerSubjects[image] {
+		t.Errorf("Expected %s to be checked for referrers", image)
+	}
+
+	// And so should pushing a fallback tag, which isn't recorded as a tag
+	other := digest.Digest("sha256:" + strings.Repeat("0", 64))
+	op.fetcher.applyTagUpdate(op, util.TagUpdate{
+		Tag:       "sha256-" + strings.Repeat("0", 64) + ".sig",
+		Digest:    signature,
+		MediaType: v1.MediaTypeImageManifest,
+	}, imageTags, listTags, failedTags)
+	if !op.referrerSubjects[other] || len(imageTags) != 1 {
+		t.Errorf("Unexpected result %v %v", op.referrerSubjects, imageTags)
+	}
+}
@@ -0,0 +1,284 @@
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate/util"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// testRegistry is a minimal in-memory implementation of the read-only parts
+// of the registry API, used to test the fetcher end-to-end.
+type testRegistry struct {
+	server *httptest.Server
+
+	mutex     sync.Mutex
+	manifests map[digest.Digest]testManifest
+	tags      map[string]map[string]digest.Digest
+	blobs     map[digest.Digest][]byte
+	gets      int
+	// Whether to implement the referrers API
+	referrersAPI bool
+	// Tags and digests whose manifests or blobs fail with 503 Service
+	// Unavailable
+	unavailable map[string]bool
+}
+
+var registryPathRegexp = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs|tags|referrers)/(.+)$`)
+
+func newTestRegistry() *testRegistry {
+	tr := &testRegistry{
+		manifests:   make(map[digest.Digest]testManifest),
+		tags:        make(map[string]map[string]digest.Digest),
+		blobs:       make(map[digest.Digest][]byte),
+		unavailable: make(map[string]bool),
+	}
+	tr.server = httptest.NewServer(http.HandlerFunc(tr.serve))
+
+	return tr
+}
+
+func (tr *testRegistry) Close() {
+	tr.server.Close()
+}
+
+func (tr *testRegistry) addBlob(content []byte) digest.Digest {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	dgst := digest.FromBytes(content)
+	tr.blobs[dgst] = content
+
+	return dgst
+}
+
+func (tr *testRegistry) addManifest(mediaType string, manifest interface{}) digest.Digest {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		panic(err)
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	dgst := digest.FromBytes(content)
+	tr.manifests[dgst] = testManifest{
+		mediaType: mediaType,
+		content:   content,
+	}
+
+	return dgst
+}
+
+func (tr *testRegistry) tag(repository string, tag string, dgst digest.Digest) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if tr.tags[repository] == nil {
+		tr.tags[repository] = make(map[string]digest.Digest)
+	}
+	tr.tags[repository][tag] = dgst
+}
+
+func (tr *testRegistry) descriptor(dgst digest.Digest) map[string]interface{} {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	m := tr.manifests[dgst]
+	return map[string]interface{}{
+		"mediaType": m.mediaType,
+		"digest":    dgst,
+		"size":      len(m.content),
+	}
+}
+
+// addImage adds a config blob and a manifest referencing it, and returns
+// the digest of the manifest.
+func (tr *testRegistry) addImage(mediaType string, config map[string]interface{}, annotations map[string]string) digest.Digest {
+	return tr.addImageWithLayers(mediaType, config, annotations, nil)
+}
+
+// addImageWithLayers is like addImage, but also adds a layer blob for each
+// of layers and references them from the manifest.
+func (tr *testRegistry) addImageWithLayers(mediaType string, config map[string]interface{}, annotations map[string]string, layers []string) digest.Digest {
+	configBytes, _ := json.Marshal(config)
+	configDigest := tr.addBlob(configBytes)
+
+	configMediaType := schema2.MediaTypeConfig
+	layerMediaType := schema2.MediaTypeLayer
+	if mediaType == v1.MediaTypeImageManifest {
+		configMediaType = v1.MediaTypeImageConfig
+		layerMediaType = v1.MediaTypeImageLayerGzip
+	}
+
+	layerDescriptors := make([]interface{}, 0)
+	for _, layer := range layers {
+		layerDescriptors = append(layerDescriptors, map[string]interface{}{
+			"mediaType": layerMediaType,
+			"digest":    tr.addBlob([]byte(layer)),
+			"size":      len(layer),
+		})
+	}
+
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaType,
+		"config": map[string]interface{}{
+			"mediaType": configMediaType,
+			"digest":    configDigest,
+			"size":      len(configBytes),
+		},
+		"layers": layerDescriptors,
+	}
+	if annotations != nil {
+		manifest["annotations"] = annotations
+	}
+
+	return tr.addManifest(mediaType, manifest)
+}
+
+func (tr *testRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.URL.Path == "/v2/_catalog" {
+		repositories := make([]string, 0)
+		for repository := range tr.tags {
+			repositories = append(repositories, repository)
+		}
+		sort.Strings(repositories)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"repositories": repositories,
+		})
+		return
+	}
+
+	match := registryPathRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repository, which, ref := match[1], match[2], match[3]
+
+	switch which {
+	case "tags":
+		tags := make([]string, 0)
+		for tag := range tr.tags[repository] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name": repository,
+			"tags": tags,
+		})
+	case "manifests":
+		if tr.unavailable[ref] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		dgst := digest.Digest(ref)
+		if !strings.Contains(ref, ":") {
+			dgst = tr.tags[repository][ref]
+		}
+		m, ok := tr.manifests[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			tr.gets++
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write(m.content)
+		}
+	case "referrers":
+		if !tr.referrersAPI {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		referrers := make([]interface{}, 0)
+		for dgst, m := range tr.manifests {
+			var parsed struct {
+				ArtifactType string `json:"artifactType"`
+				Subject      *struct {
+					Digest digest.Digest `json:"digest"`
+				} `json:"subject"`
+			}
+			json.Unmarshal(m.content, &parsed)
+			if parsed.Subject != nil && parsed.Subject.Digest == digest.Digest(ref) {
+				referrers = append(referrers, map[string]interface{}{
+					"mediaType":    m.mediaType,
+					"digest":       dgst,
+					"size":         len(m.content),
+					"artifactType": parsed.ArtifactType,
+				})
+			}
+		}
+		w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     v1.MediaTypeImageIndex,
+			"manifests":     referrers,
+		})
+	case "blobs":
+		if tr.unavailable[ref] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		content, ok := tr.blobs[digest.Digest(ref)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			tr.gets++
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+	}
+}
+
+func newTestOperation(t *testing.T, tr *testRegistry, repository string) *fetchOperation {
+	f := &Fetcher{
+		changes:       util.NewChangeBroadcaster(),
+		registryUrl:   tr.server.URL,
+		authenticator: newAuthenticator(tr.server.URL, http.DefaultTransport, &credentialStore{}),
+	}
+
+	op, err := f.newFetchOperation(context.Background(), repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return op
+}
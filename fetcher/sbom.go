@@ -0,0 +1,210 @@
+package fetcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"sort"
+	"strings"
+)
+
+// SBOMs bigger than this are skipped rather than downloaded
+const maxSBOMSize = 64 * 1024 * 1024
+
+// spdxDocument is the part of an SPDX JSON document that we use
+type spdxDocument struct {
+	SPDXVersion string `json:"spdxVersion"`
+	Packages    []struct {
+		Name         string `json:"name"`
+		VersionInfo  string `json:"versionInfo"`
+		ExternalRefs []struct {
+			ReferenceType    string `json:"referenceType"`
+			ReferenceLocator string `json:"referenceLocator"`
+		} `json:"externalRefs"`
+	} `json:"packages"`
+}
+
+type cycloneDXComponent struct {
+	Name       string               `json:"name"`
+	Version    string               `json:"version"`
+	Purl       string               `json:"purl"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+// cycloneDXDocument is the part of a CycloneDX JSON document that we use
+type cycloneDXDocument struct {
+	BOMFormat  string               `json:"bomFormat"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+// inTotoStatement is an attestation, which might have an SBOM as its
+// predicate, or a DSSE envelope wrapping such an attestation
+type inTotoStatement struct {
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+	PayloadType   string          `json:"payloadType"`
+	Payload       string          `json:"payload"`
+}
+
+func addCycloneDXComponents(components []cycloneDXComponent, result []*flagstate.Package) []*flagstate.Package {
+	for _, c := range components {
+		result = append(result, &flagstate.Package{
+			Name:    c.Name,
+			Version: c.Version,
+			Purl:    c.Purl,
+		})
+		result = addCycloneDXComponents(c.Components, result)
+	}
+
+	return result
+}
+
+// parseSBOM returns the packages listed in an SPDX or CycloneDX JSON
+// document, or in an in-toto attestation with such a document as the
+// predicate. Documents that aren't SBOMs have no packages.
+func parseSBOM(bytes []byte) ([]*flagstate.Package, error) {
+	var probe struct {
+		SPDXVersion string `json:"spdxVersion"`
+		BOMFormat   string `json:"bomFormat"`
+		inTotoStatement
+	}
+	err := json.Unmarshal(bytes, &probe)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*flagstate.Package, 0)
+	switch {
+	case probe.SPDXVersion != "":
+		var doc spdxDocument
+		err = json.Unmarshal(bytes, &doc)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range doc.Packages {
+			pkg := flagstate.Package{
+				Name:    p.Name,
+				Version: p.VersionInfo,
+			}
+			for _, ref := range p.ExternalRefs {
+				if ref.ReferenceType == "purl" {
+					pkg.Purl = ref.ReferenceLocator
+					break
+				}
+			}
+			result = append(result, &pkg)
+		}
+	case probe.BOMFormat == "CycloneDX":
+		var doc cycloneDXDocument
+		err = json.Unmarshal(bytes, &doc)
+		if err != nil {
+			return nil, err
+		}
+		result = addCycloneDXComponents(doc.Components, result)
+	case probe.Payload != "":
+		payload, err := base64.StdEncoding.DecodeString(probe.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return parseSBOM(payload)
+	case len(probe.Predicate) > 0 &&
+		(strings.Contains(probe.PredicateType, "spdx") || strings.Contains(probe.PredicateType, "cyclonedx")):
+		return parseSBOM(probe.Predicate)
+	}
+
+	return result, nil
+}
+
+// isSBOMLayer is true for layers that might hold an SBOM or an attestation
+// with an SBOM as the predicate
+func isSBOMLayer(mediaType string) bool {
+	for _, s := range []string{"spdx", "cyclonedx", "in-toto", "dsse"} {
+		if strings.Contains(mediaType, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// getSBOMPackages downloads and parses the SBOMs in the layers of an SBOM
+// or attestation manifest
+func (f *Fetcher) getSBOMPackages(op *fetchOperation, dgst digest.Digest) ([]*flagstate.Package, error) {
+	mfst, err := op.manifests.Get(op.ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*flagstate.Package, 0)
+	for _, layer := range mfst.References() {
+		if !isSBOMLayer(layer.MediaType) {
+			continue
+		}
+		if layer.Size > maxSBOMSize {
+			log.Printf("Skipping %s in %s@%s: too big", layer.Digest, op.repo.Named().Name(), dgst)
+			continue
+		}
+
+		bytes, err := op.blobs.Get(op.ctx, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		packages, err := parseSBOM(bytes)
+		if err != nil {
+			log.Printf("Can't parse %s in %s@%s: %v", layer.Digest, op.repo.Named().Name(), dgst, err)
+			continue
+		}
+		result = append(result, packages...)
+	}
+
+	return result, nil
+}
+
+// sortedPackages sorts packages and removes duplicates and packages without
+// a name
+func sortedPackages(packages []*flagstate.Package) []*flagstate.Package {
+	seen := make(map[flagstate.Package]bool)
+	result := make([]*flagstate.Package, 0, len(packages))
+	for _, pkg := range packages {
+		if pkg.Name == "" || seen[*pkg] {
+			continue
+		}
+		seen[*pkg] = true
+		result = append(result, pkg)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Purl < b.Purl
+	})
+
+	return result
+}
+
+// updatePackages stores the packages from the SBOMs among the referrers to
+// subject. Errors talking to the registry are logged, and leave the stored
+// packages alone; false is returned so that the caller can try again later.
+func (f *Fetcher) updatePackages(op *fetchOperation, tx database.Tx, subject digest.Digest, referrers []*flagstate.Referrer) (bool, error) {
+	packages := make([]*flagstate.Package, 0)
+	for _, referrer := range referrers {
+		if referrer.Type != flagstate.ReferrerSBOM && referrer.Type != flagstate.ReferrerAttestation {
+			continue
+		}
+		p, err := f.getSBOMPackages(op, referrer.Digest)
+		if err != nil {
+			log.Printf("Error getting SBOM %s@%s: %v", op.repo.Named().Name(), referrer.Digest, err)
+			return false, nil
+		}
+		packages = append(packages, p...)
+	}
+
+	return true, tx.SetPackages(op.repo.Named().Name(), subject, sortedPackages(packages))
+}
@@ -0,0 +1,202 @@
+package fetcher
+
+import (
+	"encoding/base64"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+	"testing"
+)
+
+const testSPDX = `{
+    "spdxVersion": "SPDX-2.3",
+    "packages": [
+        {
+            "name": "openssl",
+            "versionInfo": "3.0.7-1.fc37",
+            "externalRefs": [
+                {
+                    "referenceCategory": "PACKAGE-MANAGER",
+                    "referenceType": "purl",
+                    "referenceLocator": "pkg:rpm/fedora/openssl@3.0.7-1.fc37?arch=x86_64"
+                }
+            ]
+        },
+        {
+            "name": "bash",
+            "versionInfo": "5.2.15-1.fc37"
+        }
+    ]
+}`
+
+const testCycloneDX = `{
+    "bomFormat": "CycloneDX",
+    "specVersion": "1.5",
+    "components": [
+        {
+            "name": "flask",
+            "version": "2.3.2",
+            "purl": "pkg:pypi/flask@2.3.2",
+            "components": [
+                {
+                    "name": "jinja2",
+                    "version": "3.1.2",
+                    "purl": "pkg:pypi/jinja2@3.1.2"
+                }
+            ]
+        }
+    ]
+}`
+
+func testPackage(name string, version string, purl string) flagstate.Package {
+	return flagstate.Package{Name: name, Version: version, Purl: purl}
+}
+
+func expectPackages(t *testing.T, packages []*flagstate.Package, expected ...flagstate.Package) {
+	if len(packages) != len(expected) {
+		t.Fatalf("Expected %d packages, got %d", len(expected), len(packages))
+	}
+	for i := range packages {
+		if *packages[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], *packages[i])
+		}
+	}
+}
+
+func TestParseSBOM(t *testing.T) {
+	packages, err := parseSBOM([]byte(testSPDX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPackages(t, packages,
+		testPackage("openssl", "3.0.7-1.fc37", "pkg:rpm/fedora/openssl@3.0.7-1.fc37?arch=x86_64"),
+		testPackage("bash", "5.2.15-1.fc37", ""))
+
+	packages, err = parseSBOM([]byte(testCycloneDX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPackages(t, packages,
+		testPackage("flask", "2.3.2", "pkg:pypi/flask@2.3.2"),
+		testPackage("jinja2", "3.1.2", "pkg:pypi/jinja2@3.1.2"))
+
+	// A cosign attestation is an in-toto statement inside a DSSE envelope
+	statement := `{"_type": "https://in-toto.io/Statement/v0.1", ` +
+		`"predicateType": "https://cyclonedx.org/bom", "predicate": ` + testCycloneDX + `}`
+	envelope := `{"payloadType": "application/vnd.in-toto+json", "payload": "` +
+		base64.StdEncoding.EncodeToString([]byte(statement)) + `", "signatures": []}`
+	packages, err = parseSBOM([]byte(envelope))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 2 {
+		t.Errorf("Expected 2 packages from the attestation, got %d", len(packages))
+	}
+
+	// Other attestations have no packages
+	packages, err = parseSBOM([]byte(`{"_type": "https://in-toto.io/Statement/v0.1", ` +
+		`"predicateType": "https://slsa.dev/provenance/v0.2", "predicate": {"builder": {}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != 0 {
+		t.Errorf("Unexpected packages %v", packages)
+	}
+
+	_, err = parseSBOM([]byte("not json"))
+	if err == nil {
+		t.Errorf("Expected an error for invalid JSON")
+	}
+}
+
+func TestFetchSBOMPackages(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+	tr.referrersAPI = true
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	config := []byte("{}")
+	tr.addManifest(v1.MediaTypeImageManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"artifactType":  "application/spdx+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.empty.v1+json",
+			"digest":    tr.addBlob(config),
+			"size":      len(config),
+		},
+		"layers": []interface{}{
+			map[string]interface{}{
+				"mediaType": "application/spdx+json",
+				"digest":    tr.addBlob([]byte(testSPDX)),
+				"size":      len(testSPDX),
+			},
+		},
+		"subject": tr.descriptor(image),
+	})
+
+	tx := newTestTx()
+	op := newTestOperation(t, tr, "foo")
+	err := op.fetcher.updateRepositoryInDatabase(op, tx,
+		map[string]digest.Digest{"latest": image}, map[string]digest.Digest{}, map[string]*flagstate.FailedTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sorted by name
+	expectPackages(t, tx.packages["foo"][image],
+		testPackage("bash", "5.2.15-1.fc37", ""),
+		testPackage("openssl", "3.0.7-1.fc37", "pkg:rpm/fedora/openssl@3.0.7-1.fc37?arch=x86_64"))
+}
+
+func TestFetchSBOMRetried(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+	tr.referrersAPI = true
+
+	image := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	config := []byte("{}")
+	tr.addManifest(v1.MediaTypeImageManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"artifactType":  "application/spdx+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.empty.v1+json",
+			"digest":    tr.addBlob(config),
+			"size":      len(config),
+		},
+		"layers": []interface{}{
+			map[string]interface{}{
+				"mediaType": "application/spdx+json",
+				// Not added to the registry until later
+				"digest": digest.FromBytes([]byte(testSPDX)),
+				"size":   len(testSPDX),
+			},
+		},
+		"subject": tr.descriptor(image),
+	})
+
+	tx := newTestTx()
+	op := newTestOperation(t, tr, "foo")
+	update := func() {
+		err := op.fetcher.updateRepositoryInDatabase(op, tx,
+			map[string]digest.Digest{"latest": image}, map[string]digest.Digest{}, map[string]*flagstate.FailedTag{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The referrers aren't stored when the SBOM can't be read...
+	update()
+	if len(tx.referrers["foo"][image]) != 0 || tx.packages["foo"][image] != nil {
+		t.Fatalf("Expected nothing stored, got %v, %v", tx.referrers["foo"][image], tx.packages["foo"][image])
+	}
+
+	// ... so the next fetch tries again
+	tr.addBlob([]byte(testSPDX))
+	update()
+	if len(tx.referrers["foo"][image]) != 1 || len(tx.packages["foo"][image]) != 2 {
+		t.Errorf("Expected the SBOM to be stored, got %v, %v", tx.referrers["foo"][image], tx.packages["foo"][image])
+	}
+}
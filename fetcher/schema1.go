@@ -0,0 +1,138 @@
+package fetcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"strings"
+)
+
+// The schema1 package of docker/distribution depends on libtrust to verify
+// signatures, which we don't need, so we parse schema1 manifests ourselves.
+
+const (
+	mediaTypeSchema1Manifest       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeSchema1SignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	mediaTypeSchema1Layer          = "application/vnd.docker.container.image.rootfs.diff+x-gtar"
+)
+
+type schema1FSLayer struct {
+	BlobSum digest.Digest `json:"blobSum"`
+}
+
+type schema1History struct {
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+type schema1Signature struct {
+	Protected string `json:"protected"`
+}
+
+type schema1Manifest struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	Name          string             `json:"name"`
+	Tag           string             `json:"tag"`
+	Architecture  string             `json:"architecture"`
+	FSLayers      []schema1FSLayer   `json:"fsLayers"`
+	History       []schema1History   `json:"history"`
+	Signatures    []schema1Signature `json:"signatures,omitempty"`
+
+	mediaType string
+	// The manifest without signatures, which is what the digest is
+	// computed over
+	canonical []byte
+	all       []byte
+}
+
+func (m *schema1Manifest) References() []distribution.Descriptor {
+	references := make([]distribution.Descriptor, len(m.FSLayers))
+	for i, layer := range m.FSLayers {
+		references[i] = distribution.Descriptor{
+			MediaType: mediaTypeSchema1Layer,
+			Digest:    layer.BlobSum,
+		}
+	}
+
+	return references
+}
+
+func (m *schema1Manifest) Payload() (string, []byte, error) {
+	return m.mediaType, m.all, nil
+}
+
+func decodeJoseBase64(s string) ([]byte, error) {
+	return base64.URLEncoding.DecodeString(s + strings.Repeat("=", (4-len(s)%4)%4))
+}
+
+// schema1Canonical strips the signatures from a signed manifest. The
+// protected header of each signature records how long the signed content
+// was and the bytes that followed it before the signatures were added.
+func schema1Canonical(b []byte, signatures []schema1Signature) ([]byte, error) {
+	if len(signatures) == 0 {
+		return b, nil
+	}
+
+	protected, err := decodeJoseBase64(signatures[0].Protected)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	err = json.Unmarshal(protected, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.FormatLength <= 0 || header.FormatLength > len(b) {
+		return nil, badManifest("Invalid schema1 signature format length %d", header.FormatLength)
+	}
+	tail, err := decodeJoseBase64(header.FormatTail)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := make([]byte, 0, header.FormatLength+len(tail))
+	canonical = append(canonical, b[:header.FormatLength]...)
+	canonical = append(canonical, tail...)
+
+	return canonical, nil
+}
+
+func unmarshalSchema1(mediaType string) distribution.UnmarshalFunc {
+	return func(b []byte) (distribution.Manifest, distribution.Descriptor, error) {
+		m := &schema1Manifest{
+			mediaType: mediaType,
+			all:       b,
+		}
+		err := json.Unmarshal(b, m)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+		if m.SchemaVersion != 1 {
+			return nil, distribution.Descriptor{}, badManifest("Unexpected schemaVersion %d for schema1 manifest", m.SchemaVersion)
+		}
+
+		m.canonical, err = schema1Canonical(b, m.Signatures)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+
+		return m, distribution.Descriptor{
+			Digest:    digest.FromBytes(m.canonical),
+			Size:      int64(len(m.canonical)),
+			MediaType: mediaType,
+		}, nil
+	}
+}
+
+func init() {
+	for _, mediaType := range []string{mediaTypeSchema1Manifest, mediaTypeSchema1SignedManifest} {
+		err := distribution.RegisterManifestSchema(mediaType, unmarshalSchema1(mediaType))
+		if err != nil {
+			panic(fmt.Sprintf("Unable to register manifest: %s", err))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package fetcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"strings"
+	"testing"
+)
+
+func TestSchema1Canonical(t *testing.T) {
+	content := `{"schemaVersion":1,"name":"foo/bar"`
+	protected, _ := json.Marshal(map[string]interface{}{
+		"formatLength": len(content),
+		"formatTail":   strings.TrimRight(base64.URLEncoding.EncodeToString([]byte("\n}")), "="),
+	})
+	signed := content + `,"signatures":[{"protected":"` +
+		strings.TrimRight(base64.URLEncoding.EncodeToString(protected), "=") + `"}]}`
+
+	m, descriptor, err := unmarshalSchema1(mediaTypeSchema1SignedManifest)([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := digest.FromBytes([]byte(content + "\n}"))
+	if descriptor.Digest != expected {
+		t.Errorf("Expected digest %s, got %s", expected, descriptor.Digest)
+	}
+	mediaType, payload, _ := m.Payload()
+	if mediaType != mediaTypeSchema1SignedManifest || string(payload) != signed {
+		t.Errorf("Unexpected payload %s: %s", mediaType, payload)
+	}
+}
+
+func TestFetchSchema1(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+
+	base := tr.addBlob([]byte("base layer"))
+	empty := tr.addBlob([]byte("empty"))
+	top := tr.addBlob([]byte("top layer"))
+
+	v1Compatibility := func(entry map[string]interface{}) map[string]interface{} {
+		bytes, _ := json.Marshal(entry)
+		return map[string]interface{}{"v1Compatibility": string(bytes)}
+	}
+
+	dgst := tr.addManifest(mediaTypeSchema1Manifest, map[string]interface{}{
+		"schemaVersion": 1,
+		"name":          "foo/bar",
+		"tag":           "latest",
+		"architecture":  "amd64",
+		"fsLayers": []interface{}{
+			map[string]interface{}{"blobSum": top},
+			map[string]interface{}{"blobSum": empty},
+			map[string]interface{}{"blobSum": base},
+		},
+		"history": []interface{}{
+			v1Compatibility(map[string]interface{}{
+				"id":      "3",
+				"os":      "linux",
+				"created": "2016-05-01T12:00:00Z",
+				"config": map[string]interface{}{
+					"Cmd":    []string{"/bin/sh"},
+					"Labels": map[string]string{"org.example.label": "old"},
+				},
+				"container_config": map[string]interface{}{
+					"Cmd": []string{"/bin/sh", "-c", "make install"},
+				},
+			}),
+			v1Compatibility(map[string]interface{}{
+				"id":        "2",
+				"throwaway": true,
+				"container_config": map[string]interface{}{
+					"Cmd": []string{"/bin/sh", "-c", "#(nop) ENV A=B"},
+				},
+			}),
+			v1Compatibility(map[string]interface{}{
+				"id":      "1",
+				"created": "2016-04-01T12:00:00Z",
+			}),
+		},
+	})
+	tr.tag("foo/bar", "latest", dgst)
+
+	op := newTestOperation(t, tr, "foo/bar")
+	imageTags, _, failedTags, err := op.fetcher.getTagsFromRegistry(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageTags["latest"] != dgst || len(failedTags) != 0 {
+		t.Fatalf("Unexpected tags %v %v", imageTags, failedTags)
+	}
+
+	var image flagstate.Image
+	err = op.fetcher.fetchImage(op, dgst, &image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.MediaType != mediaTypeSchema1Manifest || !image.NeedsMigration() {
+		t.Errorf("Unexpected media type %s", image.MediaType)
+	}
+	if image.OS != "linux" || image.Architecture != "amd64" {
+		t.Errorf("Unexpected platform %s/%s", image.OS, image.Architecture)
+	}
+	if image.Labels["org.example.label"] != "old" || image.Created == nil || image.Created.Month() != 5 {
+		t.Errorf("Unexpected configuration %+v", image)
+	}
+	if len(image.Layers) != 2 || image.Layers[0].Digest != base || image.Layers[1].Digest != top {
+		t.Fatalf("Unexpected layers %+v", image.Layers)
+	}
+	if image.Size != int64(len("base layer")+len("top layer")) {
+		t.Errorf("Unexpected size %d", image.Size)
+	}
+	if len(image.History) != 3 || !image.History[1].EmptyLayer ||
+		image.History[2].CreatedBy != "/bin/sh -c make install" {
+		t.Errorf("Unexpected history %+v", image.History)
+	}
+}
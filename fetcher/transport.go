@@ -0,0 +1,163 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/owtaylor/flagstate"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func loadCertificates(pool *x509.CertPool, filename string) error {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(bytes) {
+		return fmt.Errorf("No certificates found in %s", filename)
+	}
+
+	return nil
+}
+
+func newTLSConfig(config *flagstate.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Registry.Tls.InsecureSkipVerify,
+	}
+
+	if v := config.Registry.Tls.MinVersion; v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS version '%s'", v)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if config.Registry.Tls.CaFile != "" || config.Registry.Tls.CaDir != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Registry.Tls.CaFile != "" {
+			err = loadCertificates(pool, config.Registry.Tls.CaFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if config.Registry.Tls.CaDir != "" {
+			files, err := ioutil.ReadDir(config.Registry.Tls.CaDir)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				ext := filepath.Ext(f.Name())
+				if f.IsDir() || (ext != ".crt" && ext != ".pem") {
+					continue
+				}
+				err = loadCertificates(pool, filepath.Join(config.Registry.Tls.CaDir, f.Name()))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.Registry.Tls.CertFile != "" || config.Registry.Tls.KeyFile != "" {
+		if config.Registry.Tls.CertFile == "" || config.Registry.Tls.KeyFile == "" {
+			return nil, fmt.Errorf("registry.tls.cert_file and registry.tls.key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.Registry.Tls.CertFile, config.Registry.Tls.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func matchesNoProxy(host string, noProxy []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, pattern := range noProxy {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" {
+			return true
+		}
+		if strings.HasPrefix(pattern, ".") {
+			if strings.HasSuffix(host, pattern) || host == pattern[1:] {
+				return true
+			}
+		} else if host == pattern || strings.HasSuffix(host, "."+pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newProxyFunc(config *flagstate.Config) (func(*http.Request) (*url.URL, error), error) {
+	if config.Registry.Proxy.Url == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyUrl, err := url.Parse(config.Registry.Proxy.Url)
+	if err != nil {
+		return nil, err
+	}
+	noProxy := config.Registry.Proxy.NoProxy
+
+	return func(req *http.Request) (*url.URL, error) {
+		if matchesNoProxy(req.URL.Host, noProxy) {
+			return nil, nil
+		}
+		return proxyUrl, nil
+	}, nil
+}
+
+// newTransport creates the transport that is shared between all HTTP
+// requests the fetcher makes to the registry and token server.
+func newTransport(config *flagstate.Config) (http.RoundTripper, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := newProxyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
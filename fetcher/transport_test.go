@@ -0,0 +1,121 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"github.com/owtaylor/flagstate"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeServerCert(t *testing.T, server *httptest.Server, filename string) {
+	block := &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}
+	err := ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newQuietTLSServer creates a test server that doesn't log the handshake
+// errors that we deliberately provoke
+func newQuietTLSServer(tlsConfig *tls.Config) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = tlsConfig
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+
+	return server
+}
+
+func expectGet(t *testing.T, config *flagstate.Config, url string, expectSuccess bool) {
+	trans, err := newTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: trans}
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if expectSuccess && err != nil {
+		t.Errorf("Expected success, got %v", err)
+	} else if !expectSuccess && err == nil {
+		t.Errorf("Expected failure")
+	}
+}
+
+func TestTransportCA(t *testing.T) {
+	server := newQuietTLSServer(nil)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "flagstate-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeServerCert(t, server, filepath.Join(dir, "ca.crt"))
+
+	var config flagstate.Config
+	expectGet(t, &config, server.URL, false)
+
+	config.Registry.Tls.CaFile = filepath.Join(dir, "ca.crt")
+	expectGet(t, &config, server.URL, true)
+
+	config = flagstate.Config{}
+	config.Registry.Tls.CaDir = dir
+	expectGet(t, &config, server.URL, true)
+
+	config = flagstate.Config{}
+	config.Registry.Tls.InsecureSkipVerify = true
+	expectGet(t, &config, server.URL, true)
+}
+
+func TestTransportMinVersion(t *testing.T) {
+	server := newQuietTLSServer(&tls.Config{
+		MaxVersion: tls.VersionTLS12,
+	})
+	defer server.Close()
+
+	var config flagstate.Config
+	config.Registry.Tls.InsecureSkipVerify = true
+	config.Registry.Tls.MinVersion = "1.2"
+	expectGet(t, &config, server.URL, true)
+
+	config.Registry.Tls.MinVersion = "1.3"
+	expectGet(t, &config, server.URL, false)
+
+	config.Registry.Tls.MinVersion = "1.9"
+	_, err := newTransport(&config)
+	if err == nil {
+		t.Errorf("Expected error for bad TLS version")
+	}
+}
+
+func TestMatchesNoProxy(t *testing.T) {
+	noProxy := []string{"localhost", ".example.com", "registry.local"}
+
+	for _, host := range []string{"localhost", "localhost:5000", "example.com", "foo.example.com", "registry.local:443"} {
+		if !matchesNoProxy(host, noProxy) {
+			t.Errorf("Expected %s to match", host)
+		}
+	}
+
+	for _, host := range []string{"example.org", "notexample.com", "registry.local.org"} {
+		if matchesNoProxy(host, noProxy) {
+			t.Errorf("Expected %s not to match", host)
+		}
+	}
+
+	if !matchesNoProxy("anything", []string{"*"}) {
+		t.Errorf("Expected * to match")
+	}
+}
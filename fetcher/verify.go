@@ -0,0 +1,276 @@
+package fetcher
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"io/ioutil"
+	"sort"
+)
+
+const (
+	mediaTypeSimpleSigning    = "application/vnd.dev.cosign.simplesigning.v1+json"
+	annotationCosignSignature = "dev.cosignproject.cosign/signature"
+	simpleSigningType         = "cosign container image signature"
+)
+
+// verificationKey is a public key from the configuration that cosign
+// signatures are checked against
+type verificationKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+func loadVerificationKeys(config *flagstate.Config) ([]*verificationKey, error) {
+	result := make([]*verificationKey, 0, len(config.Verification.Keys))
+	seen := make(map[string]bool)
+	for _, k := range config.Verification.Keys {
+		if k.Id == "" {
+			return nil, fmt.Errorf("Verification key %s has no id", k.File)
+		}
+		if seen[k.Id] {
+			return nil, fmt.Errorf("Duplicate verification key id %s", k.Id)
+		}
+		seen[k.Id] = true
+
+		bytes, err := ioutil.ReadFile(k.File)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePublicKey(bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k.File, err)
+		}
+
+		result = append(result, &verificationKey{id: k.Id, key: key})
+	}
+
+	// Verifications are stored sorted by key id
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].id < result[j].id
+	})
+
+	return result, nil
+}
+
+// parsePublicKey parses a PEM-encoded public key, as written by
+// 'cosign generate-key-pair' or 'openssl pkey -pubout'
+func parsePublicKey(bytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+
+	var key crypto.PublicKey
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unexpected PEM block type %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T", key)
+	}
+}
+
+// checkSignature checks that signature was made over payload with the
+// private half of key, the same way that cosign signs
+func checkSignature(key crypto.PublicKey, payload []byte, signature []byte) error {
+	hash := sha256.Sum256(payload)
+
+	ok := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, hash[:], signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, payload, signature)
+	default:
+		return fmt.Errorf("Unsupported key type %T", key)
+	}
+	if !ok {
+		return fmt.Errorf("Signature doesn't match key")
+	}
+
+	return nil
+}
+
+// simpleSigningPayload is the part of a cosign signature payload that
+// identifies what was signed
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// checkPayload checks that a signed payload is a signature of subject
+func checkPayload(payload []byte, subject digest.Digest) error {
+	var parsed simpleSigningPayload
+	err := json.Unmarshal(payload, &parsed)
+	if err != nil {
+		return fmt.Errorf("Can't parse payload: %v", err)
+	}
+
+	if parsed.Critical.Type != simpleSigningType {
+		return fmt.Errorf("Unexpected payload type '%s'", parsed.Critical.Type)
+	}
+	if parsed.Critical.Image.DockerManifestDigest != subject {
+		return fmt.Errorf("Payload is for %s", parsed.Critical.Image.DockerManifestDigest)
+	}
+
+	return nil
+}
+
+// cosignSignature is a payload and the signature of it
+type cosignSignature struct {
+	payload   []byte
+	signature []byte
+}
+
+// signatureManifest is a cosign signature manifest. Each layer is a
+// payload, with the signature in an annotation. distribution.Descriptor
+// doesn't have annotations, so we parse the manifest ourselves.
+type signatureManifest struct {
+	Layers []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      digest.Digest     `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// getCosignSignatures downloads the payloads and signatures from a cosign
+// signature manifest
+func (f *Fetcher) getCosignSignatures(op *fetchOperation, dgst digest.Digest) ([]*cosignSignature, error) {
+	mfst, err := op.manifests.Get(op.ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+	_, payload, err := mfst.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest signatureManifest
+	err = json.Unmarshal(payload, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*cosignSignature, 0)
+	for _, layer := range manifest.Layers {
+		encoded, ok := layer.Annotations[annotationCosignSignature]
+		if layer.MediaType != mediaTypeSimpleSigning || !ok {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode signature in %s: %v", dgst, err)
+		}
+
+		signedPayload, err := op.blobs.Get(op.ctx, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, &cosignSignature{
+			payload:   signedPayload,
+			signature: signature,
+		})
+	}
+
+	return result, nil
+}
+
+// verifySignatures checks the cosign signatures among the referrers to
+// subject against each of the configured keys. If there are no keys or no
+// cosign signatures, the result is empty.
+func (f *Fetcher) verifySignatures(op *fetchOperation, subject digest.Digest, referrers []*flagstate.Referrer) ([]*flagstate.SignatureVerification, error) {
+	result := make([]*flagstate.SignatureVerification, 0)
+	if len(f.keys) == 0 {
+		return result, nil
+	}
+
+	signatures := make([]*cosignSignature, 0)
+	for _, referrer := range referrers {
+		if referrer.Type != flagstate.ReferrerSignature || referrer.ArtifactType == artifactTypeNotarySignature {
+			continue
+		}
+		s, err := f.getCosignSignatures(op, referrer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, s...)
+	}
+	if len(signatures) == 0 {
+		return result, nil
+	}
+
+	for _, key := range f.keys {
+		verification := flagstate.SignatureVerification{KeyId: key.id}
+		for _, s := range signatures {
+			err := checkSignature(key.key, s.payload, s.signature)
+			if err == nil {
+				err = checkPayload(s.payload, subject)
+			}
+			if err == nil {
+				verification.Verified = true
+				verification.Error = ""
+				break
+			}
+			verification.Error = err.Error()
+		}
+		result = append(result, &verification)
+	}
+
+	return result, nil
+}
+
+// verifiedWithKeys checks whether verifications were made with the keys that
+// are currently configured. Without any signatures nothing is stored, but
+// checking again is cheap, since there's nothing to fetch.
+func verifiedWithKeys(verifications []*flagstate.SignatureVerification, keys []*verificationKey) bool {
+	if len(verifications) != len(keys) {
+		return false
+	}
+	for i, key := range keys {
+		if verifications[i].KeyId != key.id {
+			return false
+		}
+	}
+	return true
+}
+
+func verificationsEqual(a []*flagstate.SignatureVerification, b []*flagstate.SignatureVerification) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
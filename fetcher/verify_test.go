@@ -0,0 +1,239 @@
+package fetcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/owtaylor/flagstate"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writePublicKey writes the public half of key to a PEM file in dir
+func writePublicKey(t *testing.T, dir string, name string, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name+".pub")
+	err = ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func simpleSigningPayloadFor(subject digest.Digest) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry.example.com/foo"},`+
+		`"image":{"docker-manifest-digest":"%s"},"type":"%s"},"optional":null}`, subject, simpleSigningType))
+}
+
+// addCosignSignature adds a cosign signature manifest referring to subject,
+// with a payload for signed, signed with key, and returns its digest
+func (tr *testRegistry) addCosignSignature(t *testing.T, key *ecdsa.PrivateKey, signed digest.Digest, subject digest.Digest) digest.Digest {
+	payload := simpleSigningPayloadFor(signed)
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := []byte("{}")
+	return tr.addManifest(v1.MediaTypeImageManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"artifactType":  artifactTypeCosignSignature,
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.empty.v1+json",
+			"digest":    tr.addBlob(config),
+			"size":      len(config),
+		},
+		"layers": []interface{}{
+			map[string]interface{}{
+				"mediaType": mediaTypeSimpleSigning,
+				"digest":    tr.addBlob(payload),
+				"size":      len(payload),
+				"annotations": map[string]string{
+					annotationCosignSignature: base64.StdEncoding.EncodeToString(signature),
+				},
+			},
+		},
+		"subject": tr.descriptor(subject),
+	})
+}
+
+func TestLoadVerificationKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flagstate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var config flagstate.Config
+	config.Verification.Keys = append(config.Verification.Keys,
+		struct{ Id, File string }{"release", writePublicKey(t, dir, "release", generateKey(t))},
+		struct{ Id, File string }{"beta", writePublicKey(t, dir, "beta", generateKey(t))})
+
+	keys, err := loadVerificationKeys(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].id != "beta" || keys[1].id != "release" {
+		t.Errorf("Unexpected keys %+v", keys)
+	}
+
+	config.Verification.Keys[1].Id = "release"
+	_, err = loadVerificationKeys(&config)
+	if err == nil {
+		t.Errorf("Expected an error for a duplicate key id")
+	}
+
+	badFile := filepath.Join(dir, "bad.pub")
+	err = ioutil.WriteFile(badFile, []byte("not a key"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Verification.Keys[1] = struct{ Id, File string }{"bad", badFile}
+	_, err = loadVerificationKeys(&config)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid key")
+	}
+}
+
+func TestCheckPayload(t *testing.T) {
+	subject := digest.FromBytes([]byte("subject"))
+	err := checkPayload(simpleSigningPayloadFor(subject), subject)
+	if err != nil {
+		t.Error(err)
+	}
+
+	other := digest.FromBytes([]byte("other"))
+	err = checkPayload(simpleSigningPayloadFor(other), subject)
+	if err == nil || err.Error() != "Payload is for "+other.String() {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	err = checkPayload([]byte(`{"critical":{"type":"something else"}}`), subject)
+	if err == nil {
+		t.Errorf("Expected an error for the wrong payload type")
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+	tr.referrersAPI = true
+
+	releaseKey := generateKey(t)
+	otherKey := generateKey(t)
+
+	signed := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	tr.addCosignSignature(t, releaseKey, signed, signed)
+	unsigned := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "arm64"), nil)
+	// A signature of a different image doesn't count, even if it's attached
+	// to this one
+	tr.addCosignSignature(t, releaseKey, signed, unsigned)
+
+	tx := newTestTx()
+	op := newTestOperation(t, tr, "foo")
+	op.fetcher.keys = []*verificationKey{
+		{id: "other", key: &otherKey.PublicKey},
+		{id: "release", key: &releaseKey.PublicKey},
+	}
+
+	err := op.fetcher.updateRepositoryInDatabase(op, tx,
+		map[string]digest.Digest{"signed": signed, "unsigned": unsigned},
+		map[string]digest.Digest{}, map[string]*flagstate.FailedTag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []flagstate.SignatureVerification{
+		{KeyId: "other", Verified: false, Error: "Signature doesn't match key"},
+		{KeyId: "release", Verified: true},
+	}
+	verifications := tx.verifications["foo"][signed]
+	if len(verifications) != len(expected) {
+		t.Fatalf("Unexpected verifications %+v", verifications)
+	}
+	for i, v := range verifications {
+		if *v != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], v)
+		}
+	}
+
+	verifications = tx.verifications["foo"][unsigned]
+	if len(verifications) != 2 || verifications[1].Verified ||
+		verifications[1].Error != "Payload is for "+signed.String() {
+		t.Errorf("Unexpected verifications %+v", verifications)
+	}
+}
+
+func TestVerifySignaturesOnlyWhenChanged(t *testing.T) {
+	tr := newTestRegistry()
+	defer tr.Close()
+	tr.referrersAPI = true
+
+	releaseKey := generateKey(t)
+	otherKey := generateKey(t)
+
+	signed := tr.addImage(schema2.MediaTypeManifest, testConfig("linux", "amd64"), nil)
+	tr.addCosignSignature(t, releaseKey, signed, signed)
+
+	tx := newTestTx()
+	op := newTestOperation(t, tr, "foo")
+	op.fetcher.keys = []*verificationKey{
+		{id: "release", key: &releaseKey.PublicKey},
+	}
+	subjects := map[digest.Digest]bool{signed: true}
+
+	_, err := op.fetcher.updateReferrers(op, tx, subjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.verifications["foo"][signed]) != 1 || !tx.verifications["foo"][signed][0].Verified {
+		t.Fatalf("Unexpected verifications %+v", tx.verifications["foo"][signed])
+	}
+
+	// Nothing changed, so the signatures aren't fetched again
+	tr.gets = 0
+	_, err = op.fetcher.updateReferrers(op, tx, subjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.gets != 0 {
+		t.Errorf("Expected no fetches, got %d", tr.gets)
+	}
+
+	// But adding a key means checking them again
+	op.fetcher.keys = append(op.fetcher.keys, &verificationKey{id: "other", key: &otherKey.PublicKey})
+	_, err = op.fetcher.updateReferrers(op, tx, subjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.gets == 0 {
+		t.Errorf("Expected signatures to be fetched")
+	}
+	verifications := tx.verifications["foo"][signed]
+	if len(verifications) != 2 || !verifications[0].Verified || verifications[1].KeyId != "other" || verifications[1].Verified {
+		t.Errorf("Unexpected verifications %+v", verifications)
+	}
+}
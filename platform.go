@@ -0,0 +1,223 @@
+package flagstate
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Platform is a platform that a client wants to run an image on, in the
+// same form as the platform of an entry in an image index.
+type Platform struct {
+	OS           string
+	OSVersion    string
+	Architecture string
+	Variant      string
+}
+
+// ParsePlatform parses a platform specifier of the form
+// <os>[/<architecture>[/<variant>]], as used by 'docker pull --platform'
+func ParsePlatform(specifier string) (Platform, error) {
+	var p Platform
+
+	parts := strings.Split(specifier, "/")
+	for _, part := range parts {
+		if part == "" {
+			return p, fmt.Errorf("Invalid platform specifier '%s'", specifier)
+		}
+	}
+
+	switch len(parts) {
+	case 3:
+		p.Variant = parts[2]
+		fallthrough
+	case 2:
+		p.Architecture = parts[1]
+		fallthrough
+	case 1:
+		p.OS = parts[0]
+	default:
+		return p, fmt.Errorf("Invalid platform specifier '%s'", specifier)
+	}
+
+	return p.Normalize(), nil
+}
+
+func (p Platform) String() string {
+	result := p.OS
+	if p.Architecture != "" {
+		result += "/" + p.Architecture
+		if p.Variant != "" {
+			result += "/" + p.Variant
+		}
+	}
+
+	return result
+}
+
+// Normalize converts alternate names for operating systems and
+// architectures into the canonical form, and fills in the default
+// variant for architectures that have one.
+func (p Platform) Normalize() Platform {
+	p.OS = strings.ToLower(p.OS)
+	if p.OS == "macos" {
+		p.OS = "darwin"
+	}
+
+	p.Architecture = strings.ToLower(p.Architecture)
+	p.Variant = strings.ToLower(p.Variant)
+
+	switch p.Architecture {
+	case "i386":
+		p.Architecture = "386"
+		p.Variant = ""
+	case "x86_64", "x86-64", "amd64":
+		p.Architecture = "amd64"
+		if p.Variant == "v1" {
+			p.Variant = ""
+		}
+	case "aarch64", "arm64":
+		p.Architecture = "arm64"
+		switch p.Variant {
+		case "8", "v8", "":
+			p.Variant = "v8"
+		}
+	case "armhf":
+		p.Architecture = "arm"
+		p.Variant = "v7"
+	case "armel":
+		p.Architecture = "arm"
+		p.Variant = "v6"
+	case "arm":
+		switch p.Variant {
+		case "", "7":
+			p.Variant = "v7"
+		case "5", "6", "8":
+			p.Variant = "v" + p.Variant
+		}
+	}
+
+	return p
+}
+
+// compatibleVariants returns the variants of the platform's architecture
+// that can run on it, in order of preference.
+func (p Platform) compatibleVariants() []string {
+	switch p.Architecture {
+	case "arm":
+		switch p.Variant {
+		case "v8":
+			return []string{"v8", "v7", "v6", "v5"}
+		case "v7":
+			return []string{"v7", "v6", "v5"}
+		case "v6":
+			return []string{"v6", "v5"}
+		}
+	case "amd64":
+		switch p.Variant {
+		case "v4":
+			return []string{"v4", "v3", "v2", ""}
+		case "v3":
+			return []string{"v3", "v2", ""}
+		case "v2":
+			return []string{"v2", ""}
+		}
+	}
+
+	return []string{p.Variant}
+}
+
+// osBuild returns the first three components of a Windows os.version
+// - images with the same build are expected to be compatible.
+func osBuild(osVersion string) string {
+	parts := strings.Split(osVersion, ".")
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// PlatformMatch describes how well an image matches a requested platform
+type PlatformMatch struct {
+	Image  *Image
+	Reason string
+
+	// lower is better
+	rank int
+}
+
+// Match checks whether an image can run on the platform. If it can, the
+// result describes the quality of the match; otherwise nil is returned.
+func (p Platform) Match(image *Image) *PlatformMatch {
+	requested := p.Normalize()
+	candidate := Platform{
+		OS:           image.OS,
+		OSVersion:    image.OSVersion,
+		Architecture: image.Architecture,
+		Variant:      image.Variant,
+	}.Normalize()
+
+	if requested.OS != candidate.OS {
+		return nil
+	}
+	if requested.Architecture != "" && requested.Architecture != candidate.Architecture {
+		return nil
+	}
+
+	var reasons []string
+	rank := 0
+
+	if requested.Architecture != "" {
+		variantRank := -1
+		for i, variant := range requested.compatibleVariants() {
+			if variant == candidate.Variant {
+				variantRank = i
+				break
+			}
+		}
+		if variantRank < 0 {
+			return nil
+		}
+		if variantRank == 0 {
+			reasons = append(reasons, fmt.Sprintf("platform %s matches exactly", candidate))
+		} else {
+			reasons = append(reasons, fmt.Sprintf("platform %s is compatible with requested %s", candidate, requested))
+		}
+		rank += 10 * variantRank
+	} else {
+		reasons = append(reasons, fmt.Sprintf("os %s matches", candidate.OS))
+	}
+
+	if requested.OSVersion != "" {
+		if candidate.OSVersion == requested.OSVersion {
+			reasons = append(reasons, fmt.Sprintf("os.version %s matches exactly", candidate.OSVersion))
+		} else if candidate.OSVersion != "" && osBuild(candidate.OSVersion) == osBuild(requested.OSVersion) {
+			reasons = append(reasons, fmt.Sprintf("os.version %s has the same build as requested %s", candidate.OSVersion, requested.OSVersion))
+			rank += 1
+		} else {
+			reasons = append(reasons, fmt.Sprintf("os.version %s does not match requested %s", candidate.OSVersion, requested.OSVersion))
+			rank += 2
+		}
+	}
+
+	return &PlatformMatch{
+		Image:  image,
+		Reason: strings.Join(reasons, "; "),
+		rank:   rank,
+	}
+}
+
+// BestMatch returns the image that best matches the platform, or nil if
+// none of the images can run on the platform. When several images match
+// equally well, the first is returned.
+func (p Platform) BestMatch(images []*Image) *PlatformMatch {
+	var best *PlatformMatch
+	for _, image := range images {
+		match := p.Match(image)
+		if match != nil && (best == nil || match.rank < best.rank) {
+			best = match
+		}
+	}
+
+	return best
+}
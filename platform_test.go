@@ -0,0 +1,87 @@
+package flagstate
+
+import (
+	"testing"
+)
+
+func expectParsePlatform(t *testing.T, input string, expected Platform) {
+	p, err := ParsePlatform(input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if p != expected {
+		t.Errorf("Parsing %s, expected %+v, got %+v", input, expected, p)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	expectParsePlatform(t, "linux", Platform{OS: "linux"})
+	expectParsePlatform(t, "linux/amd64", Platform{OS: "linux", Architecture: "amd64"})
+	expectParsePlatform(t, "linux/x86_64", Platform{OS: "linux", Architecture: "amd64"})
+	expectParsePlatform(t, "linux/arm64", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	expectParsePlatform(t, "linux/aarch64", Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	expectParsePlatform(t, "linux/arm", Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	expectParsePlatform(t, "linux/arm/6", Platform{OS: "linux", Architecture: "arm", Variant: "v6"})
+	expectParsePlatform(t, "linux/armhf", Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	expectParsePlatform(t, "Windows/AMD64", Platform{OS: "windows", Architecture: "amd64"})
+
+	for _, input := range []string{"", "linux/", "/amd64", "linux/arm/v7/extra"} {
+		_, err := ParsePlatform(input)
+		if err == nil {
+			t.Errorf("Parsing '%s', expected error", input)
+		}
+	}
+}
+
+func expectBestMatch(t *testing.T, images []*Image, platform string, osVersion string, expected *Image) {
+	p, err := ParsePlatform(platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.OSVersion = osVersion
+
+	match := p.BestMatch(images)
+	if expected == nil {
+		if match != nil {
+			t.Errorf("%s: expected no match, got %+v", platform, match.Image)
+		}
+		return
+	}
+	if match == nil {
+		t.Errorf("%s: expected %s, got no match", platform, expected.Digest)
+	} else if match.Image != expected {
+		t.Errorf("%s: expected %s, got %s (%s)", platform, expected.Digest, match.Image.Digest, match.Reason)
+	}
+}
+
+func TestBestMatch(t *testing.T) {
+	amd64 := &Image{Digest: "amd64", OS: "linux", Architecture: "amd64"}
+	arm64 := &Image{Digest: "arm64", OS: "linux", Architecture: "arm64"}
+	armv6 := &Image{Digest: "armv6", OS: "linux", Architecture: "arm", Variant: "v6"}
+	armv7 := &Image{Digest: "armv7", OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	images := []*Image{amd64, arm64, armv6}
+	expectBestMatch(t, images, "linux/amd64", "", amd64)
+	expectBestMatch(t, images, "linux/amd64/v3", "", amd64)
+	expectBestMatch(t, images, "linux/arm64/v8", "", arm64)
+	expectBestMatch(t, images, "linux/arm/v7", "", armv6)
+	expectBestMatch(t, images, "linux/arm/v5", "", nil)
+	expectBestMatch(t, images, "linux/s390x", "", nil)
+	expectBestMatch(t, images, "windows/amd64", "", nil)
+
+	images = []*Image{armv6, armv7}
+	expectBestMatch(t, images, "linux/arm/v7", "", armv7)
+	expectBestMatch(t, images, "linux/arm/v8", "", armv7)
+	expectBestMatch(t, images, "linux/arm/v6", "", armv6)
+
+	ltsc2016 := &Image{Digest: "ltsc2016", OS: "windows", Architecture: "amd64", OSVersion: "10.0.14393.1066"}
+	ltsc2019 := &Image{Digest: "ltsc2019", OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.107"}
+	ltsc2019new := &Image{Digest: "ltsc2019new", OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.2000"}
+
+	images = []*Image{ltsc2016, ltsc2019, ltsc2019new}
+	expectBestMatch(t, images, "windows/amd64", "10.0.17763.2000", ltsc2019new)
+	expectBestMatch(t, images, "windows/amd64", "10.0.17763.500", ltsc2019)
+	expectBestMatch(t, images, "windows/amd64", "10.0.14393.2000", ltsc2016)
+	expectBestMatch(t, images, "windows/amd64", "", ltsc2016)
+}
@@ -1,4 +1,4 @@
-DROP TABLE IF EXISTS modification, image, imageTag, list, listTag, listEntry CASCADE;
+DROP TABLE IF EXISTS modification, image, layer, imageTag, list, listTag, listEntry, artifact, artifactTag, referrer, signatureVerification, package, vulnerability, vulnerabilityScan, failedTag, fetchStatus CASCADE;
 
 CREATE TABLE modification (
        ModificationTime timestamp with time zone
@@ -9,37 +9,186 @@ CREATE TABLE image (
        Digest text PRIMARY KEY,
        MediaType text,
        Architecture text,
+       Variant text,
        OS text,
+       OSVersion text,
+       OSFeatures jsonb,
        Annotations jsonb,
-       Labels jsonb
+       Labels jsonb,
+       -- Selected keys from /etc/os-release, if the layers were inspected
+       OSRelease jsonb,
+       -- Parsed from the Flatpak labels
+       Flatpak jsonb,
+       Created timestamp with time zone,
+       Author text,
+       Config jsonb,
+       History jsonb,
+       ConfigBlob jsonb,
+       -- Compressed size of the config and layers
+       Size bigint,
+       -- Denormalized from the layer table for matching base images
+       LayerDigests text[],
+       -- Full-text search vector of the title, description, and the
+       -- labels configured for searching
+       SearchText tsvector
 );
 CREATE INDEX imageAnnotations ON image USING gin(Annotations);
+CREATE INDEX imageLayerDigests ON image USING gin(LayerDigests);
+CREATE INDEX imageCreated ON image ( Created );
+CREATE INDEX imageFlatpak ON image USING gin(Flatpak);
+CREATE INDEX imageSearchText ON image USING gin(SearchText);
+
+CREATE TABLE layer (
+       Image text REFERENCES image(Digest) ON DELETE CASCADE,
+       Position integer,
+       Digest text,
+       MediaType text,
+       Size bigint
+);
+CREATE UNIQUE INDEX layerPKey ON layer ( Image, Position );
+CREATE INDEX layerDigest ON layer ( Digest );
 
 CREATE TABLE imageTag (
        Repository text,
        Tag text,
-       Image text REFERENCES image(Digest)
+       Image text REFERENCES image(Digest),
+       -- When we first saw the tag pointing to this image
+       FirstSeen timestamp with time zone DEFAULT now()
 );
 CREATE UNIQUE INDEX imageTagPKey ON imageTag ( Repository, Tag );
 CREATE INDEX imageTagTag ON imageTag ( Tag );
+CREATE INDEX imageTagFirstSeen ON imageTag ( FirstSeen );
 
 CREATE TABLE list (
        Digest text PRIMARY KEY,
        MediaType text,
-       Annotations jsonb
+       Annotations jsonb,
+       -- Compressed size of the unique blobs of the images in the list
+       Size bigint
 );
 CREATE INDEX listAnnotations ON list USING gin(Annotations);
 
 CREATE TABLE listTag (
        Repository text,
        Tag text,
-       List text REFERENCES list(Digest)
+       List text REFERENCES list(Digest),
+       -- When we first saw the tag pointing to this list
+       FirstSeen timestamp with time zone DEFAULT now()
 );
 CREATE UNIQUE INDEX listTagPKey ON listTag ( Repository, Tag );
 CREATE INDEX listTagTag ON listTag ( Tag );
+CREATE INDEX listTagFirstSeen ON listTag ( FirstSeen );
 
 CREATE TABLE listEntry (
        List text REFERENCES list(Digest) ON DELETE CASCADE,
        Image text REFERENCES image(Digest)
 );
 CREATE UNIQUE INDEX listEntryPKey ON listEntry ( List, Image );
+
+-- Manifests that aren't container images, such as Helm charts
+CREATE TABLE artifact (
+       Digest text PRIMARY KEY,
+       MediaType text,
+       ArtifactType text,
+       ConfigBlob jsonb,
+       Annotations jsonb,
+       Layers jsonb,
+       Size bigint,
+       Helm jsonb
+);
+CREATE INDEX artifactArtifactType ON artifact ( ArtifactType );
+CREATE INDEX artifactAnnotations ON artifact USING gin(Annotations);
+
+CREATE TABLE artifactTag (
+       Repository text,
+       Tag text,
+       Artifact text REFERENCES artifact(Digest),
+       -- When we first saw the tag pointing to this artifact
+       FirstSeen timestamp with time zone DEFAULT now()
+);
+CREATE UNIQUE INDEX artifactTagPKey ON artifactTag ( Repository, Tag );
+CREATE INDEX artifactTagTag ON artifactTag ( Tag );
+CREATE INDEX artifactTagFirstSeen ON artifactTag ( FirstSeen );
+
+-- Signatures, attestations, and SBOMs that refer to a tagged image, list,
+-- or artifact in the same repository
+CREATE TABLE referrer (
+       Repository text,
+       Subject text,
+       Digest text,
+       MediaType text,
+       ArtifactType text,
+       -- signature, attestation, sbom, or other
+       Type text,
+       -- The fallback tag the referrer was found through, if any
+       Tag text
+);
+CREATE UNIQUE INDEX referrerPKey ON referrer ( Repository, Subject, Digest );
+CREATE INDEX referrerSubject ON referrer ( Subject );
+
+-- Results of checking the cosign signatures of a subject in a repository
+-- against each configured public key
+CREATE TABLE signatureVerification (
+       Repository text,
+       Subject text,
+       KeyId text,
+       Verified boolean,
+       Error text
+);
+CREATE UNIQUE INDEX signatureVerificationPKey ON signatureVerification ( Repository, Subject, KeyId );
+
+-- Packages listed in the SBOMs of an image or image list; the SBOMs are
+-- referrers, so they can differ between repositories
+CREATE TABLE package (
+       Repository text,
+       Image text,
+       Name text,
+       Version text,
+       -- Sorts in version order when compared with COLLATE "C"
+       VersionKey text,
+       Purl text,
+       -- Purl without the version, qualifiers, and subpath
+       PurlBase text
+);
+CREATE INDEX packageImage ON package ( Repository, Image );
+CREATE INDEX packageName ON package ( Name );
+CREATE INDEX packagePurlBase ON package ( PurlBase );
+
+-- Findings imported from vulnerability scanners
+CREATE TABLE vulnerability (
+       Image text,
+       Id text,
+       Package text,
+       InstalledVersion text,
+       FixedVersion text,
+       Severity text,
+       -- From 0 for UNKNOWN to 4 for CRITICAL
+       SeverityRank integer
+);
+CREATE INDEX vulnerabilityImage ON vulnerability ( Image );
+
+-- The last import of scanner results for each image
+CREATE TABLE vulnerabilityScan (
+       Image text PRIMARY KEY,
+       Scanner text,
+       Imported timestamp with time zone
+);
+
+-- Tags that couldn't be fetched, for example because they point to a
+-- manifest type we don't understand
+CREATE TABLE failedTag (
+       Repository text,
+       Tag text,
+       Digest text,
+       MediaType text,
+       Error text
+);
+CREATE UNIQUE INDEX failedTagPKey ON failedTag ( Repository, Tag );
+
+CREATE TABLE fetchStatus (
+       Repository text PRIMARY KEY,
+       LastAttempt timestamp with time zone,
+       LastSuccess timestamp with time zone,
+       ConsecutiveFailures integer DEFAULT 0,
+       LastError text
+);
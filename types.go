@@ -2,20 +2,98 @@ package flagstate
 
 import (
 	"github.com/docker/distribution/digest"
+	"strings"
+	"time"
 )
 
+// ImageConfig holds the parts of the "config" section of an image
+// configuration that describe how a container is run.
+type ImageConfig struct {
+	Entrypoint   []string `json:",omitempty"`
+	Cmd          []string `json:",omitempty"`
+	Env          []string `json:",omitempty"`
+	ExposedPorts []string `json:",omitempty"`
+	User         string   `json:",omitempty"`
+	WorkingDir   string   `json:",omitempty"`
+}
+
+// ImageHistory is an entry in the "history" section of an image configuration
+type ImageHistory struct {
+	Created    *time.Time `json:",omitempty"`
+	CreatedBy  string     `json:",omitempty"`
+	Author     string     `json:",omitempty"`
+	Comment    string     `json:",omitempty"`
+	EmptyLayer bool       `json:",omitempty"`
+}
+
+// Blob describes a blob referenced from an image manifest
+type Blob struct {
+	Digest    digest.Digest
+	MediaType string
+	Size      int64
+}
+
 type Image struct {
 	Digest       digest.Digest
 	MediaType    string
 	OS           string
+	OSVersion    string   `json:",omitempty"`
+	OSFeatures   []string `json:",omitempty"`
 	Architecture string
+	Variant      string            `json:",omitempty"`
 	Annotations  map[string]string `json:",omitempty"`
 	Labels       map[string]string `json:",omitempty"`
+	// ID, VERSION_ID and PRETTY_NAME from /etc/os-release, if layer
+	// inspection is enabled and found the file
+	OSRelease map[string]string `json:",omitempty"`
+	// Parsed from the org.flatpak.ref and org.flatpak.metadata labels
+	Flatpak *FlatpakMetadata `json:",omitempty"`
+	// Total compressed size of the configuration and layers
+	Size int64 `json:",omitempty"`
+	// The following are only returned from queries with IncludeLayers()
+	ConfigBlob *Blob  `json:",omitempty"`
+	Layers     []Blob `json:",omitempty"`
+	// The following are only returned from queries with IncludeConfig()
+	Created *time.Time     `json:",omitempty"`
+	Author  string         `json:",omitempty"`
+	Config  *ImageConfig   `json:",omitempty"`
+	History []ImageHistory `json:",omitempty"`
+	// Set by queries if scanner results have been imported for the image
+	Vulnerabilities *VulnerabilitySummary `json:",omitempty"`
 }
 
 type TaggedImage struct {
 	Image
 	Tags []string
+	// The earliest time one of the tags was seen pointing to the image
+	Pushed *time.Time `json:",omitempty"`
+	// Whether the repository has a signature or SBOM referring to the image
+	HasSignature bool `json:",omitempty"`
+	HasSBOM      bool `json:",omitempty"`
+	// Results of checking the image's cosign signatures against the
+	// configured keys
+	Verifications []*SignatureVerification `json:",omitempty"`
+}
+
+// FlatpakMetadata describes the Flatpak application or runtime that an
+// image contains
+type FlatpakMetadata struct {
+	// "app" or "runtime"
+	Kind   string
+	Id     string
+	Arch   string `json:",omitempty"`
+	Branch string `json:",omitempty"`
+	// Refs of the form ID/ARCH/BRANCH
+	Runtime string `json:",omitempty"`
+	Sdk     string `json:",omitempty"`
+	// Permissions from the [Context] group, as passed to --share,
+	// --socket, --device and --filesystem
+	Shared      []string `json:",omitempty"`
+	Sockets     []string `json:",omitempty"`
+	Devices     []string `json:",omitempty"`
+	Filesystems []string `json:",omitempty"`
+	// Names of the extension points the application or runtime defines
+	Extensions []string `json:",omitempty"`
 }
 
 type ImageList struct {
@@ -23,48 +101,218 @@ type ImageList struct {
 	MediaType   string
 	Images      []*Image
 	Annotations map[string]string `json:",omitempty"`
+	// Total compressed size of the unique blobs referenced by the images
+	Size int64 `json:",omitempty"`
 }
 
 type TaggedImageList struct {
 	ImageList
-	Tags []string
+	Tags          []string
+	Pushed        *time.Time               `json:",omitempty"`
+	HasSignature  bool                     `json:",omitempty"`
+	HasSBOM       bool                     `json:",omitempty"`
+	Verifications []*SignatureVerification `json:",omitempty"`
+}
+
+// HelmChart holds the fields of a Helm chart's Chart.yaml, which are
+// duplicated into the config blob of the chart's manifest
+type HelmChart struct {
+	Name        string
+	Version     string
+	AppVersion  string `json:",omitempty"`
+	Description string `json:",omitempty"`
+}
+
+// Artifact is a manifest that isn't a container image, such as a Helm chart,
+// a WASM module, or an SBOM. Artifacts are identified by their artifactType,
+// or if that isn't set, by the media type of their config.
+type Artifact struct {
+	Digest       digest.Digest
+	MediaType    string
+	ArtifactType string
+	ConfigBlob   *Blob             `json:",omitempty"`
+	Annotations  map[string]string `json:",omitempty"`
+	Layers       []Blob            `json:",omitempty"`
+	// Total compressed size of the config and layers
+	Size int64 `json:",omitempty"`
+	// Set for Helm charts
+	Helm *HelmChart `json:",omitempty"`
+}
+
+type TaggedArtifact struct {
+	Artifact
+	Tags          []string
+	Pushed        *time.Time               `json:",omitempty"`
+	HasSignature  bool                     `json:",omitempty"`
+	HasSBOM       bool                     `json:",omitempty"`
+	Verifications []*SignatureVerification `json:",omitempty"`
+}
+
+// Types of Referrer
+const (
+	ReferrerSignature   = "signature"
+	ReferrerAttestation = "attestation"
+	ReferrerSBOM        = "sbom"
+	ReferrerOther       = "other"
+)
+
+// Referrer is a manifest that describes an image, list, or artifact in the
+// same repository, such as a signature or an SBOM. Referrers are found
+// through the subject field of the referring manifest, or through tags of
+// the form sha256-<hex>.sig that older tools use instead.
+type Referrer struct {
+	Subject      digest.Digest
+	Digest       digest.Digest
+	MediaType    string
+	ArtifactType string `json:",omitempty"`
+	Type         string
+	// The fallback tag the referrer was found through
+	Tag string `json:",omitempty"`
+}
+
+// SignatureVerification is the result of checking the cosign signatures of
+// an image, list, or artifact against one of the configured public keys.
+// Verified is true if any of the signatures was made with the key, otherwise
+// Error says why the last signature checked didn't match.
+type SignatureVerification struct {
+	KeyId    string
+	Verified bool
+	Error    string `json:",omitempty"`
+}
+
+// Package is a software package listed in an SBOM of an image
+type Package struct {
+	Name    string
+	Version string `json:",omitempty"`
+	// Package URL - see https://github.com/package-url/purl-spec
+	Purl string `json:",omitempty"`
+}
+
+// Vulnerability severities, from least to most severe
+const (
+	SeverityUnknown  = "UNKNOWN"
+	SeverityLow      = "LOW"
+	SeverityMedium   = "MEDIUM"
+	SeverityHigh     = "HIGH"
+	SeverityCritical = "CRITICAL"
+)
+
+var severityRanks = map[string]int{
+	SeverityUnknown:  0,
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// SeverityRank orders severities from SeverityUnknown (0) to
+// SeverityCritical (4). ok is false if severity isn't one of the
+// Severity constants.
+func SeverityRank(severity string) (rank int, ok bool) {
+	rank, ok = severityRanks[severity]
+	return
+}
+
+// Vulnerability is a finding from a vulnerability scanner for an image
+type Vulnerability struct {
+	// CVE or other advisory identifier
+	Id               string
+	Package          string
+	InstalledVersion string
+	FixedVersion     string `json:",omitempty"`
+	Severity         string
+}
+
+// VulnerabilityCounts counts vulnerabilities by severity
+type VulnerabilityCounts struct {
+	Critical int
+	High     int
+	Medium   int
+	Low      int
+	Unknown  int
+}
+
+// VulnerabilitySummary describes the last scanner results imported for an
+// image
+type VulnerabilitySummary struct {
+	VulnerabilityCounts
+	Scanner  string
+	Imported time.Time
+}
+
+// FailedTag is a tag that couldn't be fetched from the registry
+type FailedTag struct {
+	Tag       string
+	Digest    digest.Digest `json:",omitempty"`
+	MediaType string        `json:",omitempty"`
+	Error     string
 }
 
 type Repository struct {
 	Name   string
 	Images []*TaggedImage
 	Lists  []*TaggedImageList
+	// Artifacts are only included in the result of queries that don't
+	// have terms specific to images
+	Artifacts []*TaggedArtifact `json:",omitempty"`
+	// Only returned from queries with IncludeFailedTags()
+	FailedTags []*FailedTag `json:",omitempty"`
 }
 
-func (im *Image) Title() string {
-	if v := im.Annotations["org.opencontainers.image.title"]; v != "" {
-		return v
-	} else if v := im.Labels["org.label-schema.name"]; v != "" {
-		return v
-	} else if v := im.Labels["io.k8s.display-name"]; v != "" {
-		return v
-	} else if v := im.Labels["name"]; v != "" {
-		return v
-	} else if v := im.Labels["Name"]; v != "" {
-		return v
-	} else {
-		return ""
+// NeedsMigration is true for images with a deprecated Docker schema1
+// manifest, which should be converted to a current format.
+func (im *Image) NeedsMigration() bool {
+	return strings.HasPrefix(im.MediaType, "application/vnd.docker.distribution.manifest.v1+")
+}
+
+// MetadataSource is an annotation or label that descriptive metadata about
+// an image can be taken from
+type MetadataSource struct {
+	Annotation bool
+	Key        string
+}
+
+// Where Image.Title() and Image.Description() look, in order of preference
+var (
+	TitleSources = []MetadataSource{
+		{true, "org.opencontainers.image.title"},
+		{false, "org.label-schema.name"},
+		{false, "io.k8s.display-name"},
+		{false, "name"},
+		{false, "Name"},
+	}
+	DescriptionSources = []MetadataSource{
+		{true, "org.opencontainers.image.description"},
+		{false, "org.label-schema.description"},
+		{false, "io.k8s.description"},
+		{false, "description"},
+		{false, "Description"},
+	}
+)
+
+// lookupMetadata returns the first non-empty value from sources
+func (im *Image) lookupMetadata(sources []MetadataSource) string {
+	for _, source := range sources {
+		var v string
+		if source.Annotation {
+			v = im.Annotations[source.Key]
+		} else {
+			v = im.Labels[source.Key]
+		}
+		if v != "" {
+			return v
+		}
 	}
+
+	return ""
 }
+
+func (im *Image) Title() string {
+	return im.lookupMetadata(TitleSources)
+}
+
 func (im *Image) Description() string {
-	if v := im.Annotations["org.opencontainers.image.description"]; v != "" {
-		return v
-	} else if v := im.Labels["org.label-schema.description"]; v != "" {
-		return v
-	} else if v := im.Labels["io.k8s.description"]; v != "" {
-		return v
-	} else if v := im.Labels["description"]; v != "" {
-		return v
-	} else if v := im.Labels["Description"]; v != "" {
-		return v
-	} else {
-		return ""
-	}
+	return im.lookupMetadata(DescriptionSources)
 }
 
 func (im *TaggedImage) IsLatest() bool {
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes how long to wait before retrying after the given number
+// of consecutive failures. The delay doubles with each failure, starting
+// from min and capped at max, and is randomized to between half and all of
+// that so that repositories that failed together don't retry together.
+func Backoff(failures int, min time.Duration, max time.Duration) time.Duration {
+	delay := min
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
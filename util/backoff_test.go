@@ -0,0 +1,24 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func expectBackoff(t *testing.T, failures int, low time.Duration, high time.Duration) {
+	for i := 0; i < 100; i++ {
+		delay := Backoff(failures, time.Minute, time.Hour)
+		if delay < low || delay > high {
+			t.Errorf("After %d failures, expected delay between %v and %v, got %v", failures, low, high, delay)
+			return
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	expectBackoff(t, 1, 30*time.Second, time.Minute)
+	expectBackoff(t, 2, time.Minute, 2*time.Minute)
+	expectBackoff(t, 4, 4*time.Minute, 8*time.Minute)
+	expectBackoff(t, 10, 30*time.Minute, time.Hour)
+	expectBackoff(t, 1000, 30*time.Minute, time.Hour)
+}
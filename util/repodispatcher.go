@@ -1,11 +1,28 @@
 package util
 
-import "sync"
+import (
+	"github.com/docker/distribution/digest"
+	"sync"
+)
+
+// TagUpdate is a change to a single tag of a repository, as reported by
+// a registry notification. If Tag is empty for a deletion, all tags
+// pointing to Digest are removed.
+type TagUpdate struct {
+	Tag       string
+	Digest    digest.Digest
+	MediaType string
+	Deleted   bool
+}
 
 type repoInfo struct {
 	lowPriority  bool
 	highPriority bool
 	pending      bool
+	// If true, the entire repository needs to be refetched, otherwise
+	// only tagUpdates need to be applied
+	full       bool
+	tagUpdates []TagUpdate
 }
 
 type repoDispatcher struct {
@@ -65,10 +82,7 @@ func (rd *repoDispatcher) someReady() bool {
 	return !rd.locked && (len(rd.highPriorityRepos) > 0 || len(rd.lowPriorityRepos) > 0)
 }
 
-func (rd *repoDispatcher) Add(repo string, lowPriority bool) {
-	rd.mutex.Lock()
-	defer rd.mutex.Unlock()
-
+func (rd *repoDispatcher) add(repo string, lowPriority bool) *repoInfo {
 	info := rd.repos[repo]
 	if info == nil {
 		info = &repoInfo{}
@@ -91,9 +105,37 @@ func (rd *repoDispatcher) Add(repo string, lowPriority bool) {
 			rd.readyCond.Signal()
 		}
 	}
+
+	return info
+}
+
+// Add queues the entire repository to be fetched
+func (rd *repoDispatcher) Add(repo string, lowPriority bool) {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+
+	info := rd.add(repo, lowPriority)
+	info.full = true
+	info.tagUpdates = nil
+}
+
+// AddTagUpdate queues a change to a single tag of the repository. If the
+// entire repository is already queued to be fetched, this does nothing
+// except raising the priority.
+func (rd *repoDispatcher) AddTagUpdate(repo string, update TagUpdate) {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+
+	info := rd.add(repo, false)
+	if !info.full {
+		info.tagUpdates = append(info.tagUpdates, update)
+	}
 }
 
-func (rd *repoDispatcher) Take() string {
+// Take waits for a repository to be ready, and returns it with the tag
+// updates queued for it. If tagUpdates is nil, the entire repository
+// should be fetched. Release must be called when done.
+func (rd *repoDispatcher) Take() (repo string, tagUpdates []TagUpdate) {
 	rd.mutex.Lock()
 	defer rd.mutex.Unlock()
 
@@ -101,7 +143,6 @@ func (rd *repoDispatcher) Take() string {
 		rd.readyCond.Wait()
 	}
 
-	var repo string
 	var info *repoInfo
 	var repos *map[string]*repoInfo
 
@@ -123,7 +164,13 @@ func (rd *repoDispatcher) Take() string {
 	info.lowPriority = false
 	info.highPriority = false
 
-	return repo
+	if !info.full {
+		tagUpdates = info.tagUpdates
+	}
+	info.full = false
+	info.tagUpdates = nil
+
+	return repo, tagUpdates
 }
 
 func (rd *repoDispatcher) Release(repo string) {
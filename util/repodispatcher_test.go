@@ -6,7 +6,7 @@ import (
 )
 
 func expectRepo(t *testing.T, rd *repoDispatcher, expected string) {
-	repo := rd.Take()
+	repo, _ := rd.Take()
 	defer rd.Release(repo)
 	if repo != expected {
 		t.Errorf("Expected '%s', got '%s'", expected, repo)
@@ -23,11 +23,13 @@ func TestRepoDispatcherBasic(t *testing.T) {
 	rd.Add("bar", true)
 	rd.Add("baz", false)
 	expectRepo(t, rd, "baz")
-	rd.Release(rd.Take())
-	rd.Release(rd.Take())
+	repo, _ := rd.Take()
+	rd.Release(repo)
+	repo, _ = rd.Take()
+	rd.Release(repo)
 
 	rd.Add("foo", true)
-	repo := rd.Take()
+	repo, _ = rd.Take()
 	rd.Add("foo", true)
 	rd.Add("bar", true)
 	expectRepo(t, rd, "bar")
@@ -42,7 +44,7 @@ func TestRepoDispatcherLock(t *testing.T) {
 
 	go func() {
 		for i := 0; i < 2; i++ {
-			repo := rd.Take()
+			repo, _ := rd.Take()
 			ch <- true
 			// Busy wait until the main thread has locked
 			locked := false
@@ -70,3 +72,51 @@ func TestRepoDispatcherLock(t *testing.T) {
 		rd.Unlock()
 	}
 }
+
+func expectTagUpdates(t *testing.T, rd *repoDispatcher, expectedRepo string, expectedTags []string) {
+	repo, updates := rd.Take()
+	defer rd.Release(repo)
+	if repo != expectedRepo {
+		t.Errorf("Expected '%s', got '%s'", expectedRepo, repo)
+	}
+	if expectedTags == nil {
+		if updates != nil {
+			t.Errorf("Expected a full fetch, got %v", updates)
+		}
+		return
+	}
+	if len(updates) != len(expectedTags) {
+		t.Errorf("Expected %v, got %v", expectedTags, updates)
+		return
+	}
+	for i := range updates {
+		if updates[i].Tag != expectedTags[i] {
+			t.Errorf("Expected %v, got %v", expectedTags, updates)
+		}
+	}
+}
+
+func TestRepoDispatcherTagUpdates(t *testing.T) {
+	rd := NewRepoDispatcher()
+
+	rd.AddTagUpdate("foo", TagUpdate{Tag: "a"})
+	rd.AddTagUpdate("foo", TagUpdate{Tag: "b"})
+	expectTagUpdates(t, rd, "foo", []string{"a", "b"})
+
+	// A full fetch supersedes tag updates, whichever comes first
+	rd.AddTagUpdate("foo", TagUpdate{Tag: "a"})
+	rd.Add("foo", true)
+	expectTagUpdates(t, rd, "foo", nil)
+
+	rd.Add("foo", true)
+	rd.AddTagUpdate("foo", TagUpdate{Tag: "a"})
+	expectTagUpdates(t, rd, "foo", nil)
+
+	// Updates that arrive while the repository is being fetched are kept
+	// for the next time
+	rd.AddTagUpdate("foo", TagUpdate{Tag: "a"})
+	repo, _ := rd.Take()
+	rd.AddTagUpdate("foo", TagUpdate{Tag: "b"})
+	rd.Release(repo)
+	expectTagUpdates(t, rd, "foo", []string{"b"})
+}
@@ -0,0 +1,222 @@
+// Package vulnerability parses the JSON output of vulnerability scanners
+package vulnerability
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"sort"
+	"strings"
+)
+
+// Supported scanner output formats
+const (
+	FormatTrivy = "trivy"
+	FormatGrype = "grype"
+)
+
+// Report is the result of scanning an image
+type Report struct {
+	// Name and version of the scanner
+	Scanner string
+	// The digest of the scanned image's manifest, if the report says
+	Digest          digest.Digest
+	Vulnerabilities []*flagstate.Vulnerability
+}
+
+type trivyReport struct {
+	SchemaVersion int
+	Metadata      struct {
+		RepoDigests []string
+	}
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID  string
+			PkgName          string
+			InstalledVersion string
+			FixedVersion     string
+			Severity         string
+		}
+	}
+}
+
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			Id       string `json:"id"`
+			Severity string `json:"severity"`
+			Fix      struct {
+				Versions []string `json:"versions"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"artifact"`
+	} `json:"matches"`
+	Source struct {
+		Target struct {
+			ManifestDigest string   `json:"manifestDigest"`
+			RepoDigests    []string `json:"repoDigests"`
+		} `json:"target"`
+	} `json:"source"`
+	Descriptor struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"descriptor"`
+}
+
+// normalizeSeverity converts a scanner's severity to one of the
+// flagstate.Severity constants
+func normalizeSeverity(severity string) string {
+	severity = strings.ToUpper(severity)
+	if severity == "NEGLIGIBLE" {
+		return flagstate.SeverityLow
+	}
+	if _, ok := flagstate.SeverityRank(severity); !ok {
+		return flagstate.SeverityUnknown
+	}
+	return severity
+}
+
+// repoDigest returns the digest from a reference of the form name@digest
+func repoDigest(repoDigests []string) digest.Digest {
+	for _, ref := range repoDigests {
+		if i := strings.LastIndexByte(ref, '@'); i >= 0 {
+			return digest.Digest(ref[i+1:])
+		}
+	}
+	return ""
+}
+
+func parseTrivy(data []byte) (*Report, error) {
+	var parsed trivyReport
+	err := json.Unmarshal(data, &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	report := Report{
+		Scanner: FormatTrivy,
+		Digest:  repoDigest(parsed.Metadata.RepoDigests),
+	}
+	for _, result := range parsed.Results {
+		for _, v := range result.Vulnerabilities {
+			report.Vulnerabilities = append(report.Vulnerabilities, &flagstate.Vulnerability{
+				Id:               v.VulnerabilityID,
+				Package:          v.PkgName,
+				InstalledVersion: v.InstalledVersion,
+				FixedVersion:     v.FixedVersion,
+				Severity:         normalizeSeverity(v.Severity),
+			})
+		}
+	}
+
+	return &report, nil
+}
+
+func parseGrype(data []byte) (*Report, error) {
+	var parsed grypeReport
+	err := json.Unmarshal(data, &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	report := Report{
+		Scanner: FormatGrype,
+		Digest:  digest.Digest(parsed.Source.Target.ManifestDigest),
+	}
+	if parsed.Descriptor.Version != "" {
+		report.Scanner += " " + parsed.Descriptor.Version
+	}
+	if report.Digest == "" {
+		report.Digest = repoDigest(parsed.Source.Target.RepoDigests)
+	}
+	for _, m := range parsed.Matches {
+		report.Vulnerabilities = append(report.Vulnerabilities, &flagstate.Vulnerability{
+			Id:               m.Vulnerability.Id,
+			Package:          m.Artifact.Name,
+			InstalledVersion: m.Artifact.Version,
+			FixedVersion:     strings.Join(m.Vulnerability.Fix.Versions, ", "),
+			Severity:         normalizeSeverity(m.Vulnerability.Severity),
+		})
+	}
+
+	return &report, nil
+}
+
+// detectFormat guesses the format of scanner output from its top-level keys
+func detectFormat(data []byte) (string, error) {
+	var keys map[string]json.RawMessage
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := keys["SchemaVersion"]; ok {
+		return FormatTrivy, nil
+	}
+	if _, ok := keys["matches"]; ok {
+		return FormatGrype, nil
+	}
+
+	return "", fmt.Errorf("Can't determine the format of the scanner output")
+}
+
+// ParseReport parses the JSON output of a scanner. If format is "", it is
+// determined from the contents. The vulnerabilities are sorted, with
+// duplicates removed.
+func ParseReport(data []byte, format string) (*Report, error) {
+	if format == "" {
+		var err error
+		format, err = detectFormat(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var report *Report
+	var err error
+	switch format {
+	case FormatTrivy:
+		report, err = parseTrivy(data)
+	case FormatGrype:
+		report, err = parseGrype(data)
+	default:
+		return nil, fmt.Errorf("Unknown scanner format '%s'", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Digest != "" {
+		err = report.Digest.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Trivy reports the same vulnerability for each target it's found in
+	seen := make(map[flagstate.Vulnerability]bool)
+	vulnerabilities := make([]*flagstate.Vulnerability, 0, len(report.Vulnerabilities))
+	for _, v := range report.Vulnerabilities {
+		if !seen[*v] {
+			seen[*v] = true
+			vulnerabilities = append(vulnerabilities, v)
+		}
+	}
+	sort.Slice(vulnerabilities, func(i, j int) bool {
+		a, b := vulnerabilities[i], vulnerabilities[j]
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.InstalledVersion < b.InstalledVersion
+	})
+	report.Vulnerabilities = vulnerabilities
+
+	return report, nil
+}
@@ -0,0 +1,144 @@
+package vulnerability
+
+import (
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"testing"
+)
+
+var testDigest = digest.Digest("sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+const testTrivy = `{
+  "SchemaVersion": 2,
+  "ArtifactName": "registry.example.com/foo:latest",
+  "ArtifactType": "container_image",
+  "Metadata": {
+    "RepoDigests": ["registry.example.com/foo@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"]
+  },
+  "Results": [
+    {
+      "Target": "registry.example.com/foo:latest (fedora 37)",
+      "Vulnerabilities": [
+        {
+          "VulnerabilityID": "CVE-2023-0286",
+          "PkgName": "openssl-libs",
+          "InstalledVersion": "1:3.0.5-3.fc37",
+          "FixedVersion": "1:3.0.8-1.fc37",
+          "Severity": "HIGH"
+        },
+        {
+          "VulnerabilityID": "CVE-2022-3821",
+          "PkgName": "systemd-libs",
+          "InstalledVersion": "251.7-611.fc37",
+          "Severity": "MEDIUM"
+        }
+      ]
+    },
+    {
+      "Target": "usr/lib/python3.11/site-packages",
+      "Vulnerabilities": [
+        {
+          "VulnerabilityID": "CVE-2023-0286",
+          "PkgName": "openssl-libs",
+          "InstalledVersion": "1:3.0.5-3.fc37",
+          "FixedVersion": "1:3.0.8-1.fc37",
+          "Severity": "HIGH"
+        }
+      ]
+    }
+  ]
+}`
+
+const testGrype = `{
+  "matches": [
+    {
+      "vulnerability": {
+        "id": "CVE-2023-0464",
+        "severity": "Critical",
+        "fix": {"versions": ["3.0.8-r1"], "state": "fixed"}
+      },
+      "artifact": {"name": "libcrypto3", "version": "3.0.7-r0"}
+    },
+    {
+      "vulnerability": {
+        "id": "CVE-2022-1234",
+        "severity": "Negligible",
+        "fix": {"versions": [], "state": "not-fixed"}
+      },
+      "artifact": {"name": "busybox", "version": "1.35.0-r29"}
+    }
+  ],
+  "source": {
+    "type": "image",
+    "target": {
+      "manifestDigest": "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+    }
+  },
+  "descriptor": {"name": "grype", "version": "0.61.0"}
+}`
+
+func expectVulnerabilities(t *testing.T, report *Report, expected ...flagstate.Vulnerability) {
+	if len(report.Vulnerabilities) != len(expected) {
+		t.Fatalf("Expected %d vulnerabilities, got %d", len(expected), len(report.Vulnerabilities))
+	}
+	for i, v := range report.Vulnerabilities {
+		if *v != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], *v)
+		}
+	}
+}
+
+func TestParseTrivy(t *testing.T) {
+	report, err := ParseReport([]byte(testTrivy), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanner != FormatTrivy || report.Digest != testDigest {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	expectVulnerabilities(t, report,
+		flagstate.Vulnerability{
+			Id: "CVE-2022-3821", Package: "systemd-libs", InstalledVersion: "251.7-611.fc37",
+			Severity: flagstate.SeverityMedium,
+		},
+		flagstate.Vulnerability{
+			Id: "CVE-2023-0286", Package: "openssl-libs", InstalledVersion: "1:3.0.5-3.fc37",
+			FixedVersion: "1:3.0.8-1.fc37", Severity: flagstate.SeverityHigh,
+		})
+}
+
+func TestParseGrype(t *testing.T) {
+	report, err := ParseReport([]byte(testGrype), FormatGrype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanner != "grype 0.61.0" || report.Digest != testDigest {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	expectVulnerabilities(t, report,
+		flagstate.Vulnerability{
+			Id: "CVE-2022-1234", Package: "busybox", InstalledVersion: "1.35.0-r29",
+			Severity: flagstate.SeverityLow,
+		},
+		flagstate.Vulnerability{
+			Id: "CVE-2023-0464", Package: "libcrypto3", InstalledVersion: "3.0.7-r0",
+			FixedVersion: "3.0.8-r1", Severity: flagstate.SeverityCritical,
+		})
+}
+
+func TestParseReportErrors(t *testing.T) {
+	_, err := ParseReport([]byte(`{"foo": 1}`), "")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+
+	_, err = ParseReport([]byte(testTrivy), "clair")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+
+	_, err = ParseReport([]byte(`{"matches": [], "source": {"target": {"manifestDigest": "foo"}}}`), "")
+	if err == nil {
+		t.Errorf("Expected an error for an invalid digest")
+	}
+}
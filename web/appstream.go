@@ -0,0 +1,184 @@
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/appstream"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The origin of components in the catalog
+const appstreamOrigin = "flagstate"
+
+type appstreamHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+type appstreamIconHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+// appstreamComponents returns the AppStream components of an image, with
+// links to its icons
+func appstreamComponents(baseUrl string, image *flagstate.Image) ([][]byte, error) {
+	appdata, err := appstream.DecodeAppdata(image.Labels[appstream.LabelAppdata])
+	if err != nil {
+		return nil, err
+	}
+
+	var icons []appstream.Icon
+	for _, size := range appstream.IconSizes(image.Labels) {
+		icons = append(icons, appstream.Icon{
+			Size: size,
+			Url:  fmt.Sprintf("%s/appstream/icons/%s/%d.png", baseUrl, image.Digest, size),
+		})
+	}
+
+	return appstream.ExtractComponents(appdata, icons)
+}
+
+// ServeHTTP returns a gzip-compressed AppStream catalog for the images
+// with an architecture and tag, for example:
+// /appstream?architecture=amd64&tag=latest
+func (ah *appstreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	architecture := r.Form.Get("architecture")
+	tag := r.Form.Get("tag")
+	if architecture == "" || tag == "" {
+		badRequest(w, fmt.Errorf("architecture and tag must be specified"))
+		return
+	}
+
+	SetCacheControl(w, ah.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(ah.db, w, r) {
+		return
+	}
+
+	q := database.NewQuery().Architecture(architecture).Tag(tag).LabelExists(appstream.LabelAppdata)
+
+	ctx := context.Background()
+	repos, err := ah.db.DoQuery(ctx, q)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	// The same image is often tagged in several repositories, or is in
+	// several lists, but should only be in the catalog once
+	var images []*flagstate.Image
+	seen := make(map[digest.Digest]bool)
+	addImage := func(image *flagstate.Image) {
+		if !seen[image.Digest] {
+			seen[image.Digest] = true
+			images = append(images, image)
+		}
+	}
+	for _, repo := range repos {
+		for _, image := range repo.Images {
+			addImage(&image.Image)
+		}
+		for _, list := range repo.Lists {
+			for _, image := range list.Images {
+				addImage(image)
+			}
+		}
+	}
+
+	baseUrl := publicUrl(ah.config, r)
+	var components [][]byte
+	for _, image := range images {
+		c, err := appstreamComponents(baseUrl, image)
+		if err != nil {
+			// One broken image shouldn't break the catalog
+			log.Printf("Can't get AppStream data for %s: %v", image.Digest, err)
+			continue
+		}
+		components = append(components, c...)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	err = appstream.WriteCollection(gz, appstreamOrigin, architecture, components)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// ServeHTTP returns an icon from the labels of an image, as
+// /appstream/icons/<digest>/<size>.png
+func (aih *appstreamIconHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/appstream/icons/"), "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[1], ".png") {
+		notFound(w, fmt.Errorf("Invalid icon path"))
+		return
+	}
+	dgst, err := digest.ParseDigest(parts[0])
+	if err != nil {
+		notFound(w, err)
+		return
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(parts[1], ".png"))
+	if err != nil {
+		notFound(w, fmt.Errorf("Invalid icon size"))
+		return
+	}
+
+	// The labels of an image can't change, so neither can its icons
+	setImmutableCacheControl(w)
+	if checkAndSetETagValue(w, r, fmt.Sprintf(`"%s-%d"`, dgst.Hex(), size)) {
+		return
+	}
+
+	ctx := context.Background()
+	image, err := database.GetImage(ctx, aih.db, dgst)
+	if err == database.ErrImageNotFound {
+		notFound(w, err)
+		return
+	} else if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	icon, err := appstream.DecodeIcon(image.Labels, size)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if icon == nil {
+		notFound(w, fmt.Errorf("No %dx%d icon for %s", size, size, dgst))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(icon)))
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write(icon)
+	if err != nil {
+		log.Print(err)
+	}
+}
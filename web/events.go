@@ -6,8 +6,8 @@ import (
 	"github.com/docker/distribution/notifications"
 	"github.com/owtaylor/flagstate"
 	"github.com/owtaylor/flagstate/fetcher"
+	"github.com/owtaylor/flagstate/util"
 	"net/http"
-	"strings"
 )
 
 type eventHandler struct {
@@ -26,22 +26,8 @@ func (eh *eventHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if eh.config.Events.Token != "" {
-		authorized := false
-		for _, header := range r.Header["Authorization"] {
-			fields := strings.Fields(header)
-			if fields[0] == "Bearer" && fields[1] == eh.config.Events.Token {
-				authorized = true
-			}
-		}
-		if !authorized {
-			w.Header().Set("Content-Type", "text/plain")
-			// We violate the HTTP spec by not including WWW-Authenticate, but
-			// there's nothing meaningful to provide
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprintf(w, "No/incorrect authorization token provided\n")
-			return
-		}
+	if eh.config.Events.Token != "" && !checkBearerToken(w, r, eh.config.Events.Token) {
+		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -54,8 +40,16 @@ func (eh *eventHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, event := range body.Events {
 		switch event.Action {
 		case notifications.EventActionPush, notifications.EventActionDelete:
-			eh.fetcher.FetchRepository(event.Target.Repository)
-			break
+			if event.Target.Tag == "" && event.Target.Digest == "" {
+				eh.fetcher.FetchRepository(event.Target.Repository)
+				break
+			}
+			eh.fetcher.FetchTag(event.Target.Repository, util.TagUpdate{
+				Tag:       event.Target.Tag,
+				Digest:    event.Target.Digest,
+				MediaType: event.Target.MediaType,
+				Deleted:   event.Action == notifications.EventActionDelete,
+			})
 		}
 	}
 }
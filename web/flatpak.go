@@ -0,0 +1,189 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/appstream"
+	"github.com/owtaylor/flagstate/database"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type flatpakRepoHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+type flatpakRefHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+// flatpakRemoteUrl returns the URL of the OCI remote, the registry's public
+// URL resolved against flagstate's own URL. Flatpak finds the index by
+// adding /index/static, so the registry and flagstate are expected to be
+// joined into a single web presence.
+func flatpakRemoteUrl(config *flagstate.Config, r *http.Request) (string, error) {
+	registryUrl := config.Registry.PublicUrl
+	if registryUrl == "" {
+		registryUrl = config.Registry.Url
+	}
+
+	base, err := url.Parse(publicUrl(config, r) + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(registryUrl)
+	if err != nil {
+		return "", err
+	}
+
+	return "oci+" + strings.TrimSuffix(base.ResolveReference(ref).String(), "/"), nil
+}
+
+// writeKeyFile writes a group of a key file, skipping keys with empty
+// values. keys and values alternate.
+func writeKeyFile(w io.Writer, group string, keysAndValues ...string) {
+	fmt.Fprintf(w, "[%s]\n", group)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		value := strings.Join(strings.Fields(keysAndValues[i+1]), " ")
+		if value != "" {
+			fmt.Fprintf(w, "%s=%s\n", keysAndValues[i], value)
+		}
+	}
+}
+
+// ServeHTTP returns a .flatpakrepo file for adding the registry as a
+// remote, as /flatpak/repo.flatpakrepo
+func (frh *flatpakRepoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteUrl, err := flatpakRemoteUrl(frh.config, r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	SetCacheControl(w, frh.config.Cache.MaxAgeIndex.Value, false)
+
+	w.Header().Set("Content-Type", "application/vnd.flatpak.repo")
+	w.WriteHeader(http.StatusOK)
+
+	writeKeyFile(w, "Flatpak Repo",
+		"Title", frh.config.Flatpak.Title,
+		"Url", remoteUrl)
+}
+
+// flatpakRefImage finds an image of the given Flatpak application or
+// runtime, preferring one with AppStream data
+func flatpakRefImage(ctx context.Context, db database.Database, kind string, id string, branch string) (*flagstate.Image, error) {
+	repos, err := db.DoQuery(ctx, database.NewQuery().FlatpakId(id).FlatpakBranch(branch))
+	if err != nil {
+		return nil, err
+	}
+
+	var result *flagstate.Image
+	check := func(image *flagstate.Image) {
+		if image.Flatpak == nil || image.Flatpak.Kind != kind {
+			return
+		}
+		if result == nil || result.Labels[appstream.LabelAppdata] == "" {
+			result = image
+		}
+	}
+	for _, repo := range repos {
+		for _, image := range repo.Images {
+			check(&image.Image)
+		}
+		for _, list := range repo.Lists {
+			for _, image := range list.Images {
+				check(image)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ServeHTTP returns a .flatpakref file for installing an application or
+// runtime, as /flatpak/<app|runtime>/<id>/<branch>.flatpakref
+func (frh *flatpakRefHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/flatpak/"), "/")
+	if len(parts) != 3 || (parts[0] != "app" && parts[0] != "runtime") ||
+		!strings.HasSuffix(parts[2], ".flatpakref") {
+		notFound(w, fmt.Errorf("Invalid Flatpak ref path"))
+		return
+	}
+	kind, id, branch := parts[0], parts[1], strings.TrimSuffix(parts[2], ".flatpakref")
+
+	remoteUrl, err := flatpakRemoteUrl(frh.config, r)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	SetCacheControl(w, frh.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(frh.db, w, r) {
+		return
+	}
+
+	ctx := context.Background()
+	image, err := flatpakRefImage(ctx, frh.db, kind, id, branch)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if image == nil {
+		notFound(w, fmt.Errorf("%s/%s/%s not found", kind, id, branch))
+		return
+	}
+
+	title := image.Title()
+	homepage := image.Annotations["org.opencontainers.image.url"]
+	if homepage == "" {
+		homepage = image.Labels["org.opencontainers.image.url"]
+	}
+	if label := image.Labels[appstream.LabelAppdata]; label != "" {
+		var component *appstream.Component
+		appdata, err := appstream.DecodeAppdata(label)
+		if err == nil {
+			component, err = appstream.ParseComponent(appdata)
+		}
+		if err != nil {
+			log.Printf("Can't parse AppStream data for %s: %v", image.Digest, err)
+		} else if component != nil {
+			if title == "" {
+				title = component.Name
+			}
+			if homepage == "" {
+				homepage = component.Homepage
+			}
+		}
+	}
+
+	icon := ""
+	if sizes := appstream.IconSizes(image.Labels); len(sizes) > 0 {
+		icon = fmt.Sprintf("%s/appstream/icons/%s/%d.png",
+			publicUrl(frh.config, r), image.Digest, sizes[len(sizes)-1])
+	}
+
+	isRuntime := "false"
+	if kind == "runtime" {
+		isRuntime = "true"
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.flatpak.ref")
+	w.WriteHeader(http.StatusOK)
+
+	writeKeyFile(w, "Flatpak Ref",
+		"Name", id,
+		"Branch", branch,
+		"Title", title,
+		"Url", remoteUrl,
+		"Homepage", homepage,
+		"Icon", icon,
+		"IsRuntime", isRuntime,
+		"SuggestRemoteName", frh.config.Flatpak.RemoteName)
+}
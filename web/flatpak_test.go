@@ -0,0 +1,42 @@
+package web
+
+import (
+	"bytes"
+	"github.com/owtaylor/flagstate"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFlatpakRemoteUrl(t *testing.T) {
+	r := httptest.NewRequest("GET", "https://flagstate.example.com/flatpak/repo.flatpakrepo", nil)
+
+	for _, tc := range []struct{ url, publicUrl, expected string }{
+		{"https://registry.example.com", "", "oci+https://registry.example.com"},
+		{"http://registry:5000", "/", "oci+https://flagstate.example.com"},
+		{"http://registry:5000", "https://registry.example.com/", "oci+https://registry.example.com"},
+	} {
+		var config flagstate.Config
+		config.Registry.Url = tc.url
+		config.Registry.PublicUrl = tc.publicUrl
+		remoteUrl, err := flatpakRemoteUrl(&config, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remoteUrl != tc.expected {
+			t.Errorf("Expected %s, got %s", tc.expected, remoteUrl)
+		}
+	}
+}
+
+func TestWriteKeyFile(t *testing.T) {
+	var buf bytes.Buffer
+	writeKeyFile(&buf, "Flatpak Ref",
+		"Name", "org.gnome.Maps",
+		"Title", "Maps\nand more",
+		"Homepage", "")
+
+	expected := "[Flatpak Ref]\nName=org.gnome.Maps\nTitle=Maps and more\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
@@ -2,11 +2,13 @@ package web
 
 import (
 	"context"
+	"fmt"
 	"github.com/owtaylor/flagstate"
 	"github.com/owtaylor/flagstate/database"
 	"html/template"
 	"log"
 	"net/http"
+	"strings"
 )
 
 type homeHandler struct {
@@ -16,9 +18,28 @@ type homeHandler struct {
 
 var homeTemplate *template.Template
 
+// formatSize formats a size in bytes in human-readable binary units
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		value /= 1024
+		if value < 1024 {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+
+	return fmt.Sprintf("%.1f TiB", value/1024)
+}
+
 func init() {
 	var err error
-	homeTemplate, err = template.New("foo").Parse(repositoriesHtmlTemplate)
+	homeTemplate, err = template.New("foo").Funcs(template.FuncMap{
+		"formatSize": formatSize,
+	}).Parse(repositoriesHtmlTemplate)
 	if err != nil {
 		panic(err)
 	}
@@ -30,8 +51,20 @@ func (hh *homeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var body struct {
+		Query   string
+		Results []*flagstate.Repository
+	}
+
+	q := database.NewQuery().IncludeConfig().IncludeFailedTags()
+	body.Query = strings.TrimSpace(r.FormValue("q"))
+	if body.Query != "" {
+		q.Search(body.Query)
+	}
+
 	ctx := context.Background()
-	results, err := hh.db.DoQuery(ctx, database.NewQuery())
+	var err error
+	body.Results, err = hh.db.DoQuery(ctx, q)
 	if err != nil {
 		internalError(w, err)
 		return
@@ -40,7 +73,7 @@ func (hh *homeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
 
-	err = homeTemplate.Execute(w, results)
+	err = homeTemplate.Execute(w, &body)
 	if err != nil {
 		log.Print(err)
 	}
@@ -0,0 +1,66 @@
+package web
+
+import (
+	"bytes"
+	"github.com/owtaylor/flagstate"
+	"strings"
+	"testing"
+)
+
+func TestFormatSize(t *testing.T) {
+	for _, c := range []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024, "5.0 MiB"},
+		{3 * 1024 * 1024 * 1024 * 1024, "3.0 TiB"},
+	} {
+		result := formatSize(c.size)
+		if result != c.expected {
+			t.Errorf("formatting %d, expected %s, got %s", c.size, c.expected, result)
+		}
+	}
+}
+
+func TestHomeTemplateSearch(t *testing.T) {
+	var buf bytes.Buffer
+	err := homeTemplate.Execute(&buf, &struct {
+		Query   string
+		Results []*flagstate.Repository
+	}{Query: "<backup>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `value="&lt;backup&gt;"`) ||
+		!strings.Contains(buf.String(), "No repositories match") {
+		t.Errorf("Unexpected output %s", buf.String())
+	}
+}
+
+func TestHomeTemplateListVulnerabilities(t *testing.T) {
+	image := &flagstate.Image{Digest: "sha256:1234", Architecture: "arm64"}
+	image.Vulnerabilities = &flagstate.VulnerabilitySummary{}
+	image.Vulnerabilities.Critical = 2
+
+	var buf bytes.Buffer
+	err := homeTemplate.Execute(&buf, &struct {
+		Query   string
+		Results []*flagstate.Repository
+	}{Results: []*flagstate.Repository{{
+		Name: "foo",
+		Lists: []*flagstate.TaggedImageList{{
+			ImageList: flagstate.ImageList{Images: []*flagstate.Image{image}},
+			Tags:      []string{"latest"},
+		}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "vulnerabilities: 2 critical, 0 high") {
+		t.Errorf("Unexpected output %s", buf.String())
+	}
+}
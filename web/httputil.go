@@ -1,6 +1,7 @@
 package web
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"github.com/owtaylor/flagstate"
 	"github.com/owtaylor/flagstate/database"
@@ -70,6 +71,20 @@ func CheckAndSetETag(db database.Database, w http.ResponseWriter, r *http.Reques
 	// data generated with the old build.
 	etag := `"` + flagstate.BuildId + "-" + modificationTime.Format(time.RFC3339Nano) + `"`
 
+	return checkAndSetETagValue(w, r, etag)
+}
+
+// Content identified by a digest never changes, so it can be cached for as
+// long as a cache is willing to keep it
+const maxAgeImmutable = 365 * 24 * time.Hour
+
+func setImmutableCacheControl(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v, immutable", int(maxAgeImmutable.Seconds())))
+}
+
+// checkAndSetETagValue is like CheckAndSetETag, for responses that have an
+// ETag of their own rather than one for the whole database
+func checkAndSetETagValue(w http.ResponseWriter, r *http.Request, etag string) bool {
 	for _, val := range r.Header["If-None-Match"] {
 		candidates, err := ParseIfMatch(val)
 		if err != nil {
@@ -90,6 +105,45 @@ func CheckAndSetETag(db database.Database, w http.ResponseWriter, r *http.Reques
 	return false
 }
 
+// publicUrl returns the URL that flagstate is reachable at, without a
+// trailing slash
+func publicUrl(config *flagstate.Config, r *http.Request) string {
+	if config.PublicUrl != "" {
+		return strings.TrimSuffix(config.PublicUrl, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// Set by a front-end proxy terminating TLS
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// checkBearerToken checks that the request has an "Authorization: Bearer"
+// header with token, and if not, writes an error response and returns false
+func checkBearerToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	for _, header := range r.Header["Authorization"] {
+		fields := strings.Fields(header)
+		if len(fields) == 2 && fields[0] == "Bearer" &&
+			subtle.ConstantTimeCompare([]byte(fields[1]), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	// We violate the HTTP spec by not including WWW-Authenticate, but
+	// there's nothing meaningful to provide
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, "No/incorrect authorization token provided\n")
+
+	return false
+}
+
 func internalError(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusInternalServerError)
@@ -103,3 +157,9 @@ func badRequest(w http.ResponseWriter, err error) {
 	log.Print(err)
 	fmt.Fprintf(w, "Error: %v\n", err)
 }
+
+func notFound(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "Error: %v\n", err)
+}
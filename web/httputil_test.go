@@ -1,6 +1,9 @@
 package web
 
 import (
+	"github.com/owtaylor/flagstate"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -60,3 +63,38 @@ func TestParseIfMatch(t *testing.T) {
 	expectParseIfMatchError(t, `"foo`)
 	expectParseIfMatchError(t, `"foo" "bar"`)
 }
+
+func TestPublicUrl(t *testing.T) {
+	var config flagstate.Config
+	r := httptest.NewRequest("GET", "http://flagstate.example.com/appstream", nil)
+	if u := publicUrl(&config, r); u != "http://flagstate.example.com" {
+		t.Errorf("Unexpected URL %s", u)
+	}
+
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if u := publicUrl(&config, r); u != "https://flagstate.example.com" {
+		t.Errorf("Unexpected URL %s", u)
+	}
+
+	config.PublicUrl = "https://registry.example.com/flagstate/"
+	if u := publicUrl(&config, r); u != "https://registry.example.com/flagstate" {
+		t.Errorf("Unexpected URL %s", u)
+	}
+}
+
+func TestCheckAndSetETagValue(t *testing.T) {
+	r := httptest.NewRequest("GET", "/appstream/icons/sha256:abcd/64.png", nil)
+	w := httptest.NewRecorder()
+	if checkAndSetETagValue(w, r, `"abcd-64"`) {
+		t.Fatalf("Expected a full response")
+	}
+	if w.Header().Get("ETag") != `"abcd-64"` {
+		t.Errorf("Unexpected ETag %q", w.Header().Get("ETag"))
+	}
+
+	r.Header.Set("If-None-Match", `"abcd-128", "abcd-64"`)
+	w = httptest.NewRecorder()
+	if !checkAndSetETagValue(w, r, `"abcd-64"`) || w.Code != http.StatusNotModified {
+		t.Errorf("Expected Not Modified, got %d", w.Code)
+	}
+}
@@ -3,11 +3,14 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
 	"github.com/owtaylor/flagstate"
 	"github.com/owtaylor/flagstate/database"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type indexHandler struct {
@@ -16,6 +19,22 @@ type indexHandler struct {
 	dynamic bool
 }
 
+// parseTime parses a time in a query parameter, either as a full RFC 3339
+// timestamp, or as a date (interpreted as midnight UTC)
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.Parse("2006-01-02", s)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("Cannot parse '%s' as a date or time", s)
+}
+
 func (ih *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Registry string
@@ -39,6 +58,10 @@ func (ih *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for k, v := range r.Form {
 		for _, vv := range v {
 			switch k {
+			case "q":
+				if vv != "" {
+					q.Search(vv)
+				}
 			case "repository":
 				q.Repository(vv)
 			case "tag":
@@ -47,9 +70,119 @@ func (ih *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				q.TagMatches(vv)
 			case "os":
 				q.OS(vv)
+			case "os.version":
+				q.OSVersion(vv)
+			case "os.version:matches":
+				q.OSVersionMatches(vv)
+			case "os.feature":
+				q.OSFeature(vv)
 			case "architecture":
 				q.Architecture(vv)
+			case "variant":
+				q.Variant(vv)
+			case "media_type":
+				q.MediaType(vv)
+			case "artifact_type":
+				q.ArtifactType(vv)
+			case "based_on":
+				dgst, err := digest.ParseDigest(vv)
+				if err != nil {
+					badRequest(w, err)
+					return
+				}
+				q.BasedOn(dgst)
+			case "created:before", "created:after", "pushed:before", "pushed:after":
+				t, err := parseTime(vv)
+				if err != nil {
+					badRequest(w, err)
+					return
+				}
+				switch k {
+				case "created:before":
+					q.CreatedBefore(t)
+				case "created:after":
+					q.CreatedAfter(t)
+				case "pushed:before":
+					q.PushedBefore(t)
+				case "pushed:after":
+					q.PushedAfter(t)
+				}
+			case "sort":
+				descending := strings.HasPrefix(vv, "-")
+				switch strings.TrimPrefix(vv, "-") {
+				case "created":
+					q.Sort(database.SortCreated, descending)
+				case "pushed":
+					q.Sort(database.SortPushed, descending)
+				default:
+					badRequest(w, fmt.Errorf("Unknown sort key '%s'", vv))
+					return
+				}
+			case "max_severity:below", "max_severity:atleast":
+				if _, ok := flagstate.SeverityRank(vv); !ok {
+					badRequest(w, fmt.Errorf("Invalid severity '%s'", vv))
+					return
+				}
+				if k == "max_severity:below" {
+					q.MaxSeverityBelow(vv)
+				} else {
+					q.MaxSeverityAtLeast(vv)
+				}
+			case "signed_by":
+				q.SignedBy(vv)
+			case "flatpak:id":
+				q.FlatpakId(vv)
+			case "flatpak:branch":
+				q.FlatpakBranch(vv)
+			case "flatpak:runtime":
+				q.FlatpakRuntime(vv)
+			case "flatpak:runtime:matches":
+				q.FlatpakRuntimeMatches(vv)
+			case "flatpak:sdk":
+				q.FlatpakSdk(vv)
+			case "flatpak:shared":
+				q.FlatpakShared(vv)
+			case "flatpak:socket":
+				q.FlatpakSocket(vv)
+			case "flatpak:device":
+				q.FlatpakDevice(vv)
+			case "flatpak:filesystem":
+				q.FlatpakFilesystem(vv)
+			case "flatpak:extension":
+				q.FlatpakExtension(vv)
+			case "has":
+				switch vv {
+				case "signature":
+					q.HasSignature()
+				case "sbom":
+					q.HasSBOM()
+				default:
+					badRequest(w, fmt.Errorf("Unknown has value '%s'", vv))
+					return
+				}
+			case "include":
+				switch vv {
+				case "config":
+					q.IncludeConfig()
+				case "layers":
+					q.IncludeLayers()
+				case "failed_tags":
+					q.IncludeFailedTags()
+				}
 			default:
+				if strings.HasPrefix(k, "os_release:") {
+					key := strings.TrimPrefix(k, "os_release:")
+					if strings.HasSuffix(key, ":exists") {
+						if vv == "1" {
+							q.OSReleaseExists(strings.TrimSuffix(key, ":exists"))
+						}
+					} else if strings.HasSuffix(key, ":matches") {
+						q.OSReleaseMatches(strings.TrimSuffix(key, ":matches"), vv)
+					} else {
+						q.OSReleaseIs(key, vv)
+					}
+					continue
+				}
 				is_annotation := false
 				if strings.HasPrefix(k, "annotation:") {
 					k = strings.TrimPrefix(k, "annotation:")
@@ -0,0 +1,30 @@
+package web
+
+import (
+	"testing"
+	"time"
+)
+
+func expectParseTime(t *testing.T, input string, expected time.Time) {
+	res, err := parseTime(input)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !res.Equal(expected) {
+		t.Errorf("parsing %v, expected %v, got %v", input, expected, res)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	expectParseTime(t, "2026-01-01", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	expectParseTime(t, "2026-01-01T12:30:00Z", time.Date(2026, 1, 1, 12, 30, 0, 0, time.UTC))
+	expectParseTime(t, "2026-01-01T12:30:00-05:00", time.Date(2026, 1, 1, 17, 30, 0, 0, time.UTC))
+
+	for _, input := range []string{"", "yesterday", "2026-13-01", "01/01/2026"} {
+		_, err := parseTime(input)
+		if err == nil {
+			t.Errorf("parsing %v, expected error", input)
+		}
+	}
+}
@@ -29,6 +29,12 @@ func (wi *WebInterface) Start() {
 			changes: wi.Changes,
 		})
 	}
+	if wi.Config.Vulnerabilities.ImportToken != "" {
+		http.Handle("/vulnerabilities", &vulnerabilityImportHandler{
+			config: wi.Config,
+			db:     wi.DB,
+		})
+	}
 	http.Handle("/index/static", &indexHandler{
 		config: wi.Config,
 		db:     wi.DB,
@@ -38,7 +44,55 @@ func (wi *WebInterface) Start() {
 		db:      wi.DB,
 		dynamic: true,
 	})
+	http.Handle("/resolve", &resolveHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/lineage", &lineageHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/appstream", &appstreamHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/appstream/icons/", &appstreamIconHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/flatpak/repo.flatpakrepo", &flatpakRepoHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/flatpak/", &flatpakRefHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/v1/search", &searchHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/v1/_ping", &pingHandler{})
+	http.Handle("/packages", &packagesHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/report/storage", &storageReportHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/report/vulnerabilities", &vulnerabilityReportHandler{
+		config: wi.Config,
+		db:     wi.DB,
+	})
+	http.Handle("/status", &statusHandler{
+		db: wi.DB,
+	})
 	if wi.Config.Components.WebUI {
+		http.Handle("/status.html", &statusHandler{
+			db:   wi.DB,
+			html: true,
+		})
 		http.Handle("/", &homeHandler{
 			config: wi.Config,
 			db:     wi.DB,
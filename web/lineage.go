@@ -0,0 +1,56 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"net/http"
+)
+
+type lineageHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+func (lh *lineageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	s := r.Form.Get("digest")
+	if s == "" {
+		badRequest(w, fmt.Errorf("digest must be specified"))
+		return
+	}
+	dgst, err := digest.ParseDigest(s)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	SetCacheControl(w, lh.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(lh.db, w, r) {
+		return
+	}
+
+	ctx := context.Background()
+	ancestry, err := database.GetAncestry(ctx, lh.db, dgst)
+	if err == database.ErrImageNotFound {
+		notFound(w, err)
+		return
+	} else if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(ancestry)
+	if err != nil {
+		log.Print(err)
+	}
+}
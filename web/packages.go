@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"net/http"
+)
+
+type packagesHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+// ServeHTTP finds the tags of the images that contain a package, for
+// example: /packages?name=openssl&version:before=3.0.7
+func (ph *packagesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	if r.Form.Get("name") == "" && r.Form.Get("purl") == "" {
+		badRequest(w, fmt.Errorf("name or purl must be specified"))
+		return
+	}
+
+	q := database.NewQuery()
+	for k, v := range r.Form {
+		for _, vv := range v {
+			switch k {
+			case "repository":
+				q.Repository(vv)
+			case "name":
+				q.PackageName(vv)
+			case "version":
+				q.PackageVersion(vv)
+			case "version:before":
+				q.PackageVersionBefore(vv)
+			case "version:after":
+				q.PackageVersionAfter(vv)
+			case "purl":
+				q.PackagePurl(vv)
+			default:
+				badRequest(w, fmt.Errorf("Unknown parameter '%s'", k))
+				return
+			}
+		}
+	}
+
+	SetCacheControl(w, ph.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(ph.db, w, r) {
+		return
+	}
+
+	ctx := context.Background()
+	tags, err := database.GetAffectedTags(ctx, ph.db, q)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(tags)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type storageReportHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+func (sh *storageReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	namespaceDepth := 0
+	if s := r.Form.Get("namespace_depth"); s != "" {
+		var err error
+		namespaceDepth, err = strconv.Atoi(s)
+		if err != nil || namespaceDepth < 0 {
+			badRequest(w, fmt.Errorf("Invalid namespace_depth '%s'", s))
+			return
+		}
+	}
+
+	SetCacheControl(w, sh.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(sh.db, w, r) {
+		return
+	}
+
+	ctx := context.Background()
+	report, err := database.GetStorageReport(ctx, sh.db, namespaceDepth)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(report)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"net/http"
+)
+
+type resolveHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+func (rh *resolveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	repository := r.Form.Get("repository")
+	tag := r.Form.Get("tag")
+	if repository == "" || tag == "" {
+		badRequest(w, fmt.Errorf("repository and tag must be specified"))
+		return
+	}
+
+	var platform flagstate.Platform
+	if s := r.Form.Get("platform"); s != "" {
+		var err error
+		platform, err = flagstate.ParsePlatform(s)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	} else {
+		platform.OS = r.Form.Get("os")
+		platform.Architecture = r.Form.Get("architecture")
+		platform.Variant = r.Form.Get("variant")
+	}
+	platform.OSVersion = r.Form.Get("os.version")
+
+	if platform.OS == "" {
+		badRequest(w, fmt.Errorf("platform or os must be specified"))
+		return
+	}
+
+	SetCacheControl(w, rh.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(rh.db, w, r) {
+		return
+	}
+
+	ctx := context.Background()
+	result, err := database.ResolvePlatform(ctx, rh.db, repository, tag, platform)
+	if err == database.ErrTagNotFound || err == database.ErrNoMatchingPlatform {
+		notFound(w, err)
+		return
+	} else if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(result)
+	if err != nil {
+		log.Print(err)
+	}
+}
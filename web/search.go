@@ -0,0 +1,144 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Page sizes for /v1/search, matching the Docker Hub, and a limit on the
+// page number that keeps the offset of the page from overflowing
+const (
+	defaultSearchPageSize = 25
+	maxSearchPageSize     = 100
+	maxSearchPage         = 100000
+)
+
+type searchHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+type pingHandler struct {
+}
+
+type searchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StarCount   int    `json:"star_count"`
+	IsOfficial  bool   `json:"is_official"`
+	IsAutomated bool   `json:"is_automated"`
+}
+
+type searchResponse struct {
+	Query      string          `json:"query"`
+	NumResults int             `json:"num_results"`
+	NumPages   int             `json:"num_pages"`
+	Page       int             `json:"page"`
+	PageSize   int             `json:"page_size"`
+	Results    []*searchResult `json:"results"`
+}
+
+// parseSearchPage returns the page size and the 1-based page number from
+// the n and page parameters of a search
+func parseSearchPage(form url.Values) (int, int, error) {
+	pageSize := defaultSearchPageSize
+	if s := form.Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("Invalid page size %q", s)
+		}
+		pageSize = n
+		if pageSize > maxSearchPageSize {
+			pageSize = maxSearchPageSize
+		}
+	}
+
+	page := 1
+	if s := form.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchPage {
+			return 0, 0, fmt.Errorf("Invalid page %q", s)
+		}
+		page = n
+	}
+
+	return pageSize, page, nil
+}
+
+// makeSearchResponse converts the results of a search to the form the
+// Docker client expects. Like on the Docker Hub, repositories without a
+// namespace are official.
+func makeSearchResponse(query string, pageSize int, page int, results []*database.SearchResult, total int) *searchResponse {
+	response := searchResponse{
+		Query:      query,
+		NumResults: total,
+		NumPages:   (total + pageSize - 1) / pageSize,
+		Page:       page,
+		PageSize:   pageSize,
+		Results:    make([]*searchResult, 0, len(results)),
+	}
+	for _, result := range results {
+		response.Results = append(response.Results, &searchResult{
+			Name:        result.Repository,
+			Description: result.Description,
+			IsOfficial:  !strings.Contains(result.Repository, "/"),
+		})
+	}
+
+	return &response
+}
+
+// ServeHTTP implements the /v1/search API used by docker search, for
+// example: /v1/search?q=maps&n=25&page=1
+func (sh *searchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	query := r.Form.Get("q")
+	pageSize, page, err := parseSearchPage(r.Form)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	SetCacheControl(w, sh.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(sh.db, w, r) {
+		return
+	}
+
+	ctx := context.Background()
+	results, total, err := database.SearchRepositories(ctx, sh.db, query, (page-1)*pageSize, pageSize)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(makeSearchResponse(query, pageSize, page, results, total))
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// ServeHTTP answers the /v1/_ping request the Docker client makes before
+// searching, identifying flagstate as a standalone registry
+func (ph *pingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Docker-Registry-Standalone", "true")
+	w.WriteHeader(http.StatusOK)
+
+	_, err := w.Write([]byte(`{"standalone":true}` + "\n"))
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"github.com/owtaylor/flagstate/database"
+	"net/url"
+	"testing"
+)
+
+func TestParseSearchPage(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		pageSize int
+		page     int
+	}{
+		{"q=maps", 25, 1},
+		{"q=maps&n=10&page=3", 10, 3},
+		{"q=maps&n=1000", 100, 1},
+	} {
+		form, _ := url.ParseQuery(tc.query)
+		pageSize, page, err := parseSearchPage(form)
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+		} else if pageSize != tc.pageSize || page != tc.page {
+			t.Errorf("%s: expected %d/%d, got %d/%d", tc.query, tc.pageSize, tc.page, pageSize, page)
+		}
+	}
+
+	for _, query := range []string{"n=0", "n=x", "page=0", "page=-1", "page=100001", "page=9223372036854775807"} {
+		form, _ := url.ParseQuery(query)
+		_, _, err := parseSearchPage(form)
+		if err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestMakeSearchResponse(t *testing.T) {
+	response := makeSearchResponse("maps", 2, 1, []*database.SearchResult{
+		{Repository: "maps", Title: "Maps", Description: "Find places"},
+		{Repository: "owtaylor/maps", Title: "Maps"},
+	}, 3)
+
+	if response.NumResults != 3 || response.NumPages != 2 || len(response.Results) != 2 {
+		t.Fatalf("Unexpected response %+v", response)
+	}
+	if r := response.Results[0]; r.Name != "maps" || r.Description != "Find places" || !r.IsOfficial {
+		t.Errorf("Unexpected result %+v", r)
+	}
+	if r := response.Results[1]; r.Name != "owtaylor/maps" || r.Description != "" || r.IsOfficial {
+		t.Errorf("Unexpected result %+v", r)
+	}
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/owtaylor/flagstate/database"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+type statusHandler struct {
+	db   database.Database
+	html bool
+}
+
+var statusTemplate *template.Template
+
+func init() {
+	var err error
+	statusTemplate, err = template.New("status").Parse(statusHtmlTemplate)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (sh *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	// The fetch status isn't part of the modification time used for
+	// ETags, so we can't cache this
+	SetCacheControl(w, 0, true)
+
+	unhealthyOnly := sh.html || r.Form.Get("all") != "1"
+
+	ctx := context.Background()
+	statuses, err := database.GetFetchStatus(ctx, sh.db, unhealthyOnly)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	if sh.html {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+
+		err = statusTemplate.Execute(w, statuses)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(w)
+		err = encoder.Encode(statuses)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
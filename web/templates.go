@@ -27,9 +27,21 @@ li.list {
     padding: 4px;
     margin-bottom: 8px;
 }
+li.artifact {
+    border: 1px solid #aaaaaa;
+    background: #f0f8ff;
+    padding: 4px;
+    margin-bottom: 8px;
+}
 li {
     list-style-type: none;
 }
+li.failed {
+    border: 1px solid #cc6666;
+    background: #fff0f0;
+    padding: 4px;
+    margin-bottom: 8px;
+}
 li.list ul {
    padding: 0px;
 }
@@ -44,9 +56,20 @@ ul {
   </script>
 </head>
 <body>
+<p><a href="/status.html">Repositories with fetch errors</a></p>
+<p><a href="/flatpak/repo.flatpakrepo">Add as a Flatpak remote</a></p>
+<form action="/" method="get">
+<input type="search" name="q" value="{{.Query}}" placeholder="Search repositories">
+<input type="submit" value="Search">
+{{if .Query}}<a href="/">Show all</a>{{end}}
+</form>
+{{if and .Query (not .Results)}}<p>No repositories match '{{.Query}}'</p>{{end}}
 {{define "Image" -}}
 digest: {{.Digest}}
-mediaType: {{.MediaType}}
+mediaType: {{.MediaType}}{{if .NeedsMigration}} (deprecated, needs migration){{end}}
+{{- with .Size }}
+size: {{formatSize .}}
+{{- end }}
 {{- with .Title }}
 title: {{.}}
 {{- end }}
@@ -54,7 +77,51 @@ title: {{.}}
 description: {{.}}
 {{- end }}
 architecture: {{.Architecture}}
+{{- with .Variant }}
+variant: {{.}}
+{{- end }}
 os: {{.OS}}
+{{- with .OSVersion }}
+os.version: {{.}}
+{{- end }}
+{{- with .OSFeatures }}
+os.features: {{range $i, $f := .}}{{if $i}}, {{end}}{{$f}}{{end}}
+{{- end }}
+{{- with .Created }}
+created: {{.Format "2006-01-02 15:04:05 MST"}}
+{{- end }}
+{{- with .Author }}
+author: {{.}}
+{{- end }}
+{{- with .Config }}
+{{- with .Entrypoint }}
+entrypoint: {{range $i, $v := .}}{{if $i}} {{end}}{{$v}}{{end}}
+{{- end }}
+{{- with .Cmd }}
+cmd: {{range $i, $v := .}}{{if $i}} {{end}}{{$v}}{{end}}
+{{- end }}
+{{- with .Env }}
+env:
+{{- range .}}
+    {{.}}
+{{- end}}
+{{- end }}
+{{- with .ExposedPorts }}
+exposedPorts: {{range $i, $v := .}}{{if $i}}, {{end}}{{$v}}{{end}}
+{{- end }}
+{{- with .User }}
+user: {{.}}
+{{- end }}
+{{- with .WorkingDir }}
+workingDir: {{.}}
+{{- end }}
+{{- end }}
+{{- with .History }}
+history:
+{{- range .}}
+    {{with .Created}}{{.Format "2006-01-02 15:04:05 MST"}}: {{end}}{{if .EmptyLayer}}(empty) {{end}}{{.CreatedBy}}
+{{- end}}
+{{- end }}
 {{- with .Annotations}}
 annotations:
 {{- range $k, $v := .}}
@@ -67,33 +134,115 @@ labels:
     {{$k}}: {{$v}}
 {{- end}}
 {{- end -}}
+{{- with .OSRelease}}
+osRelease: {{or .PRETTY_NAME .ID}}
+{{- end -}}
+{{- with .Flatpak}}
+flatpak: {{if .Branch}}<a href="/flatpak/{{.Kind}}/{{.Id}}/{{.Branch}}.flatpakref">{{.Id}}</a>{{else}}{{.Id}}{{end}}
+{{- end -}}
 {{- end}}
 <ul>
-{{- range .}}
+{{- range .Results}}
 <li>
 <h2>{{.Name}}</h2>
 <ul>
 {{- range .Images}}
 <li class="image" onclick="toggleDetails(event)">
-<pre class="tags">{{- range .Tags}}{{ . }} {{- end }}</pre>
+<pre class="tags">{{- range .Tags}}{{ . }} {{- end }}{{if .HasSignature}} [signed]{{end}}{{range .Verifications}}{{if .Verified}} [verified: {{.KeyId}}]{{end}}{{end}}{{if .HasSBOM}} [sbom]{{end}}{{with .Vulnerabilities}} [{{.Critical}} critical, {{.High}} high, {{.Medium}} medium, {{.Low}} low]{{end}}</pre>
 <pre class="details {{if .IsLatest}}{{else}}hidden{{end}}">{{template "Image" .}}</pre>
 </li>
 {{end}}
 {{- range .Lists}}
 <li class="list">
 <ul>
-<pre class="tags">{{- range .Tags}}{{ . }} {{- end }}</pre>
+<pre class="tags">{{- range .Tags}}{{ . }} {{- end }}{{if .HasSignature}} [signed]{{end}}{{range .Verifications}}{{if .Verified}} [verified: {{.KeyId}}]{{end}}{{end}}{{if .HasSBOM}} [sbom]{{end}}</pre>
+{{- with .Size }}
+<pre>size: {{formatSize .}}</pre>
+{{- end }}
 {{- range .Images}}
 <li class="image" onclick="toggleDetails(event)">
-<pre>{{template "Image" .}}</pre>
+<pre>{{template "Image" .}}
+{{- with .Vulnerabilities}}
+vulnerabilities: {{.Critical}} critical, {{.High}} high, {{.Medium}} medium, {{.Low}} low{{end}}</pre>
 </li>
 {{end}}
 </ul>
 <li>
 {{end}}
+{{- range .Artifacts}}
+<li class="artifact" onclick="toggleDetails(event)">
+<pre class="tags">{{- range .Tags}}{{ . }} {{- end }}{{if .HasSignature}} [signed]{{end}}{{range .Verifications}}{{if .Verified}} [verified: {{.KeyId}}]{{end}}{{end}}{{if .HasSBOM}} [sbom]{{end}}</pre>
+<pre class="details hidden">digest: {{.Digest}}
+artifactType: {{.ArtifactType}}
+{{- with .Size }}
+size: {{formatSize .}}
+{{- end }}
+{{- with .Helm }}
+chart: {{.Name}} {{.Version}}
+{{- with .AppVersion }}
+appVersion: {{.}}
+{{- end }}
+{{- with .Description }}
+description: {{.}}
+{{- end }}
+{{- end }}
+{{- with .Annotations}}
+annotations:
+{{- range $k, $v := .}}
+    {{$k}}: {{$v}}
+{{- end}}
+{{- end -}}
+</pre>
+</li>
+{{end}}
+{{- with .FailedTags}}
+<li class="failed">
+<pre>failed tags:
+{{- range .}}
+    {{.Tag}}{{with .Digest}} ({{.}}){{end}}: {{.Error}}
+{{- end}}</pre>
+</li>
+{{- end}}
 </ul>
 </li>
 {{end}}
 </ul>
 </body>
 `
+
+const statusHtmlTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+  <style type="text/css">
+table {
+    border-collapse: collapse;
+}
+td, th {
+    border: 1px solid #aaaaaa;
+    padding: 4px;
+    text-align: left;
+    vertical-align: top;
+}
+  </style>
+</head>
+<body>
+<h1>Unhealthy repositories</h1>
+{{- if . }}
+<table>
+<tr><th>repository</th><th>failures</th><th>last attempt</th><th>last success</th><th>error</th></tr>
+{{- range . }}
+<tr>
+<td>{{.Repository}}</td>
+<td>{{.ConsecutiveFailures}}</td>
+<td>{{with .LastAttempt}}{{.Format "2006-01-02 15:04:05 MST"}}{{end}}</td>
+<td>{{with .LastSuccess}}{{.Format "2006-01-02 15:04:05 MST"}}{{else}}never{{end}}</td>
+<td><pre>{{.LastError}}</pre></td>
+</tr>
+{{- end }}
+</table>
+{{- else }}
+<p>All repositories were fetched successfully.</p>
+{{- end }}
+</body>
+`
@@ -0,0 +1,130 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"github.com/owtaylor/flagstate"
+	"github.com/owtaylor/flagstate/database"
+	"github.com/owtaylor/flagstate/vulnerability"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Scanner output can be large, but not this large
+const maxReportSize = 256 * 1024 * 1024
+
+type vulnerabilityImportHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+// ServeHTTP imports the output of a scanner POSTed as the request body.
+// The digest and format parameters are optional if they can be found from
+// the output.
+func (vh *vulnerabilityImportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		badRequest(w, fmt.Errorf("Can only POST to /vulnerabilities"))
+		return
+	}
+
+	if !checkBearerToken(w, r, vh.config.Vulnerabilities.ImportToken) {
+		return
+	}
+
+	r.ParseForm()
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxReportSize))
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	report, err := vulnerability.ParseReport(data, r.Form.Get("format"))
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	dgst := report.Digest
+	if s := r.Form.Get("digest"); s != "" {
+		dgst, err = digest.ParseDigest(s)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	if dgst == "" {
+		badRequest(w, fmt.Errorf("digest must be specified"))
+		return
+	}
+
+	ctx := context.Background()
+	err = database.ImportVulnerabilities(ctx, vh.db, dgst, report.Scanner, report.Vulnerabilities)
+	if err == database.ErrImageNotFound {
+		notFound(w, err)
+		return
+	} else if err == database.ErrImageListDigest {
+		badRequest(w, err)
+		return
+	} else if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type vulnerabilityReportHandler struct {
+	config *flagstate.Config
+	db     database.Database
+}
+
+// ServeHTTP reports the repositories most affected by vulnerabilities that
+// are at least as severe as the severity parameter, LOW by default
+func (vh *vulnerabilityReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	severity := flagstate.SeverityLow
+	if s := r.Form.Get("severity"); s != "" {
+		if _, ok := flagstate.SeverityRank(s); !ok {
+			badRequest(w, fmt.Errorf("Invalid severity '%s'", s))
+			return
+		}
+		severity = s
+	}
+
+	limit := 0
+	if s := r.Form.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			badRequest(w, fmt.Errorf("Invalid limit '%s'", s))
+			return
+		}
+	}
+
+	SetCacheControl(w, vh.config.Cache.MaxAgeIndex.Value, false)
+	if CheckAndSetETag(vh.db, w, r) {
+		return
+	}
+
+	ctx := context.Background()
+	report, err := database.GetVulnerabilityReport(ctx, vh.db, severity, limit)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = encoder.Encode(report)
+	if err != nil {
+		log.Print(err)
+	}
+}